@@ -0,0 +1,298 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin serves the debug and config endpoints. Routes that change
+// things, anything but a GET or HEAD, can be limited to clients with a bearer
+// token or a client certificate, and every one of them is written to an audit
+// log along with who made it.
+package admin
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// DefaultAddr keeps the endpoints to the local host
+const DefaultAddr = "localhost:11299"
+
+var (
+	MetricDenied = metrics.AddCounter("admin_denied", nil)
+)
+
+// Options configures the admin server
+type Options struct {
+	// Addr is the address to listen on, DefaultAddr if empty
+	Addr string
+
+	// TokenFile holds the bearer tokens accepted, one per line as NAME:TOKEN.
+	// NAME is who the requests are recorded as. Blank lines and lines starting
+	// with # are skipped.
+	TokenFile string
+
+	// CertFile and KeyFile turn on TLS
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile holds the CAs client certificates are checked against. A
+	// client with a verified certificate is recorded as its common name. It
+	// needs TLS.
+	ClientCAFile string
+
+	// OpenReads leaves GET and HEAD requests open to everyone when there is
+	// auth, so metrics and profiles can be scraped without credentials
+	OpenReads bool
+
+	// Public are paths left open to GET and HEAD requests even without
+	// OpenReads, like health checks
+	Public []string
+}
+
+// Server is the admin endpoint in front of a handler, usually
+// http.DefaultServeMux
+type Server struct {
+	opts   Options
+	next   http.Handler
+	tokens map[string]string
+	tls    *tls.Config
+}
+
+// New checks opts and loads the tokens and certificates they name
+func New(next http.Handler, opts Options) (*Server, error) {
+	if opts.Addr == "" {
+		opts.Addr = DefaultAddr
+	}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("a TLS certificate and key must be given together")
+	}
+	if opts.ClientCAFile != "" && opts.CertFile == "" {
+		return nil, errors.New("client certificates need a TLS certificate and key")
+	}
+
+	s := &Server{opts: opts, next: next}
+
+	if opts.TokenFile != "" {
+		tokens, err := loadTokens(opts.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		s.tokens = tokens
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.ClientCAFile)
+		}
+		// Clients without a certificate can still use a token or the open
+		// routes
+		s.tls.ClientCAs = pool
+		s.tls.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return s, nil
+}
+
+// loadTokens reads a token file into a map of token to name
+func loadTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 || colon == len(line)-1 {
+			return nil, fmt.Errorf("%s:%d: expected NAME:TOKEN", path, n)
+		}
+		tokens[line[colon+1:]] = line[:colon]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in %s", path)
+	}
+	return tokens, nil
+}
+
+// ListenAndServe serves the endpoints, with TLS if it is configured
+func (s *Server) ListenAndServe() error {
+	srv := &http.Server{Addr: s.opts.Addr, Handler: s, TLSConfig: s.tls}
+	if s.tls != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// authRequired is whether anything needs credentials
+func (s *Server) authRequired() bool {
+	return s.tokens != nil || (s.tls != nil && s.tls.ClientCAs != nil)
+}
+
+// identify returns who made a request, and false if they gave no valid
+// credentials
+func (s *Server) identify(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for token, name := range s.tokens {
+			if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+				return name, true
+			}
+		}
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+
+	return "", false
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mutating := r.Method != "GET" && r.Method != "HEAD"
+
+	who, ok := s.identify(r)
+	if !ok {
+		who = r.RemoteAddr
+	}
+
+	if s.authRequired() && !ok && (mutating || !(s.opts.OpenReads || s.public(r.URL.Path))) {
+		metrics.IncCounter(MetricDenied)
+		if mutating {
+			Audit(who, "denied", request{Method: r.Method, Path: r.URL.Path, Status: 401})
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(401)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, who))
+	if !mutating {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w, status: 200}
+	s.next.ServeHTTP(sw, r)
+	Audit(who, "request", request{Method: r.Method, Path: r.URL.Path, Status: sw.status})
+}
+
+// public is whether reads of path are open to everyone
+func (s *Server) public(path string) bool {
+	for _, p := range s.opts.Public {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+// Identity returns who made a request served by a Server: the token's name or
+// the certificate's common name, or the remote address without credentials.
+// It is empty for requests that didn't come through a Server.
+func Identity(r *http.Request) string {
+	who, _ := r.Context().Value(identityKey{}).(string)
+	return who
+}
+
+// statusWriter remembers the status of a response for the audit log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// request is how a mutating request is described in the audit log
+type request struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+var audit = struct {
+	sync.Mutex
+	w io.Writer
+}{}
+
+// SetAuditLog sends the audit log to w. By default it goes to the standard
+// logger.
+func SetAuditLog(w io.Writer) {
+	audit.Lock()
+	defer audit.Unlock()
+	audit.w = w
+}
+
+// Audit writes an event to the audit log as a line of JSON, with details
+// marshalled as they are
+func Audit(who, event string, details interface{}) {
+	line, err := json.Marshal(struct {
+		Time    time.Time   `json:"time"`
+		Who     string      `json:"who"`
+		Event   string      `json:"event"`
+		Details interface{} `json:"details"`
+	}{time.Now(), who, event, details})
+	if err != nil {
+		log.Printf("Error: audit of %s by %s: %v\n", event, who, err)
+		return
+	}
+
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.w == nil {
+		log.Printf("Audit: %s\n", line)
+		return
+	}
+	audit.w.Write(append(line, '\n'))
+}
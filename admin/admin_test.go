@@ -0,0 +1,327 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/admin"
+	"github.com/netflix/rend-http/config"
+)
+
+// whoami responds with the identity of the request
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(admin.Identity(r)))
+})
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// writeCert writes a self-signed certificate and its key, which can serve as
+// its own CA
+func writeCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+func serve(s *admin.Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestTokens(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	writeFile(t, tokens, "# operators\nalice:s3cret\n\nbob:hunter2\n")
+
+	for _, open := range []bool{false, true} {
+		s, err := admin.New(whoami, admin.Options{TokenFile: tokens, OpenReads: open})
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		tests := []struct {
+			method string
+			token  string
+			status int
+			who    string
+		}{
+			{"PUT", "s3cret", 200, "alice"},
+			{"PUT", "hunter2", 200, "bob"},
+			{"PUT", "wrong", 401, ""},
+			{"PUT", "", 401, ""},
+			{"GET", "s3cret", 200, "alice"},
+			{"GET", "", map[bool]int{false: 401, true: 200}[open], ""},
+		}
+
+		for _, test := range tests {
+			r := httptest.NewRequest(test.method, "/config/foo", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := serve(s, r)
+
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d for %s with token %q (open reads %v) but got %d", test.status, test.method, test.token, open, w.Code)
+			}
+			if w.Code != 200 {
+				continue
+			}
+			who := test.who
+			if who == "" {
+				who = "10.0.0.1:1234"
+			}
+			if w.Body.String() != who {
+				t.Fatalf("Expected identity %q but got %q", who, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestPublic(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	writeFile(t, tokens, "alice:s3cret\n")
+
+	s, err := admin.New(whoami, admin.Options{TokenFile: tokens, Public: []string{"/readyz"}})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	if w := serve(s, httptest.NewRequest("GET", "/readyz", nil)); w.Code != 200 {
+		t.Fatalf("Expected a public path to be open but got %d", w.Code)
+	}
+	if w := serve(s, httptest.NewRequest("POST", "/readyz", nil)); w.Code != 401 {
+		t.Fatalf("Expected changes to a public path to need auth but got %d", w.Code)
+	}
+	if w := serve(s, httptest.NewRequest("GET", "/config", nil)); w.Code != 401 {
+		t.Fatalf("Expected other paths to need auth but got %d", w.Code)
+	}
+}
+
+func TestNoAuth(t *testing.T) {
+	s, err := admin.New(whoami, admin.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "/reload", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	if w := serve(s, r); w.Code != 200 || w.Body.String() != "127.0.0.1:1234" {
+		t.Fatalf("Expected requests to be open without auth but got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	cert, key := writeCert(t, dir)
+
+	if _, err := admin.New(whoami, admin.Options{ClientCAFile: cert}); err == nil {
+		t.Fatalf("Expected client certificates without TLS to be rejected")
+	}
+	if _, err := admin.New(whoami, admin.Options{CertFile: cert}); err == nil {
+		t.Fatalf("Expected a certificate without a key to be rejected")
+	}
+
+	s, err := admin.New(whoami, admin.Options{CertFile: cert, KeyFile: key, ClientCAFile: cert})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	r := httptest.NewRequest("DELETE", "/config/foo", nil)
+	r.TLS = &tls.ConnectionState{}
+	if w := serve(s, r); w.Code != 401 {
+		t.Fatalf("Expected status 401 without a client certificate but got %d", w.Code)
+	}
+
+	r.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "deployer"}}}},
+	}
+	if w := serve(s, r); w.Code != 200 || w.Body.String() != "deployer" {
+		t.Fatalf("Expected the certificate's common name but got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// auditEvent is an audit line of a request
+type auditEvent struct {
+	Who     string
+	Event   string
+	Details struct {
+		Method string
+		Path   string
+		Status int
+	}
+}
+
+func TestAudit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	admin.SetAuditLog(buf)
+	defer admin.SetAuditLog(nil)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	writeFile(t, tokens, "alice:s3cret\n")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+	})
+	s, err := admin.New(next, admin.Options{TokenFile: tokens})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	r := httptest.NewRequest("PATCH", "/config", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	serve(s, r)
+	serve(s, httptest.NewRequest("POST", "/reload", nil))
+	serve(s, httptest.NewRequest("GET", "/config", nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected an audit line per mutating request but got %q", buf.String())
+	}
+
+	var events []auditEvent
+	for _, line := range lines {
+		var e auditEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Got bad audit line %q: %v", line, err)
+		}
+		events = append(events, e)
+	}
+
+	if e := events[0]; e.Who != "alice" || e.Event != "request" || e.Details.Method != "PATCH" || e.Details.Status != 400 {
+		t.Fatalf("Got bad audit event: %+v", e)
+	}
+	if e := events[1]; e.Event != "denied" || e.Details.Path != "/reload" || e.Details.Status != 401 {
+		t.Fatalf("Got bad audit event: %+v", e)
+	}
+}
+
+func TestAuditConfig(t *testing.T) {
+	buf := &bytes.Buffer{}
+	admin.SetAuditLog(buf)
+	defer admin.SetAuditLog(nil)
+	config.SetIdentity(admin.Identity)
+	config.OnChange(func(who string, keys []config.KeyChange) {
+		admin.Audit(who, "config", keys)
+	})
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	writeFile(t, tokens, "alice:s3cret\n")
+
+	s, err := admin.New(http.DefaultServeMux, admin.Options{TokenFile: tokens})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	r := httptest.NewRequest("PUT", "/config/auditedKey", strings.NewReader("5"))
+	r.Header.Set("Authorization", "Bearer s3cret")
+	if w := serve(s, r); w.Code != 200 {
+		t.Fatalf("Expected status code of 200 but got %v", w.Code)
+	}
+
+	// One line for the request and one with the values for the change
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two audit lines for the change but got %q", buf.String())
+	}
+
+	var e struct {
+		Who     string
+		Event   string
+		Details []config.KeyChange
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("Got bad audit line %q: %v", lines[0], err)
+	}
+	if e.Who != "alice" || e.Event != "config" || len(e.Details) != 1 || e.Details[0].Key != "auditedKey" ||
+		e.Details[0].New == nil || *e.Details[0].New != "5" {
+		t.Fatalf("Got bad audit event: %q", lines[0])
+	}
+
+	// The change is still attributed in the history
+	r = httptest.NewRequest("GET", "/config/history", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	var history []struct {
+		Who string `json:"who"`
+	}
+	if err := json.Unmarshal(serve(s, r).Body.Bytes(), &history); err != nil {
+		t.Fatalf("Got bad history: %v", err)
+	}
+	if len(history) == 0 || history[len(history)-1].Who != "alice" {
+		t.Fatalf("Expected the change to be recorded as alice's but got %+v", history)
+	}
+}
@@ -15,20 +15,144 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	endpointPath = "/config"
 )
 
-// In this (small) universe, all config is an int
-type conf map[string]int
+// Config values are set as strings and parsed up front as each type they can
+// be read as
+type conf map[string]value
+
+// kind is a type config values can be read as
+type kind int
+
+const (
+	kindInt kind = iota
+	kindFloat
+	kindBool
+	kindDuration
+	kindString
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindInt:
+		return "an int"
+	case kindFloat:
+		return "a float"
+	case kindBool:
+		return "a bool"
+	case kindDuration:
+		return "a duration"
+	}
+	return "a string"
+}
+
+// name is how the kind is listed in JSON
+func (k kind) name() string {
+	switch k {
+	case kindInt:
+		return "int"
+	case kindFloat:
+		return "float"
+	case kindBool:
+		return "bool"
+	case kindDuration:
+		return "duration"
+	}
+	return "string"
+}
+
+type value struct {
+	raw string
+
+	i int
+	f float64
+	b bool
+	d time.Duration
+
+	isInt, isFloat, isBool, isDuration bool
+}
+
+func parse(raw string) value {
+	v := value{raw: raw}
+
+	var err error
+	v.i, err = strconv.Atoi(raw)
+	v.isInt = err == nil
+	v.f, err = strconv.ParseFloat(raw, 64)
+	v.isFloat = err == nil
+	v.b, err = strconv.ParseBool(raw)
+	v.isBool = err == nil
+	v.d, err = time.ParseDuration(raw)
+	v.isDuration = err == nil
+
+	return v
+}
+
+func (v value) is(k kind) bool {
+	switch k {
+	case kindInt:
+		return v.isInt
+	case kindFloat:
+		return v.isFloat
+	case kindBool:
+		return v.isBool
+	case kindDuration:
+		return v.isDuration
+	}
+	return true
+}
+
+// typed returns the value as k for listing in JSON, or as it was written if
+// it isn't one. Durations are always listed as written.
+func (v value) typed(k kind) interface{} {
+	switch {
+	case k == kindInt && v.isInt:
+		return v.i
+	case k == kindFloat && v.isFloat:
+		return v.f
+	case k == kindBool && v.isBool:
+		return v.b
+	}
+	return v.raw
+}
+
+// kinds holds the type each key was first read as, which values set for it
+// must parse as
+var kinds sync.Map
+
+func expect(key string, k kind) {
+	if _, ok := kinds.Load(key); !ok {
+		kinds.LoadOrStore(key, k)
+	}
+}
+
+// check returns an error if raw can't be read as the type of key, or of the
+// key it is scoped from
+func check(key string, v value) error {
+	k, ok := kinds.Load(key)
+	if !ok {
+		k, ok = kinds.Load(unscoped(key))
+	}
+	if ok && !v.is(k.(kind)) {
+		return fmt.Errorf("%s must be %v, got %q", key, k, v.raw)
+	}
+	return nil
+}
 
 func copyConf(orig conf) conf {
 	ret := make(conf)
@@ -50,85 +174,390 @@ func init() {
 func handleConfig(w http.ResponseWriter, r *http.Request) {
 	// Allow GET to retrieve a specific config (or all)
 	// Allow PUT to set a specific config
+	// Allow PATCH to set several configs at once
+	// Allow DELETE to revert a specific config to its default
 	// Otherwise return a 405 Method Not Allowed
 
+	// Take the "/config" off the front, and the slash before the key
+	key := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, endpointPath))
+	key = strings.TrimPrefix(key, "/")
+
+	if key == historyPath || strings.HasPrefix(key, historyPath+"/") {
+		handleHistory(w, r, strings.TrimPrefix(key, historyPath))
+		return
+	}
+
 	switch r.Method {
 	case "GET":
-		// read from value then map
 		// If the path does not include a key, print all config
 		// If it does include a key, use it to look up in the map and print that value
-
-		// Take the "/config" off the front
-		key := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, endpointPath))
 		c := confHolder.Load().(conf)
 
-		if key == "" || key == "/" {
-			// print all config
-			for k, v := range c {
-				fmt.Fprintf(w, "%s %d\n", k, v)
-			}
-
-		} else {
-			// print specific config
-			// assume the rest of the path is the config key
-
-			// skip the leading slash
-			key = key[1:]
-
-			if v, ok := c[key]; ok {
-				fmt.Fprintf(w, "%s %d\n", key, v)
+		if wantsJSON(r) {
+			entries := listEntries(c)
+			if key == "" {
+				writeJSON(w, entries)
+			} else if e, ok := entries[key]; ok {
+				writeJSON(w, e)
 			} else {
 				w.WriteHeader(404)
 			}
+			return
 		}
 
-	case "PUT":
-		// read from value, copy config, modify copy, store copy
-		// The body of the request is assumed to be a string that can be converted into an int
-		// Otherwise the handler will return 400
+		if key == "" {
+			// print all config, in order
+			for _, k := range sortedKeys(c) {
+				fmt.Fprintf(w, "%s %s\n", k, c[k].raw)
+			}
+		} else if v, ok := c[key]; ok {
+			fmt.Fprintf(w, "%s %s\n", key, v.raw)
+		} else {
+			w.WriteHeader(404)
+		}
 
-		// Translate path into a key
-		key := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, endpointPath))
-		if key == "" || key == "/" {
+	case "PUT":
+		// The body of the request must parse as the type the key is read as,
+		// otherwise the handler will return 400
+		if key == "" {
 			w.WriteHeader(400)
 			return
 		}
 
-		// skip the / at the beginning
-		key = key[1:]
-
-		// Extract body and turn into int
-		raw, err := ioutil.ReadAll(r.Body)
+		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			w.WriteHeader(500)
 			return
 		}
 		r.Body.Close()
 
-		v, err := strconv.Atoi(string(raw))
+		raw := strings.TrimSpace(string(body))
+		if _, err := update(requester(r), map[string]*string{key: &raw}); err != nil {
+			writeUpdateError(w, err)
+		}
+
+	case "PATCH":
+		// The body is a JSON object of keys to values, with null reverting a
+		// key to its default. Either every key is changed or none are.
+		if key != "" {
+			w.WriteHeader(400)
+			return
+		}
+
+		changes, err := decodePatch(r.Body)
+		r.Body.Close()
 		if err != nil {
-			w.WriteHeader(500)
+			w.WriteHeader(400)
+			fmt.Fprintln(w, err)
 			return
 		}
 
-		c := confHolder.Load().(conf)
-		c = copyConf(c)
-		c[key] = v
+		rec, err := update(requester(r), changes)
+		if err != nil {
+			writeUpdateError(w, err)
+			return
+		}
+		if rec != nil {
+			writeJSON(w, rec)
+		}
+
+	case "DELETE":
+		// Remove a specific config so its default is used again
+		if key == "" {
+			w.WriteHeader(400)
+			return
+		}
+		if _, ok := confHolder.Load().(conf)[key]; !ok {
+			w.WriteHeader(404)
+			return
+		}
 
-		confHolder.Store(c)
+		if _, err := update(requester(r), map[string]*string{key: nil}); err != nil {
+			writeUpdateError(w, err)
+		}
 
 	default:
 		w.WriteHeader(405)
 	}
 }
 
+// identity names who made a request, see SetIdentity
+var identity = func(r *http.Request) string { return "" }
+
+// SetIdentity sets how requests to the config endpoint are named in the
+// history, for example by the credentials they were made with. Requests it
+// returns "" for are named by their remote address. It must be called before
+// the endpoint serves any requests.
+func SetIdentity(f func(r *http.Request) string) {
+	identity = f
+}
+
+// requester names who made a request, for the history
+func requester(r *http.Request) string {
+	if who := identity(r); who != "" {
+		return who
+	}
+	return r.RemoteAddr
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeUpdateError responds to a failed update: a 500 if the config couldn't
+// be saved and a 400 for a bad value
+func writeUpdateError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*storeError); ok {
+		w.WriteHeader(500)
+	} else {
+		w.WriteHeader(400)
+	}
+	fmt.Fprintln(w, err)
+}
+
+// decodePatch reads a PATCH body into the changes for update. Values may be
+// JSON strings, numbers or bools, which are set as they are written.
+func decodePatch(body io.Reader) (map[string]*string, error) {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("invalid JSON object: %v", err)
+	}
+
+	changes := make(map[string]*string, len(fields))
+	for key, f := range fields {
+		var raw string
+		switch f := f.(type) {
+		case nil:
+			changes[key] = nil
+			continue
+		case string:
+			raw = strings.TrimSpace(f)
+		case json.Number:
+			raw = f.String()
+		case bool:
+			raw = strconv.FormatBool(f)
+		default:
+			return nil, fmt.Errorf("%s must be a string, number, bool or null", key)
+		}
+		changes[key] = &raw
+	}
+	return changes, nil
+}
+
+// entry is how a key is listed as JSON. Value is left out if the key isn't
+// set and Default if it hasn't been read yet.
+type entry struct {
+	Value   interface{} `json:"value,omitempty"`
+	Default interface{} `json:"default,omitempty"`
+	Type    string      `json:"type,omitempty"`
+}
+
+// listEntries lists every key that is set or has been read, with values as
+// the type they are read as
+func listEntries(c conf) map[string]entry {
+	entries := make(map[string]entry)
+	kindOf := func(key string) (kind, bool) {
+		k, ok := kinds.Load(key)
+		if !ok {
+			k, ok = kinds.Load(unscoped(key))
+		}
+		if !ok {
+			return 0, false
+		}
+		return k.(kind), true
+	}
+
+	for key, v := range c {
+		e := entry{Value: v.raw}
+		if k, ok := kindOf(key); ok {
+			e.Type = k.name()
+			e.Value = v.typed(k)
+		}
+		entries[key] = e
+	}
+
+	defaults.Range(func(key, d interface{}) bool {
+		e := entries[key.(string)]
+		if dur, ok := d.(time.Duration); ok {
+			d = dur.String()
+		}
+		e.Default = d
+		if k, ok := kindOf(key.(string)); ok {
+			e.Type = k.name()
+		}
+		entries[key.(string)] = e
+		return true
+	})
+
+	return entries
+}
+
+func sortedKeys(c conf) []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMu serializes changes so none are lost. Subscribers are notified after
+// it is released, so they can read and change the config themselves.
+var writeMu sync.Mutex
+
+// update checks and stores changes to several keys at once, all or none, then
+// notifies the subscribers of each key that changed. A nil value removes its
+// key so the default is used again. It returns the change recorded in the
+// history, or nil if every key already had its value.
+func update(who string, changes map[string]*string) (*change, error) {
+	writeMu.Lock()
+	rec, err := updateLocked(change{Who: who}, changes)
+	writeMu.Unlock()
+
+	notifyChange(rec)
+	return rec, err
+}
+
+// updateLocked is update, filling in and recording rec, without notifying
+// the subscribers. It must be called with writeMu held.
+func updateLocked(rec change, changes map[string]*string) (*change, error) {
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	c := confHolder.Load().(conf)
+	next := copyConf(c)
+
+	for _, key := range keys {
+		raw := changes[key]
+		old, wasSet := c[key]
+
+		kc := KeyChange{Key: key}
+		if wasSet {
+			kc.Old = &old.raw
+		}
+
+		if raw == nil {
+			if !wasSet {
+				continue
+			}
+			delete(next, key)
+		} else {
+			if wasSet && old.raw == *raw {
+				continue
+			}
+			v := parse(*raw)
+			if err := check(key, v); err != nil {
+				return nil, err
+			}
+			if err := validate(key, *raw); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", key, *raw, err)
+			}
+			next[key] = v
+			kc.New = &v.raw
+		}
+
+		rec.Keys = append(rec.Keys, kc)
+	}
+
+	if len(rec.Keys) == 0 {
+		return nil, nil
+	}
+
+	if err := save(next); err != nil {
+		return nil, err
+	}
+	confHolder.Store(next)
+	rec = record(rec)
+	return &rec, nil
+}
+
+// lookup returns the value of key if it is set and can be read as k
+func lookup(key string, k kind) (value, bool) {
+	expect(key, k)
+
+	c := confHolder.Load().(conf)
+	v, ok := c[key]
+	if !ok || !v.is(k) {
+		return value{}, false
+	}
+	return v, true
+}
+
+// GetForCache is Get for a key that can be set for one cache, like
+// "cache/MY_CACHE/numTries", falling back to the key for all of them
+func GetForCache(cache, key string, otherwise int) int {
+	if v, ok := lookup(CacheKey(cache, key), kindInt); ok {
+		return v.i
+	}
+	return Get(key, otherwise)
+}
+
+// defaults holds the default each key was first read with, for listing
+var defaults sync.Map
+
 // Get retrieves the value from the configuration or, if it's not explicitly set, returns otherwise
 func Get(key string, otherwise int) int {
-	c := confHolder.Load().(conf)
+	if _, ok := defaults.Load(key); !ok {
+		defaults.LoadOrStore(key, otherwise)
+	}
+	if v, ok := lookup(key, kindInt); ok {
+		return v.i
+	}
+	return otherwise
+}
 
-	if v, ok := c[key]; ok {
-		return v
+// GetFloat is Get for float values
+func GetFloat(key string, otherwise float64) float64 {
+	if _, ok := defaults.Load(key); !ok {
+		defaults.LoadOrStore(key, otherwise)
+	}
+	if v, ok := lookup(key, kindFloat); ok {
+		return v.f
 	}
+	return otherwise
+}
 
+// GetBool is Get for bool values, written as strconv.ParseBool accepts them
+func GetBool(key string, otherwise bool) bool {
+	if _, ok := defaults.Load(key); !ok {
+		defaults.LoadOrStore(key, otherwise)
+	}
+	if v, ok := lookup(key, kindBool); ok {
+		return v.b
+	}
+	return otherwise
+}
+
+// GetDuration is Get for durations, written like "500ms"
+func GetDuration(key string, otherwise time.Duration) time.Duration {
+	if _, ok := defaults.Load(key); !ok {
+		defaults.LoadOrStore(key, otherwise)
+	}
+	if v, ok := lookup(key, kindDuration); ok {
+		return v.d
+	}
+	return otherwise
+}
+
+// GetString is Get for strings, which any value can be read as
+func GetString(key string, otherwise string) string {
+	if _, ok := defaults.Load(key); !ok {
+		defaults.LoadOrStore(key, otherwise)
+	}
+	if v, ok := lookup(key, kindString); ok {
+		return v.raw
+	}
 	return otherwise
 }
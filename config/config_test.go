@@ -16,15 +16,22 @@ package config
 
 import (
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 )
 
 import "os"
 
 func TestMain(m *testing.M) {
-	go http.ListenAndServe("127.0.0.1:55555", nil)
+	// Listen before the tests start so the first request isn't refused
+	l, err := net.Listen("tcp", "127.0.0.1:55555")
+	if err != nil {
+		panic(err)
+	}
+	go http.Serve(l, nil)
 	os.Exit(m.Run())
 }
 
@@ -32,8 +39,8 @@ func TestHTTPEndpoint(t *testing.T) {
 	t.Run("GET", func(t *testing.T) {
 		t.Run("All", func(t *testing.T) {
 			confHolder.Store(conf{
-				"foo": 4,
-				"bar": 5,
+				"foo": parse("4"),
+				"bar": parse("5"),
 			})
 
 			res, err := http.Get("http://localhost:55555/config")
@@ -50,14 +57,14 @@ func TestHTTPEndpoint(t *testing.T) {
 				t.Fatalf("Got error reading get response: %v", err)
 			}
 
-			if string(body) != "foo 4\nbar 5\n" {
+			if string(body) != "bar 5\nfoo 4\n" {
 				t.Fatalf("Got bad response: %v", string(body))
 			}
 		})
 		t.Run("Single", func(t *testing.T) {
 			confHolder.Store(conf{
-				"foo": 4,
-				"bar": 5,
+				"foo": parse("4"),
+				"bar": parse("5"),
 			})
 
 			res, err := http.Get("http://localhost:55555/config/foo")
@@ -80,8 +87,8 @@ func TestHTTPEndpoint(t *testing.T) {
 		})
 		t.Run("Miss", func(t *testing.T) {
 			confHolder.Store(conf{
-				"foo": 4,
-				"bar": 5,
+				"foo": parse("4"),
+				"bar": parse("5"),
 			})
 
 			res, err := http.Get("http://localhost:55555/config/baz")
@@ -112,7 +119,7 @@ func TestHTTPEndpoint(t *testing.T) {
 		c := confHolder.Load().(conf)
 
 		if v, ok := c["foo"]; ok {
-			if v != 4 {
+			if v.i != 4 {
 				t.Fatalf("Expected stored value of 4 but got %v", v)
 			}
 		} else {
@@ -174,8 +181,8 @@ func TestHTTPEndpoint(t *testing.T) {
 func TestGet(t *testing.T) {
 	t.Run("ExplicitlySet", func(t *testing.T) {
 		confHolder.Store(conf{
-			"foo": 4,
-			"bar": 5,
+			"foo": parse("4"),
+			"bar": parse("5"),
 		})
 
 		v := Get("foo", 17)
@@ -194,3 +201,94 @@ func TestGet(t *testing.T) {
 		}
 	})
 }
+
+func put(t *testing.T, key, body string) *http.Response {
+	req, err := http.NewRequest("PUT", "http://localhost:55555/config/"+key, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Got error during request creation (this is a bug in the test): %v", err)
+	}
+
+	res, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatalf("Got error performing request: %v", err)
+	}
+	return res
+}
+
+func TestTypedGet(t *testing.T) {
+	confHolder.Store(conf{
+		"int":      parse("4"),
+		"float":    parse("0.99"),
+		"bool":     parse("true"),
+		"duration": parse("500ms"),
+		"string":   parse("a,b"),
+	})
+
+	if v := GetFloat("float", 0.5); v != 0.99 {
+		t.Fatalf("Expected to get value 0.99 but got %v", v)
+	}
+	if v := GetFloat("int", 0.5); v != 4 {
+		t.Fatalf("Expected an int to be read as a float but got %v", v)
+	}
+	if v := GetBool("bool", false); !v {
+		t.Fatalf("Expected to get value true but got %v", v)
+	}
+	if v := GetDuration("duration", time.Second); v != 500*time.Millisecond {
+		t.Fatalf("Expected to get value 500ms but got %v", v)
+	}
+	if v := GetString("string", ""); v != "a,b" {
+		t.Fatalf("Expected to get value a,b but got %v", v)
+	}
+	if v := GetString("int", ""); v != "4" {
+		t.Fatalf("Expected an int to be read as a string but got %v", v)
+	}
+
+	// Values of the wrong type and missing values fall back to the default
+	if v := Get("string", 17); v != 17 {
+		t.Fatalf("Expected to get value 17 but got %v", v)
+	}
+	if v := GetDuration("missing", time.Second); v != time.Second {
+		t.Fatalf("Expected to get value 1s but got %v", v)
+	}
+}
+
+func TestTypedPUT(t *testing.T) {
+	confHolder.Store(conf{})
+
+	// Reading the keys sets their types
+	Get("typedInt", 0)
+	GetDuration("typedDuration", 0)
+	GetBool("typedBool", false)
+
+	tests := []struct {
+		key    string
+		body   string
+		status int
+	}{
+		{"typedInt", "3", 200},
+		{"typedInt", "3.5", 400},
+		{"typedInt", "abc", 400},
+		{"typedDuration", "250ms", 200},
+		{"typedDuration", "250", 400},
+		{"typedBool", "false", 200},
+		{"typedBool", "nope", 400},
+		{"untyped", "anything", 200},
+	}
+
+	for _, test := range tests {
+		res := put(t, test.key, test.body)
+		if res.StatusCode != test.status {
+			t.Fatalf("Expected status code of %d for %s=%s but got %v", test.status, test.key, test.body, res.StatusCode)
+		}
+	}
+
+	if v := Get("typedInt", 0); v != 3 {
+		t.Fatalf("Expected a rejected value to leave the old one but got %v", v)
+	}
+	if v := GetDuration("typedDuration", 0); v != 250*time.Millisecond {
+		t.Fatalf("Expected to get value 250ms but got %v", v)
+	}
+	if v := GetString("untyped", ""); v != "anything" {
+		t.Fatalf("Expected to get value anything but got %v", v)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// historyPath is under /config, so it can't be used as a key
+	historyPath = "history"
+
+	// maxHistory is how many changes are kept, oldest dropped first
+	maxHistory = 1000
+)
+
+// change is one update of the config, as listed at /config/history
+type change struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+	Who  string    `json:"who"`
+
+	// RollbackOf is the ID of the change this one undid, if any
+	RollbackOf int `json:"rollbackOf,omitempty"`
+
+	Keys []KeyChange `json:"keys"`
+}
+
+// KeyChange is what happened to one key in a change. Old is nil if the key
+// wasn't set before and New is nil if it was removed.
+type KeyChange struct {
+	Key string  `json:"key"`
+	Old *string `json:"old"`
+	New *string `json:"new"`
+}
+
+// The history is kept in memory only, so it starts over on restart. It is
+// guarded by writeMu.
+var (
+	history      []change
+	nextChangeID = 1
+)
+
+var errNoChange = errors.New("no such change in the history")
+
+// record adds a change to the history, giving it an ID and time. It must be
+// called with writeMu held.
+func record(ch change) change {
+	ch.ID = nextChangeID
+	ch.Time = time.Now()
+	nextChangeID++
+
+	history = append(history, ch)
+	if len(history) > maxHistory {
+		history = append([]change(nil), history[len(history)-maxHistory:]...)
+	}
+	return ch
+}
+
+// conflictError is returned for a rollback of a change whose keys have been
+// changed again since
+type conflictError struct {
+	keys []string
+}
+
+func (e *conflictError) Error() string {
+	return "changed since: " + strings.Join(e.keys, ", ")
+}
+
+// rollback sets each key in change id back to what it was before. The values
+// are checked again, since the validators may have changed since. Unless
+// force is set, it fails with a conflictError if any of the keys no longer
+// has the value the change gave it.
+func rollback(who string, id int, force bool) (*change, error) {
+	writeMu.Lock()
+	rec, err := rollbackLocked(who, id, force)
+	writeMu.Unlock()
+
+	notifyChange(rec)
+	return rec, err
+}
+
+func rollbackLocked(who string, id int, force bool) (*change, error) {
+	for _, ch := range history {
+		if ch.ID != id {
+			continue
+		}
+
+		c := confHolder.Load().(conf)
+		var conflicts []string
+		changes := make(map[string]*string, len(ch.Keys))
+		for _, kc := range ch.Keys {
+			cur, set := c[kc.Key]
+			if set != (kc.New != nil) || (set && cur.raw != *kc.New) {
+				conflicts = append(conflicts, kc.Key)
+			}
+			changes[kc.Key] = kc.Old
+		}
+		if len(conflicts) > 0 && !force {
+			return nil, &conflictError{conflicts}
+		}
+
+		return updateLocked(change{Who: who, RollbackOf: id}, changes)
+	}
+	return nil, errNoChange
+}
+
+// handleHistory serves the history at /config/history, oldest first, and
+// rolls back a change on a POST to /config/history/<id>/rollback, which fails
+// with a 409 if its keys were changed again since unless ?force=true is given.
+// The path is what comes after "history".
+func handleHistory(w http.ResponseWriter, r *http.Request, path string) {
+	if path == "" || path == "/" {
+		if r.Method != "GET" {
+			w.WriteHeader(405)
+			return
+		}
+		writeMu.Lock()
+		list := append([]change{}, history...)
+		writeMu.Unlock()
+		writeJSON(w, list)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 || parts[1] != "rollback" {
+		w.WriteHeader(404)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	rec, err := rollback(requester(r), id, force)
+	if err == errNoChange {
+		w.WriteHeader(404)
+		return
+	}
+	if _, ok := err.(*conflictError); ok {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if err != nil {
+		writeUpdateError(w, err)
+		return
+	}
+	if rec != nil {
+		writeJSON(w, rec)
+	}
+}
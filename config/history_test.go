@@ -0,0 +1,216 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func patch(t *testing.T, body string) *http.Response {
+	req, err := http.NewRequest("PATCH", "http://localhost:55555/config", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Got error during request creation (this is a bug in the test): %v", err)
+	}
+
+	res, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatalf("Got error performing request: %v", err)
+	}
+	return res
+}
+
+func getJSON(t *testing.T, path string, v interface{}) {
+	req, err := http.NewRequest("GET", "http://localhost:55555"+path, nil)
+	if err != nil {
+		t.Fatalf("Got error during request creation (this is a bug in the test): %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatalf("Got error performing request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected status code of 200 for %s but got %v", path, res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("Got error decoding %s: %v", path, err)
+	}
+}
+
+func lastChange(t *testing.T) change {
+	var list []change
+	getJSON(t, "/config/history", &list)
+	if len(list) == 0 {
+		t.Fatalf("Expected a change in the history")
+	}
+	return list[len(list)-1]
+}
+
+func TestJSON(t *testing.T) {
+	confHolder.Store(conf{
+		"jsonInt":   parse("4"),
+		"jsonOther": parse("abc"),
+	})
+	Get("jsonInt", 7)
+	GetDuration("jsonDuration", time.Second)
+
+	var all map[string]map[string]interface{}
+	getJSON(t, "/config", &all)
+
+	if e := all["jsonInt"]; e["value"] != 4.0 || e["default"] != 7.0 || e["type"] != "int" {
+		t.Fatalf("Got bad entry for jsonInt: %v", e)
+	}
+	if e := all["jsonDuration"]; e["value"] != nil || e["default"] != "1s" || e["type"] != "duration" {
+		t.Fatalf("Got bad entry for jsonDuration: %v", e)
+	}
+	if e := all["jsonOther"]; e["value"] != "abc" || e["default"] != nil {
+		t.Fatalf("Got bad entry for jsonOther: %v", e)
+	}
+
+	var one map[string]interface{}
+	getJSON(t, "/config/jsonInt", &one)
+	if one["value"] != 4.0 {
+		t.Fatalf("Got bad entry for jsonInt: %v", one)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	confHolder.Store(conf{"patchGone": parse("x")})
+	ValidateInt("patchInt", MinInt(0))
+
+	var seen []string
+	defer Subscribe("patchInt", func() { seen = append(seen, "patchInt") })()
+	defer Subscribe("patchGone", func() { seen = append(seen, "patchGone") })()
+
+	res := patch(t, `{"patchInt": 3, "patchBool": true, "patchString": " a ", "patchGone": null}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected status code of 200 but got %v", res.StatusCode)
+	}
+	if v := Get("patchInt", 0); v != 3 {
+		t.Fatalf("Expected to get value 3 but got %v", v)
+	}
+	if v := GetBool("patchBool", false); !v {
+		t.Fatalf("Expected to get value true but got %v", v)
+	}
+	if v := GetString("patchString", ""); v != "a" {
+		t.Fatalf("Expected to get value a but got %q", v)
+	}
+	if v := GetString("patchGone", "default"); v != "default" {
+		t.Fatalf("Expected patchGone to be removed but got %v", v)
+	}
+	if fmt.Sprint(seen) != "[patchGone patchInt]" {
+		t.Fatalf("Expected subscribers to be notified in key order but got %v", seen)
+	}
+
+	// One bad value rejects the whole patch
+	for _, body := range []string{
+		`{"patchInt": -1, "patchBool": false}`,
+		`{"patchInt": [1], "patchBool": false}`,
+		`not json`,
+	} {
+		if code := patch(t, body).StatusCode; code != 400 {
+			t.Fatalf("Expected status code of 400 for %s but got %v", body, code)
+		}
+	}
+	if v := GetBool("patchBool", false); !v {
+		t.Fatalf("Expected a rejected patch to change nothing but got %v", v)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	confHolder.Store(conf{})
+
+	put(t, "historyA", "1")
+	patch(t, `{"historyA": 2, "historyB": "b"}`)
+
+	ch := lastChange(t)
+	if len(ch.Keys) != 2 || ch.Who == "" || ch.Time.IsZero() {
+		t.Fatalf("Got bad change: %+v", ch)
+	}
+	a, b := ch.Keys[0], ch.Keys[1]
+	if a.Key != "historyA" || *a.Old != "1" || *a.New != "2" {
+		t.Fatalf("Got bad change to historyA: %+v", a)
+	}
+	if b.Key != "historyB" || b.Old != nil || *b.New != "b" {
+		t.Fatalf("Got bad change to historyB: %+v", b)
+	}
+
+	res, err := http.Post(fmt.Sprintf("http://localhost:55555/config/history/%d/rollback", ch.ID), "", nil)
+	if err != nil {
+		t.Fatalf("Got error during http post: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected status code of 200 but got %v: %s", res.StatusCode, body)
+	}
+
+	if v := Get("historyA", 0); v != 1 {
+		t.Fatalf("Expected historyA to be rolled back to 1 but got %v", v)
+	}
+	if _, ok := confHolder.Load().(conf)["historyB"]; ok {
+		t.Fatalf("Expected historyB to be removed by the rollback")
+	}
+	if rb := lastChange(t); rb.RollbackOf != ch.ID || len(rb.Keys) != 2 {
+		t.Fatalf("Expected the rollback to be recorded but got %+v", rb)
+	}
+
+	res, err = http.Post("http://localhost:55555/config/history/0/rollback", "", nil)
+	if err != nil {
+		t.Fatalf("Got error during http post: %v", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("Expected status code of 404 for a missing change but got %v", res.StatusCode)
+	}
+}
+
+func TestRollbackConflict(t *testing.T) {
+	confHolder.Store(conf{})
+
+	put(t, "conflicted", "1")
+	put(t, "conflicted", "2")
+	ch := lastChange(t)
+	put(t, "conflicted", "3")
+
+	url := fmt.Sprintf("http://localhost:55555/config/history/%d/rollback", ch.ID)
+	res, err := http.Post(url, "", nil)
+	if err != nil {
+		t.Fatalf("Got error during http post: %v", err)
+	}
+	if res.StatusCode != 409 {
+		t.Fatalf("Expected status code of 409 for a key changed since but got %v", res.StatusCode)
+	}
+	if v := Get("conflicted", 0); v != 3 {
+		t.Fatalf("Expected the later change to be kept but got %v", v)
+	}
+
+	res, err = http.Post(url+"?force=true", "", nil)
+	if err != nil {
+		t.Fatalf("Got error during http post: %v", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected status code of 200 for a forced rollback but got %v", res.StatusCode)
+	}
+	if v := Get("conflicted", 0); v != 1 {
+		t.Fatalf("Expected a forced rollback to 1 but got %v", v)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+var hooks = struct {
+	sync.Mutex
+	validators map[string]func(raw string) error
+	subs       map[string]map[int]func()
+	nextSub    int
+	onChange   []func(who string, keys []KeyChange)
+}{
+	validators: make(map[string]func(raw string) error),
+	subs:       make(map[string]map[int]func()),
+}
+
+// Validate sets the check for values of key, replacing any set before. Values
+// it returns an error for are rejected, so a PUT of them fails with a 400. The
+// check also applies to the key scoped to a cache, unless it has its own.
+func Validate(key string, check func(raw string) error) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.validators[key] = check
+}
+
+// ValidateInt is Validate for an int key. It also makes the key an int, so
+// values that aren't are rejected before they get to check.
+func ValidateInt(key string, check func(v int) error) {
+	kinds.Store(key, kindInt)
+	Validate(key, func(raw string) error {
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		return check(v)
+	})
+}
+
+// MinInt is a check for ValidateInt that values are at least min
+func MinInt(min int) func(v int) error {
+	return func(v int) error {
+		if v < min {
+			return fmt.Errorf("must be at least %d", min)
+		}
+		return nil
+	}
+}
+
+func validate(key, raw string) error {
+	hooks.Lock()
+	check, ok := hooks.validators[key]
+	if !ok {
+		check = hooks.validators[unscoped(key)]
+	}
+	hooks.Unlock()
+
+	if check == nil {
+		return nil
+	}
+	return check(raw)
+}
+
+// Subscribe calls onChange once after each change to key is stored, until the
+// returned function is called to unsubscribe. Setting a key to the value it
+// already has isn't a change. A change to the key scoped to any cache, like
+// "cache/MY_CACHE/key", is also a change to key, since it changes what
+// GetForCache returns. onChange is called after the change is stored,
+// and should read the new value with one of the getters. It may change the
+// config itself.
+func Subscribe(key string, onChange func()) (unsubscribe func()) {
+	hooks.Lock()
+	defer hooks.Unlock()
+
+	id := hooks.nextSub
+	hooks.nextSub++
+	if hooks.subs[key] == nil {
+		hooks.subs[key] = make(map[int]func())
+	}
+	hooks.subs[key][id] = onChange
+
+	return func() {
+		hooks.Lock()
+		defer hooks.Unlock()
+		delete(hooks.subs[key], id)
+	}
+}
+
+// OnChange calls f after each change to the config is stored, with who made
+// it and the keys it changed, for example to audit it. A rollback is a change
+// like any other.
+func OnChange(f func(who string, keys []KeyChange)) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.onChange = append(hooks.onChange, f)
+}
+
+// notifyChange calls the OnChange hooks with rec, which may be nil, then
+// notifies the subscribers of each key in it and of the keys scoped ones
+// override. Each is notified once. It must be called without writeMu held.
+func notifyChange(rec *change) {
+	if rec == nil {
+		return
+	}
+
+	hooks.Lock()
+	onChange := hooks.onChange
+	hooks.Unlock()
+	for _, f := range onChange {
+		f(rec.Who, rec.Keys)
+	}
+
+	notified := make(map[string]bool)
+	for _, kc := range rec.Keys {
+		for _, key := range []string{kc.Key, unscoped(kc.Key)} {
+			if !notified[key] {
+				notified[key] = true
+				notify(key)
+			}
+		}
+	}
+}
+
+func notify(key string) {
+	hooks.Lock()
+	subs := make([]func(), 0, len(hooks.subs[key]))
+	for _, fn := range hooks.subs[key] {
+		subs = append(subs, fn)
+	}
+	hooks.Unlock()
+
+	for _, fn := range subs {
+		fn()
+	}
+}
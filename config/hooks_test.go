@@ -0,0 +1,176 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	confHolder.Store(conf{})
+	ValidateInt("validatedInt", MinInt(1))
+	Validate("validatedString", func(raw string) error {
+		if raw != "a" && raw != "b" {
+			return errors.New("must be a or b")
+		}
+		return nil
+	})
+
+	tests := []struct {
+		key    string
+		body   string
+		status int
+	}{
+		{"validatedInt", "3", 200},
+		{"validatedInt", "-5", 400},
+		{"validatedInt", "0", 400},
+		{"validatedInt", "x", 400},
+		{"validatedString", "b", 200},
+		{"validatedString", "c", 400},
+	}
+
+	for _, test := range tests {
+		res := put(t, test.key, test.body)
+		if res.StatusCode != test.status {
+			t.Fatalf("Expected status code of %d for %s=%s but got %v", test.status, test.key, test.body, res.StatusCode)
+		}
+	}
+
+	if v := Get("validatedInt", 0); v != 3 {
+		t.Fatalf("Expected rejected values to leave the old one but got %v", v)
+	}
+	if v := GetString("validatedString", ""); v != "b" {
+		t.Fatalf("Expected rejected values to leave the old one but got %v", v)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	confHolder.Store(conf{})
+	ValidateInt("subscribed", MinInt(0))
+
+	var seen []int
+	unsubscribe := Subscribe("subscribed", func() {
+		seen = append(seen, Get("subscribed", -1))
+	})
+
+	for _, body := range []string{"1", "1", "-1", "2"} {
+		put(t, "subscribed", body)
+	}
+	put(t, "other", "3")
+
+	// Unchanged and rejected values aren't changes
+	if len(seen) != 2 || seen[0] != 1 || seen[1] != 2 {
+		t.Fatalf("Expected to be notified of 1 then 2 but got %v", seen)
+	}
+
+	unsubscribe()
+	put(t, "subscribed", "4")
+	if len(seen) != 2 {
+		t.Fatalf("Expected no notifications after unsubscribing but got %v", seen)
+	}
+}
+
+func TestSubscribeScoped(t *testing.T) {
+	confHolder.Store(conf{})
+
+	var seen []int
+	unsubscribe := Subscribe("subscribedScoped", func() {
+		seen = append(seen, GetForCache("A", "subscribedScoped", -1))
+	})
+	defer unsubscribe()
+
+	put(t, "cache/A/subscribedScoped", "1")
+	put(t, "subscribedScoped", "2")
+
+	// Both keys changing at once is one change
+	patch(t, `{"subscribedScoped": "3", "cache/A/subscribedScoped": "4"}`)
+
+	if len(seen) != 3 || seen[0] != 1 || seen[1] != 1 || seen[2] != 4 {
+		t.Fatalf("Expected to be notified of changes to the scoped key but got %v", seen)
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	confHolder.Store(conf{})
+
+	var seen [][]KeyChange
+	OnChange(func(who string, keys []KeyChange) {
+		if who == "onChangeTest" {
+			seen = append(seen, keys)
+		}
+	})
+
+	v := "1"
+	update("onChangeTest", map[string]*string{"onChangeA": &v, "onChangeB": &v})
+	update("onChangeTest", map[string]*string{"onChangeA": &v})
+
+	if len(seen) != 1 || len(seen[0]) != 2 || seen[0][0].Key != "onChangeA" || *seen[0][0].New != "1" {
+		t.Fatalf("Expected to be told of the one change but got %+v", seen)
+	}
+}
+
+func TestSubscriberWrites(t *testing.T) {
+	confHolder.Store(conf{})
+
+	// The subscriber keeps a second key in step, which needs the write lock
+	unsubscribe := Subscribe("leader", func() {
+		raw := GetString("leader", "")
+		update("test", map[string]*string{"follower": &raw})
+	})
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		put(t, "leader", "a")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the subscriber to be able to change the config")
+	}
+
+	if v := GetString("follower", ""); v != "a" {
+		t.Fatalf("Expected the subscriber's change to be stored but got %q", v)
+	}
+}
+
+func TestCacheScope(t *testing.T) {
+	confHolder.Store(conf{})
+	ValidateInt("scopedInt", MinInt(1))
+
+	if code := put(t, "scopedInt", "2").StatusCode; code != 200 {
+		t.Fatalf("Expected status code of 200 but got %v", code)
+	}
+	if code := put(t, "cache/A/scopedInt", "5").StatusCode; code != 200 {
+		t.Fatalf("Expected status code of 200 but got %v", code)
+	}
+	if code := put(t, "cache/A/scopedInt", "-1").StatusCode; code != 400 {
+		t.Fatalf("Expected the key's check to apply to the scoped key but got %v", code)
+	}
+
+	if v := GetForCache("A", "scopedInt", 0); v != 5 {
+		t.Fatalf("Expected to get the scoped value 5 but got %v", v)
+	}
+	if v := GetForCache("B", "scopedInt", 0); v != 2 {
+		t.Fatalf("Expected to fall back to the value for all caches but got %v", v)
+	}
+	if v := GetForCache("B", "unset", 17); v != 17 {
+		t.Fatalf("Expected to get value 17 but got %v", v)
+	}
+}
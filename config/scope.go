@@ -0,0 +1,40 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "strings"
+
+// cachePrefix starts the keys that apply to a single cache
+const cachePrefix = "cache/"
+
+// CacheKey returns the key that overrides key for one cache, like
+// "cache/MY_CACHE/numTries". It is set through the /config endpoint like any
+// other, as /config/cache/MY_CACHE/numTries.
+func CacheKey(cache, key string) string {
+	return cachePrefix + cache + "/" + key
+}
+
+// unscoped returns the key a cache's key overrides, or key itself if it isn't
+// scoped to a cache
+func unscoped(key string) string {
+	if !strings.HasPrefix(key, cachePrefix) {
+		return key
+	}
+	rest := key[len(cachePrefix):]
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return rest[i+1:]
+	}
+	return key
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// storePath is the file config is saved to, if any. It is guarded by writeMu.
+var storePath string
+
+// storeError is a failure to save the config, which leaves it unchanged
+type storeError struct {
+	err error
+}
+
+func (e *storeError) Error() string {
+	return "saving config: " + e.err.Error()
+}
+
+// Persist loads the config saved in a JSON file at path, if there is one, and
+// saves every change to it from then on so they survive restarts. Saved values
+// are loaded as they are, without the type checks and validators, since those
+// may not be set up yet.
+func Persist(path string) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	saved := make(map[string]string)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	c := copyConf(confHolder.Load().(conf))
+	for k, raw := range saved {
+		c[k] = parse(raw)
+	}
+
+	storePath = path
+	if err := save(c); err != nil {
+		storePath = ""
+		return err
+	}
+	confHolder.Store(c)
+
+	return nil
+}
+
+// save writes c to the store, replacing the file in one step so a crash
+// leaves either the old config or the new one
+func save(c conf) error {
+	if storePath == "" {
+		return nil
+	}
+
+	saved := make(map[string]string, len(c))
+	for k, v := range c {
+		saved[k] = v.raw
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return &storeError{err}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(storePath), filepath.Base(storePath)+".tmp")
+	if err != nil {
+		return &storeError{err}
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return &storeError{err}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return &storeError{err}
+	}
+	if err := tmp.Close(); err != nil {
+		return &storeError{err}
+	}
+	if err := os.Rename(tmp.Name(), storePath); err != nil {
+		return &storeError{err}
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func del(t *testing.T, key string) *http.Response {
+	req, err := http.NewRequest("DELETE", "http://localhost:55555/config/"+key, nil)
+	if err != nil {
+		t.Fatalf("Got error during request creation (this is a bug in the test): %v", err)
+	}
+
+	res, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatalf("Got error performing request: %v", err)
+	}
+	return res
+}
+
+func readStore(t *testing.T, path string) map[string]string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the store: %v", err)
+	}
+	saved := make(map[string]string)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Failed to parse the store: %v", err)
+	}
+	return saved
+}
+
+func TestPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { storePath = "" }()
+
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"stored": "7", "storedDuration": "2s"}`), 0644); err != nil {
+		t.Fatalf("Failed to write the store: %v", err)
+	}
+
+	confHolder.Store(conf{})
+	if err := Persist(path); err != nil {
+		t.Fatalf("Failed to load the store: %v", err)
+	}
+
+	t.Run("Load", func(t *testing.T) {
+		if v := Get("stored", 0); v != 7 {
+			t.Fatalf("Expected to get the stored value 7 but got %v", v)
+		}
+		if v := GetString("storedDuration", ""); v != "2s" {
+			t.Fatalf("Expected to get the stored value 2s but got %v", v)
+		}
+	})
+
+	t.Run("PUT", func(t *testing.T) {
+		if code := put(t, "stored", "8").StatusCode; code != 200 {
+			t.Fatalf("Expected status code of 200 but got %v", code)
+		}
+		if saved := readStore(t, path); saved["stored"] != "8" || saved["storedDuration"] != "2s" {
+			t.Fatalf("Expected the change to be saved but got %v", saved)
+		}
+	})
+
+	t.Run("DELETE", func(t *testing.T) {
+		if code := del(t, "stored").StatusCode; code != 200 {
+			t.Fatalf("Expected status code of 200 but got %v", code)
+		}
+		if v := Get("stored", 17); v != 17 {
+			t.Fatalf("Expected the default 17 after deleting but got %v", v)
+		}
+		if saved := readStore(t, path); len(saved) != 1 {
+			t.Fatalf("Expected the deletion to be saved but got %v", saved)
+		}
+
+		if code := del(t, "stored").StatusCode; code != 404 {
+			t.Fatalf("Expected status code of 404 for a key that isn't set but got %v", code)
+		}
+	})
+
+	t.Run("SaveFailure", func(t *testing.T) {
+		os.RemoveAll(dir)
+
+		if code := put(t, "stored", "9").StatusCode; code != 500 {
+			t.Fatalf("Expected status code of 500 when saving fails but got %v", code)
+		}
+		if v := Get("stored", 17); v != 17 {
+			t.Fatalf("Expected a change that wasn't saved to be dropped but got %v", v)
+		}
+	})
+
+	t.Run("BadFile", func(t *testing.T) {
+		bad := filepath.Join(os.TempDir(), "config-bad.json")
+		ioutil.WriteFile(bad, []byte("{"), 0644)
+		defer os.Remove(bad)
+
+		if err := Persist(bad); err == nil {
+			t.Fatalf("Expected an error for a store that isn't JSON")
+		}
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Int is an int key kept up to date through Subscribe, so it can be read on
+// every request without looking it up
+type Int struct {
+	v int64
+
+	// serializes reloads so an older value can't overwrite a newer one
+	mu          sync.Mutex
+	load        func() int
+	unsubscribe func()
+}
+
+// WatchInt follows key, which is otherwise when it isn't set
+func WatchInt(key string, otherwise int) *Int {
+	return watch(key, func() int { return Get(key, otherwise) })
+}
+
+// WatchIntForCache follows key for one cache as GetForCache reads it. It is
+// updated when either the key or the cache's override of it changes.
+func WatchIntForCache(cache, key string, otherwise int) *Int {
+	return watch(key, func() int { return GetForCache(cache, key, otherwise) })
+}
+
+func watch(key string, load func() int) *Int {
+	i := &Int{load: load}
+	i.unsubscribe = Subscribe(key, i.reload)
+	i.reload()
+	return i
+}
+
+func (i *Int) reload() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	atomic.StoreInt64(&i.v, int64(i.load()))
+}
+
+// Get returns the current value
+func (i *Int) Get() int {
+	return int(atomic.LoadInt64(&i.v))
+}
+
+// Stop stops following changes. Get keeps returning the last value.
+func (i *Int) Stop() {
+	i.unsubscribe()
+}
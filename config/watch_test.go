@@ -0,0 +1,46 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "testing"
+
+func TestWatchInt(t *testing.T) {
+	confHolder.Store(conf{})
+	ValidateInt("watched", MinInt(0))
+
+	plain := WatchInt("watched", 3)
+	scoped := WatchIntForCache("A", "watched", 3)
+	defer scoped.Stop()
+
+	if plain.Get() != 3 || scoped.Get() != 3 {
+		t.Fatalf("Expected the default 3 but got %d and %d", plain.Get(), scoped.Get())
+	}
+
+	put(t, "watched", "5")
+	if plain.Get() != 5 || scoped.Get() != 5 {
+		t.Fatalf("Expected the new value 5 but got %d and %d", plain.Get(), scoped.Get())
+	}
+
+	put(t, "cache/A/watched", "7")
+	if plain.Get() != 5 || scoped.Get() != 7 {
+		t.Fatalf("Expected only the cache's value to change to 7 but got %d and %d", plain.Get(), scoped.Get())
+	}
+
+	plain.Stop()
+	put(t, "watched", "9")
+	if plain.Get() != 5 {
+		t.Fatalf("Expected no updates after stopping but got %d", plain.Get())
+	}
+}
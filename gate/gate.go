@@ -0,0 +1,335 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gate shuts the proxy down in order. Once a Gate is closed it turns
+// away new connections and commands, waits for the commands in progress to
+// finish and then flushes the background work registered with it.
+package gate
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricRejectedConns = metrics.AddCounter("shutdown_rejected_conns", nil)
+	MetricRejectedCmds  = metrics.AddCounter("shutdown_rejected_cmds", nil)
+)
+
+var (
+	// ErrClosed is returned instead of a handler for connections made after
+	// the gate closed, which makes the server hang up on them
+	ErrClosed = errors.New("shutting down")
+
+	// ErrTimeout is returned by Shutdown if the deadline passed before
+	// everything finished
+	ErrTimeout = errors.New("timed out waiting for shutdown")
+)
+
+// Gate tracks the commands in progress on the handlers it wraps
+type Gate struct {
+	mu       sync.Mutex
+	closed   bool
+	inFlight int
+	idle     chan struct{}
+	flushes  []func()
+}
+
+// New creates an open Gate
+func New() *Gate {
+	return &Gate{idle: make(chan struct{})}
+}
+
+// enter reports whether a command may start, counting it as in progress if so
+func (g *Gate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.inFlight++
+	return true
+}
+
+func (g *Gate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.inFlight--
+	if g.closed && g.inFlight == 0 {
+		close(g.idle)
+	}
+}
+
+// Close turns away new connections and commands. It is safe to call more than
+// once.
+func (g *Gate) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return
+	}
+	g.closed = true
+	if g.inFlight == 0 {
+		close(g.idle)
+	}
+}
+
+// OnShutdown adds a function that flushes background work once the commands
+// in progress are done. They run in the reverse order they were added, like
+// deferred calls, so something wrapping another handler should be added after
+// it and is flushed first.
+func (g *Gate) OnShutdown(flush func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.flushes = append(g.flushes, flush)
+}
+
+// Shutdown closes the gate, waits for the commands in progress and then runs
+// the flushes. It returns ErrTimeout if that takes longer than timeout, in
+// which case the rest is left running.
+func (g *Gate) Shutdown(timeout time.Duration) error {
+	deadline := time.After(timeout)
+
+	g.Close()
+
+	select {
+	case <-g.idle:
+	case <-deadline:
+		return ErrTimeout
+	}
+
+	g.mu.Lock()
+	flushes := g.flushes
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for i := len(flushes) - 1; i >= 0; i-- {
+			flushes[i]()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-deadline:
+		return ErrTimeout
+	}
+}
+
+// Wrap creates a handler constructor for handlers made by inner that are
+// tracked by the gate
+func (g *Gate) Wrap(inner handlers.HandlerConst) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		g.mu.Lock()
+		closed := g.closed
+		g.mu.Unlock()
+
+		if closed {
+			metrics.IncCounter(MetricRejectedConns)
+			return nil, ErrClosed
+		}
+
+		h, err := inner()
+		if err != nil {
+			return nil, err
+		}
+		return &Handler{inner: h, gate: g}, nil
+	}
+}
+
+// Handler passes commands on to another handler while the gate is open.
+// Commands made after it closed fail with a server error.
+type Handler struct {
+	inner handlers.Handler
+	gate  *Gate
+}
+
+func (h *Handler) enter() error {
+	if !h.gate.enter() {
+		metrics.IncCounter(MetricRejectedCmds)
+		return common.ErrInternal
+	}
+	return nil
+}
+
+// Set passes the set on while the gate is open
+func (h *Handler) Set(cmd common.SetRequest) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.gate.leave()
+	return h.inner.Set(cmd)
+}
+
+// Add passes the add on while the gate is open
+func (h *Handler) Add(cmd common.SetRequest) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.gate.leave()
+	return h.inner.Add(cmd)
+}
+
+// Replace passes the replace on while the gate is open
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.gate.leave()
+	return h.inner.Replace(cmd)
+}
+
+// Append passes the append on while the gate is open
+func (h *Handler) Append(cmd common.SetRequest) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.gate.leave()
+	return h.inner.Append(cmd)
+}
+
+// Prepend passes the prepend on while the gate is open
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.gate.leave()
+	return h.inner.Prepend(cmd)
+}
+
+// Delete passes the delete on while the gate is open
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.gate.leave()
+	return h.inner.Delete(cmd)
+}
+
+// Touch passes the touch on while the gate is open
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	if err := h.enter(); err != nil {
+		return err
+	}
+	defer h.gate.leave()
+	return h.inner.Touch(cmd)
+}
+
+// GAT passes the get-and-touch on while the gate is open
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	if err := h.enter(); err != nil {
+		return common.GetResponse{}, err
+	}
+	defer h.gate.leave()
+	return h.inner.GAT(cmd)
+}
+
+// Get passes the get on while the gate is open. It is in progress until all of
+// its responses have been read.
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := h.enter(); err != nil {
+		errorOut := make(chan error, 1)
+		errorOut <- err
+		return nil, errorOut
+	}
+
+	dataIn, errorIn := h.inner.Get(cmd)
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+		defer h.gate.leave()
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				// Handlers stop at the first error and may not close the
+				// channel after it
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE passes the get on while the gate is open. It is in progress until all
+// of its responses have been read.
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if err := h.enter(); err != nil {
+		errorOut := make(chan error, 1)
+		errorOut <- err
+		return nil, errorOut
+	}
+
+	dataIn, errorIn := h.inner.GetE(cmd)
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+		defer h.gate.leave()
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// Close closes the wrapped handler
+func (h *Handler) Close() error {
+	return h.inner.Close()
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gate_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/gate"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// memHandler is a handler that keeps items in a map
+type memHandler struct {
+	sync.Mutex
+	data map[string]string
+
+	// if set, sets signal started and wait for block to be closed
+	started chan struct{}
+	block   chan struct{}
+}
+
+func (m *memHandler) Set(cmd common.SetRequest) error {
+	if m.block != nil {
+		m.started <- struct{}{}
+		<-m.block
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *memHandler) Delete(cmd common.DeleteRequest) error { return common.ErrKeyNotFound }
+func (m *memHandler) Add(cmd common.SetRequest) error       { return common.ErrUnknownCmd }
+func (m *memHandler) Replace(cmd common.SetRequest) error   { return common.ErrUnknownCmd }
+func (m *memHandler) Append(cmd common.SetRequest) error    { return common.ErrUnknownCmd }
+func (m *memHandler) Prepend(cmd common.SetRequest) error   { return common.ErrUnknownCmd }
+func (m *memHandler) Touch(cmd common.TouchRequest) error   { return common.ErrUnknownCmd }
+func (m *memHandler) Close() error                          { return nil }
+
+func (m *memHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	m.Lock()
+	defer m.Unlock()
+
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	for _, key := range cmd.Keys {
+		data, ok := m.data[string(key)]
+		dataOut <- common.GetResponse{Key: key, Data: []byte(data), Miss: !ok}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (m *memHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	return nil, errchan
+}
+
+func (m *memHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{}, common.ErrUnknownCmd
+}
+
+func setup(t *testing.T) (*memHandler, *gate.Gate, handlers.HandlerConst) {
+	m := &memHandler{data: make(map[string]string)}
+	g := gate.New()
+	return m, g, g.Wrap(func() (handlers.Handler, error) { return m, nil })
+}
+
+func connect(t *testing.T, hc handlers.HandlerConst) handlers.Handler {
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	return h
+}
+
+func set(h handlers.Handler, key string) error {
+	return h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)})
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("WaitsForCommands", func(t *testing.T) {
+		m, g, hc := setup(t)
+		m.started = make(chan struct{})
+		m.block = make(chan struct{})
+
+		h := connect(t, hc)
+		setDone := make(chan error)
+		go func() { setDone <- set(h, "a") }()
+		<-m.started
+
+		var flushed bool
+		g.OnShutdown(func() {
+			m.Lock()
+			defer m.Unlock()
+			// The set in progress finished before the flush
+			flushed = m.data["a"] == "a"
+		})
+
+		shutdownDone := make(chan error)
+		go func() { shutdownDone <- g.Shutdown(time.Second) }()
+
+		// Wait for the gate to close
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if _, err := hc(); err == gate.ErrClosed {
+				break
+			}
+		}
+		if _, err := hc(); err != gate.ErrClosed {
+			t.Fatalf("Expected new connections to be turned away but got %v", err)
+		}
+		if err := h.Delete(common.DeleteRequest{Key: []byte("a")}); err != common.ErrInternal {
+			t.Fatalf("Expected new commands to be turned away but got %v", err)
+		}
+
+		select {
+		case <-shutdownDone:
+			t.Fatalf("Shutdown finished while a command was in progress")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(m.block)
+		if err := <-setDone; err != nil {
+			t.Fatalf("Set in progress failed: %v", err)
+		}
+		if err := <-shutdownDone; err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+		if !flushed {
+			t.Fatalf("Expected the flush to run after the set in progress")
+		}
+	})
+
+	t.Run("WaitsForGets", func(t *testing.T) {
+		_, g, hc := setup(t)
+		h := connect(t, hc)
+
+		datchan, _ := h.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("a")},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+
+		if err := g.Shutdown(20 * time.Millisecond); err != gate.ErrTimeout {
+			t.Fatalf("Expected shutdown to wait for the unread get but got %v", err)
+		}
+
+		for range datchan {
+		}
+		if err := g.Shutdown(time.Second); err != nil {
+			t.Fatalf("Shutdown failed after the get was read: %v", err)
+		}
+	})
+
+	t.Run("FlushOrder", func(t *testing.T) {
+		_, g, _ := setup(t)
+
+		var order []int
+		for i := 0; i < 3; i++ {
+			i := i
+			g.OnShutdown(func() { order = append(order, i) })
+		}
+
+		if err := g.Shutdown(time.Second); err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+		if len(order) != 3 || order[0] != 2 || order[1] != 1 || order[2] != 0 {
+			t.Fatalf("Expected flushes in reverse order but got %v", order)
+		}
+	})
+
+	t.Run("FlushTimeout", func(t *testing.T) {
+		_, g, _ := setup(t)
+
+		block := make(chan struct{})
+		defer close(block)
+		g.OnShutdown(func() { <-block })
+
+		if err := g.Shutdown(20 * time.Millisecond); err != gate.ErrTimeout {
+			t.Fatalf("Expected a slow flush to time out but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,374 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpch is the gRPC sibling of httph. It proxies memcached requests to
+// a cache service implementing the small KV protobuf service in kvpb.
+package grpch
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kvpb/kv.proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/netflix/rend-http/config"
+	"github.com/netflix/rend-http/grpch/kvpb"
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func (h *Handler) retryDelay(try int) {
+	// wait for 10, 40, and 90 ms successively on retries
+	if try > 0 {
+		mult := h.retryDelayMultiplier
+		if mult == 0 {
+			mult = h.retryDelayConf.Get()
+		}
+		<-time.After(time.Duration(try) * time.Millisecond * time.Duration(mult))
+	}
+}
+
+func (h *Handler) numTries() int {
+	if h.tries > 0 {
+		return h.tries
+	}
+	return h.numTriesConf.Get()
+}
+
+// retryable reports whether an RPC error is worth trying again. Everything
+// else is a failure that will very likely happen again.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// Handler implements the github.com/netflix/rend/handlers.Handler interface
+// on top of the kvpb.KV gRPC service. The supported operations are set, get,
+// delete, and touch.
+type Handler struct {
+	cache   string
+	conn    *grpc.ClientConn
+	client  kvpb.KVClient
+	timeout time.Duration
+
+	// override the dynamic config when set
+	tries                int
+	retryDelayMultiplier int
+
+	// the dynamic config for the cache, followed for changes
+	numTriesConf, retryDelayConf *config.Int
+}
+
+// Options holds the optional settings for a Handler
+type Options struct {
+	// Timeout bounds each RPC attempt. Zero means no timeout.
+	Timeout time.Duration
+
+	// NumTries and RetryDelayMultiplier override the numTries and
+	// retryDelayMultiplier dynamic config for this handler. Zero means the
+	// dynamic config is used.
+	NumTries             int
+	RetryDelayMultiplier int
+
+	// DialOptions are passed to the gRPC client. If empty, an insecure
+	// (plaintext) connection is used, the same as httph.
+	DialOptions []grpc.DialOption
+}
+
+// New creates a new handler constructor function. Like httph, the returned
+// function returns the same singleton every time so all connections share the
+// one multiplexed gRPC connection to the server at target ("host:port").
+func New(target string, cache string) (handlers.HandlerConst, error) {
+	return NewWithOptions(target, cache, Options{})
+}
+
+// NewWithOptions creates a new handler constructor function like New, but with
+// the given options applied to the singleton.
+func NewWithOptions(target string, cache string, opts Options) (handlers.HandlerConst, error) {
+	if opts.Timeout < 0 || opts.NumTries < 0 || opts.RetryDelayMultiplier < 0 {
+		return nil, errors.New("timeout, tries and retry delay multiplier must not be negative")
+	}
+
+	dialOpts := opts.DialOptions
+	if len(dialOpts) == 0 {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+
+	// The connection is established lazily on the first RPC
+	conn, err := grpc.NewClient(target, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	singleton := &Handler{
+		cache:   cache,
+		conn:    conn,
+		client:  kvpb.NewKVClient(conn),
+		timeout: opts.Timeout,
+
+		tries:                opts.NumTries,
+		retryDelayMultiplier: opts.RetryDelayMultiplier,
+
+		numTriesConf:   config.WatchIntForCache(cache, httph.NumTriesConfigName, httph.DefaultNumTries),
+		retryDelayConf: config.WatchIntForCache(cache, httph.RetryDelayMultiplierConfigName, httph.DefaultRetryDelayMultiplier),
+	}
+
+	return func() (handlers.Handler, error) {
+		return singleton, nil
+	}, nil
+}
+
+func (h *Handler) context() (context.Context, context.CancelFunc) {
+	if h.timeout > 0 {
+		return context.WithTimeout(context.Background(), h.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// call runs an RPC attempt function with retries on transient errors
+func (h *Handler) call(op string, key []byte, attempt func(ctx context.Context) error) error {
+	tries := h.numTries()
+	for i := 0; i < tries; i++ {
+		h.retryDelay(i)
+
+		ctx, cancel := h.context()
+		err := attempt(ctx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		if !retryable(err) {
+			log.Printf("[%s] RPC failed for key %q: %v\n", op, key, err)
+			return common.ErrInternal
+		}
+
+		log.Printf("[%s] Retryable RPC error: %v\n", op, err)
+	}
+
+	return common.ErrInternal
+}
+
+// Set performs a Set RPC on the backend server
+func (h *Handler) Set(cmd common.SetRequest) error {
+	req := &kvpb.SetRequest{
+		Cache: h.cache,
+		Key:   cmd.Key,
+		Value: cmd.Data,
+		Flags: cmd.Flags,
+		Ttl:   cmd.Exptime,
+	}
+
+	return h.call("SET", cmd.Key, func(ctx context.Context) error {
+		_, err := h.client.Set(ctx, req)
+		return err
+	})
+}
+
+// Delete performs a Delete RPC on the backend server
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	req := &kvpb.DeleteRequest{
+		Cache: h.cache,
+		Key:   cmd.Key,
+	}
+
+	var res *kvpb.DeleteResponse
+	err := h.call("DELETE", cmd.Key, func(ctx context.Context) (err error) {
+		res, err = h.client.Delete(ctx, req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !res.GetFound() {
+		return common.ErrKeyNotFound
+	}
+
+	return nil
+}
+
+// Touch performs a Touch RPC on the backend server
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	req := &kvpb.TouchRequest{
+		Cache: h.cache,
+		Key:   cmd.Key,
+		Ttl:   cmd.Exptime,
+	}
+
+	var res *kvpb.TouchResponse
+	err := h.call("TOUCH", cmd.Key, func(ctx context.Context) (err error) {
+		res, err = h.client.Touch(ctx, req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !res.GetFound() {
+		return common.ErrKeyNotFound
+	}
+
+	return nil
+}
+
+// Get performs a MultiGet RPC on the backend server for all the keys given and
+// relays the streamed responses in order
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+	go realHandleGet(h, cmd, dataOut, errorOut)
+	return dataOut, errorOut
+}
+
+func realHandleGet(h *Handler, cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error) {
+	defer close(errorOut)
+	defer close(dataOut)
+
+	req := &kvpb.MultiGetRequest{
+		Cache: h.cache,
+		Keys:  cmd.Keys,
+	}
+
+	// The whole stream is retried if it fails before the first response. After
+	// that, responses have already gone out to the client so a retry would
+	// duplicate them.
+	var sent int
+	err := h.call("GET", nil, func(ctx context.Context) error {
+		stream, err := h.client.MultiGet(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		for sent < len(cmd.Keys) {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				log.Printf("[GET] Stream ended after %d of %d keys\n", sent, len(cmd.Keys))
+				return status.Error(codes.Internal, "short multiget stream")
+			}
+			if err != nil {
+				if sent > 0 {
+					return status.Error(codes.Internal, err.Error())
+				}
+				return err
+			}
+
+			key := cmd.Keys[sent]
+			if !bytes.Equal(res.GetKey(), key) {
+				log.Printf("[GET] Out of order response: expected key %q but got %q\n", key, res.GetKey())
+				return status.Error(codes.Internal, "out of order multiget response")
+			}
+
+			if res.GetFound() {
+				dataOut <- common.GetResponse{
+					Miss:   false,
+					Quiet:  cmd.Quiet[sent],
+					Opaque: cmd.Opaques[sent],
+					Flags:  res.GetFlags(),
+					Key:    key,
+					Data:   res.GetValue(),
+				}
+			} else {
+				dataOut <- common.GetResponse{
+					Miss:   true,
+					Quiet:  cmd.Quiet[sent],
+					Opaque: cmd.Opaques[sent],
+					Flags:  0,
+					Key:    key,
+				}
+			}
+
+			sent++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		errorOut <- err
+	}
+}
+
+// Close does nothing on this handler because they all share the same singleton
+func (h *Handler) Close() error {
+	// nothing to "close" here
+	return nil
+}
+
+// Probe checks the server is answering with a single Get of httph.ProbeKey,
+// without retries. A hit and a miss both mean it is up.
+func (h *Handler) Probe(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := h.client.Get(ctx, &kvpb.GetRequest{Cache: h.cache, Key: []byte(httph.ProbeKey)})
+	return err
+}
+
+// Shutdown stops following the dynamic config and closes the gRPC connection
+// shared by the singleton, for retiring it. RPCs made afterwards fail.
+func (h *Handler) Shutdown() error {
+	h.numTriesConf.Stop()
+	h.retryDelayConf.Stop()
+	return h.conn.Close()
+}
+
+/////////////////////////////////////
+// All the rest just return an error
+/////////////////////////////////////
+
+// Add is not implemented and returns common.ErrUnknownCmd
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return common.ErrUnknownCmd
+}
+
+// Replace is not implemented and returns common.ErrUnknownCmd
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return common.ErrUnknownCmd
+}
+
+// Append is not implemented and returns common.ErrUnknownCmd
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return common.ErrUnknownCmd
+}
+
+// Prepend is not implemented and returns common.ErrUnknownCmd
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return common.ErrUnknownCmd
+}
+
+// GetE is not implemented and returns common.ErrUnknownCmd
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	return nil, errchan
+}
+
+// GAT is not implemented and returns common.ErrUnknownCmd
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{}, common.ErrUnknownCmd
+}
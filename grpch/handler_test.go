@@ -0,0 +1,397 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpch_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/grpch"
+	"github.com/netflix/rend-http/grpch/kvpb"
+	"github.com/netflix/rend-http/health"
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type item struct {
+	value []byte
+	flags uint32
+	ttl   uint32
+}
+
+// server is an in-process implementation of the KV service
+type server struct {
+	kvpb.UnimplementedKVServer
+
+	sync.Mutex
+	data      map[string]item
+	forcecode codes.Code
+	failtimes int
+	numReqs   int
+}
+
+func newServer(forcecode codes.Code, failtimes int) *server {
+	return &server{
+		data:      make(map[string]item),
+		forcecode: forcecode,
+		failtimes: failtimes,
+	}
+}
+
+// check counts the request and returns the forced error, if any
+func (s *server) check(cache string) error {
+	s.numReqs++
+
+	if cache != "evcache" {
+		return status.Error(codes.InvalidArgument, "bad cache")
+	}
+
+	if s.failtimes > 0 {
+		s.failtimes--
+		// Unavailable, not broken
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+
+	if s.forcecode != codes.OK {
+		return status.Error(s.forcecode, "forced")
+	}
+
+	return nil
+}
+
+func (s *server) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.check(req.Cache); err != nil {
+		return nil, err
+	}
+
+	it, ok := s.data[string(req.Key)]
+	return &kvpb.GetResponse{Key: req.Key, Found: ok, Value: it.value, Flags: it.flags}, nil
+}
+
+func (s *server) MultiGet(req *kvpb.MultiGetRequest, stream kvpb.KV_MultiGetServer) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.check(req.Cache); err != nil {
+		return err
+	}
+
+	for _, key := range req.Keys {
+		it, ok := s.data[string(key)]
+		res := &kvpb.GetResponse{Key: key, Found: ok, Value: it.value, Flags: it.flags}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *server) Set(ctx context.Context, req *kvpb.SetRequest) (*kvpb.SetResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.check(req.Cache); err != nil {
+		return nil, err
+	}
+
+	s.data[string(req.Key)] = item{value: req.Value, flags: req.Flags, ttl: req.Ttl}
+	return &kvpb.SetResponse{}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.check(req.Cache); err != nil {
+		return nil, err
+	}
+
+	_, ok := s.data[string(req.Key)]
+	delete(s.data, string(req.Key))
+	return &kvpb.DeleteResponse{Found: ok}, nil
+}
+
+func (s *server) Touch(ctx context.Context, req *kvpb.TouchRequest) (*kvpb.TouchResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.check(req.Cache); err != nil {
+		return nil, err
+	}
+
+	it, ok := s.data[string(req.Key)]
+	if ok {
+		it.ttl = req.Ttl
+		s.data[string(req.Key)] = it
+	}
+	return &kvpb.TouchResponse{Found: ok}, nil
+}
+
+// startServer runs the server on an in-memory listener and returns a handler
+// connected to it along with a function to stop the server
+func startServer(s *server) (handlers.Handler, func()) {
+	lis := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	kvpb.RegisterKVServer(gs, s)
+	go gs.Serve(lis)
+
+	hc, err := grpch.NewWithOptions("passthrough:///bufnet", "evcache", grpch.Options{
+		DialOptions: []grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+	})
+	if err != nil {
+		panic(fmt.Sprintf("Handler creation failed: %s", err.Error()))
+	}
+
+	handler, err := hc()
+	if err != nil {
+		panic(fmt.Sprintf("Handler creation failed: %s", err.Error()))
+	}
+
+	return handler, gs.Stop
+}
+
+func getRequest(keys ...string) common.GetRequest {
+	req := common.GetRequest{}
+	for i, k := range keys {
+		req.Keys = append(req.Keys, []byte(k))
+		req.Opaques = append(req.Opaques, uint32(i))
+		req.Quiet = append(req.Quiet, false)
+	}
+	return req
+}
+
+func TestGet(t *testing.T) {
+	t.Run("MultiGetInOrder", func(t *testing.T) {
+		s := newServer(codes.OK, 0)
+		handler, stop := startServer(s)
+		defer stop()
+
+		s.data["foo"] = item{value: []byte("bar"), flags: 3}
+		s.data["baz"] = item{value: []byte("qux")}
+
+		datchan, errchan := handler.Get(getRequest("foo", "missing", "baz"))
+
+		var responses []common.GetResponse
+		for res := range datchan {
+			responses = append(responses, res)
+		}
+		if err, ok := <-errchan; ok {
+			t.Fatalf("Failed to retrieve items: %s", err.Error())
+		}
+
+		if len(responses) != 3 {
+			t.Fatalf("Expected 3 responses but got %d", len(responses))
+		}
+		if responses[0].Miss || string(responses[0].Data) != "bar" || responses[0].Flags != 3 {
+			t.Errorf("Bad first response: %#v", responses[0])
+		}
+		if !responses[1].Miss || responses[1].Opaque != 1 {
+			t.Errorf("Bad second response: %#v", responses[1])
+		}
+		if responses[2].Miss || string(responses[2].Data) != "qux" {
+			t.Errorf("Bad third response: %#v", responses[2])
+		}
+
+		if s.numReqs != 1 {
+			t.Fatalf("Expected number of requests to be 1 but got %d", s.numReqs)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for i := 0; i < httph.DefaultNumTries; i++ {
+			t.Run(fmt.Sprintf("SuccessWith%dFailures", i), func(t *testing.T) {
+				s := newServer(codes.OK, i)
+				handler, stop := startServer(s)
+				defer stop()
+
+				s.data["foo"] = item{value: []byte("bar")}
+
+				datchan, errchan := handler.Get(getRequest("foo"))
+
+				select {
+				case res := <-datchan:
+					if res.Miss {
+						t.Error("Response was a miss")
+					}
+				case err := <-errchan:
+					t.Errorf("Failed to retrieve item: %s", err.Error())
+				}
+
+				if s.numReqs != i+1 {
+					t.Fatalf("Expected number of requests to be %d but got %d", i+1, s.numReqs)
+				}
+			})
+		}
+
+		t.Run("NoRetriesOnServerError", func(t *testing.T) {
+			s := newServer(codes.Internal, 0)
+			handler, stop := startServer(s)
+			defer stop()
+
+			datchan, errchan := handler.Get(getRequest("foo"))
+
+			select {
+			case res := <-datchan:
+				t.Errorf("Should have received an error.\nResponse: %#v", res)
+			case err := <-errchan:
+				t.Logf("Properly received error: %s", err.Error())
+			}
+
+			if s.numReqs != 1 {
+				t.Fatalf("Expected number of requests to be 1 but got %d", s.numReqs)
+			}
+		})
+	})
+}
+
+func TestSet(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		s := newServer(codes.OK, 0)
+		handler, stop := startServer(s)
+		defer stop()
+
+		err := handler.Set(common.SetRequest{
+			Key:     []byte("foo"),
+			Data:    []byte("bar"),
+			Flags:   7,
+			Exptime: 30,
+		})
+		if err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		if it := s.data["foo"]; string(it.value) != "bar" || it.flags != 7 || it.ttl != 30 {
+			t.Fatalf("Set stored the wrong item: %#v", it)
+		}
+	})
+
+	t.Run("FailureAfterAllRetries", func(t *testing.T) {
+		s := newServer(codes.OK, httph.DefaultNumTries)
+		handler, stop := startServer(s)
+		defer stop()
+
+		err := handler.Set(common.SetRequest{
+			Key:  []byte("foo"),
+			Data: []byte("bar"),
+		})
+		if err == nil {
+			t.Fatalf("Should have received an error.")
+		}
+
+		if s.numReqs != httph.DefaultNumTries {
+			t.Fatalf("Expected number of requests to be %d but got %d", httph.DefaultNumTries, s.numReqs)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	s := newServer(codes.OK, 0)
+	handler, stop := startServer(s)
+	defer stop()
+
+	s.data["foo"] = item{value: []byte("bar")}
+
+	if err := handler.Delete(common.DeleteRequest{Key: []byte("foo")}); err != nil {
+		t.Fatalf("Failed delete request: %s", err.Error())
+	}
+	if _, ok := s.data["foo"]; ok {
+		t.Fatalf("Delete failed")
+	}
+
+	if err := handler.Delete(common.DeleteRequest{Key: []byte("foo")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound but got %v", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	s := newServer(codes.OK, 0)
+	handler, stop := startServer(s)
+	defer stop()
+
+	s.data["foo"] = item{value: []byte("bar"), ttl: 10}
+
+	if err := handler.Touch(common.TouchRequest{Key: []byte("foo"), Exptime: 60}); err != nil {
+		t.Fatalf("Failed touch request: %s", err.Error())
+	}
+	if ttl := s.data["foo"].ttl; ttl != 60 {
+		t.Fatalf("Expected TTL of 60 but got %d", ttl)
+	}
+
+	if err := handler.Touch(common.TouchRequest{Key: []byte("baz"), Exptime: 60}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound but got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	handler, stop := startServer(newServer(codes.OK, 0))
+	defer stop()
+
+	if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+		t.Fatalf("Failed set request: %s", err.Error())
+	}
+
+	if err := handler.(*grpch.Handler).Shutdown(); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err == nil {
+		t.Fatalf("Expected sets to fail after shutting down")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	s := newServer(codes.OK, 0)
+	handler, stop := startServer(s)
+	h := handler.(*grpch.Handler)
+
+	if err := h.Probe(time.Second); err != nil {
+		t.Fatalf("Expected a live server to pass the probe but got %v", err)
+	}
+
+	// A dead backend fails the probe, and so the readiness of its cache
+	stop()
+
+	c, err := health.New(health.Options{MinHealthy: 1, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Failed to create checker: %v", err)
+	}
+	c.AddBackend("evcache", "bufnet", h)
+
+	r := c.Check()
+	if cr := r.Caches["evcache"]; cr.Healthy || len(cr.Backends) != 1 || cr.Backends[0].Error == "" {
+		t.Fatalf("Expected the dead backend to fail its probe but got %+v", cr)
+	}
+	if r.Reason == "" || r.Ready {
+		t.Fatalf("Expected not to be ready with a dead backend but got %+v", r)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health serves /healthz, which says the process is up, and /readyz,
+// which says whether it is ready for traffic: every listener is accepting
+// connections and enough caches have a backend answering probes. Both are
+// checked when asked for, and /readyz lists what it found as JSON.
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds each probe and listener check
+const DefaultTimeout = 2 * time.Second
+
+// Prober checks that a backend is answering
+type Prober interface {
+	Probe(timeout time.Duration) error
+}
+
+// Options configures a Checker
+type Options struct {
+	// MinHealthy is the fraction of caches that must have a healthy backend
+	// to be ready: 1 needs all of them and 0 only needs the listeners
+	MinHealthy float64
+
+	// Timeout bounds each probe and listener check, DefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// Checker tracks the listeners and backends of the proxy
+type Checker struct {
+	opts Options
+
+	mu       sync.Mutex
+	ports    []int
+	backends map[int]backend
+	nextID   int
+	draining bool
+}
+
+// backend is a backend of a cache that is probed
+type backend struct {
+	cache string
+	name  string
+	probe Prober
+}
+
+// New creates a Checker, with no listeners until SetPorts is called
+func New(opts Options) (*Checker, error) {
+	if opts.MinHealthy < 0 || opts.MinHealthy > 1 {
+		return nil, fmt.Errorf("min healthy fraction %v must be between 0 and 1", opts.MinHealthy)
+	}
+	if opts.Timeout < 0 {
+		return nil, errors.New("timeout must not be negative")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	return &Checker{opts: opts, backends: make(map[int]backend)}, nil
+}
+
+// SetPorts sets the ports that must be accepting connections
+func (c *Checker) SetPorts(ports []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ports = append([]int(nil), ports...)
+}
+
+// AddBackend adds a backend of cache, named by its address, until the
+// returned function is called. A cache is healthy if any of its backends is.
+func (c *Checker) AddBackend(cache, name string, p Prober) (remove func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID
+	c.nextID++
+	c.backends[id] = backend{cache: cache, name: name, probe: p}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.backends, id)
+	}
+}
+
+// SetDraining makes the proxy not ready from now on, for shutting down
+func (c *Checker) SetDraining() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+}
+
+// Report is what /readyz responds with
+type Report struct {
+	Ready bool `json:"ready"`
+
+	// Reason says why the proxy isn't ready
+	Reason string `json:"reason,omitempty"`
+
+	Listeners map[string]ListenerReport `json:"listeners"`
+	Caches    map[string]CacheReport    `json:"caches"`
+}
+
+// ListenerReport is the state of the listener on a port
+type ListenerReport struct {
+	Bound bool   `json:"bound"`
+	Error string `json:"error,omitempty"`
+}
+
+// CacheReport is the state of a cache's backends
+type CacheReport struct {
+	Healthy  bool            `json:"healthy"`
+	Backends []BackendReport `json:"backends"`
+}
+
+// BackendReport is the result of probing a backend
+type BackendReport struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// Check checks every listener and probes every backend at once, and decides
+// whether the proxy is ready
+func (c *Checker) Check() Report {
+	c.mu.Lock()
+	ports := c.ports
+	backends := make([]backend, 0, len(c.backends))
+	for _, b := range c.backends {
+		backends = append(backends, b)
+	}
+	draining := c.draining
+	c.mu.Unlock()
+
+	// Backends are listed in a stable order
+	sort.Slice(backends, func(i, j int) bool { return backends[i].name < backends[j].name })
+
+	listeners := make([]ListenerReport, len(ports))
+	probes := make([]BackendReport, len(backends))
+
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i, port int) {
+			defer wg.Done()
+			listeners[i] = c.dial(port)
+		}(i, port)
+	}
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, b backend) {
+			defer wg.Done()
+			probes[i] = c.probe(b)
+		}(i, b)
+	}
+	wg.Wait()
+
+	r := Report{
+		Ready:     true,
+		Listeners: make(map[string]ListenerReport, len(ports)),
+		Caches:    make(map[string]CacheReport),
+	}
+
+	unbound := 0
+	for i, port := range ports {
+		r.Listeners[strconv.Itoa(port)] = listeners[i]
+		if !listeners[i].Bound {
+			unbound++
+		}
+	}
+
+	for i, b := range backends {
+		cr := r.Caches[b.cache]
+		cr.Healthy = cr.Healthy || probes[i].Healthy
+		cr.Backends = append(cr.Backends, probes[i])
+		r.Caches[b.cache] = cr
+	}
+	healthy := 0
+	for _, cr := range r.Caches {
+		if cr.Healthy {
+			healthy++
+		}
+	}
+	needed := int(math.Ceil(c.opts.MinHealthy * float64(len(r.Caches))))
+
+	switch {
+	case draining:
+		r.Reason = "shutting down"
+	case len(ports) == 0:
+		r.Reason = "no listeners"
+	case unbound > 0:
+		r.Reason = fmt.Sprintf("%d of %d listeners not accepting connections", unbound, len(ports))
+	case healthy < needed:
+		r.Reason = fmt.Sprintf("%d of %d caches healthy, %d needed", healthy, len(r.Caches), needed)
+	}
+	r.Ready = r.Reason == ""
+
+	return r
+}
+
+// dial checks a listener is accepting connections on the local host
+func (c *Checker) dial(port int) ListenerReport {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), c.opts.Timeout)
+	if err != nil {
+		return ListenerReport{Error: err.Error()}
+	}
+	conn.Close()
+	return ListenerReport{Bound: true}
+}
+
+func (c *Checker) probe(b backend) BackendReport {
+	start := time.Now()
+	err := b.probe.Probe(c.opts.Timeout)
+
+	r := BackendReport{Name: b.name, Healthy: err == nil, Latency: time.Since(start).String()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Healthz responds 200 as long as the process is serving
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz responds with the Report as JSON, with a 200 if the proxy is ready
+// and a 503 if it isn't
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := c.Check()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(503)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
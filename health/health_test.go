@@ -0,0 +1,152 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/health"
+)
+
+// prober returns err from every probe
+type prober struct {
+	err error
+}
+
+func (p prober) Probe(timeout time.Duration) error {
+	return p.err
+}
+
+// listen returns a port that accepts connections and one that doesn't
+func listen(t *testing.T) (open, closed int, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	c, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closed = c.Addr().(*net.TCPAddr).Port
+	c.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, closed, func() { l.Close() }
+}
+
+func TestReady(t *testing.T) {
+	open, closed, stop := listen(t)
+	defer stop()
+
+	down := prober{errors.New("down")}
+	up := prober{}
+
+	tests := []struct {
+		name       string
+		minHealthy float64
+		ports      []int
+		probes     map[string][]prober
+		ready      bool
+	}{
+		{"NoListeners", 1, nil, nil, false},
+		{"AllHealthy", 1, []int{open}, map[string][]prober{"a": {up}, "b": {down, up}}, true},
+		{"Unbound", 1, []int{open, closed}, map[string][]prober{"a": {up}}, false},
+		{"CacheDown", 1, []int{open}, map[string][]prober{"a": {up}, "b": {down, down}}, false},
+		{"Partial", 0.5, []int{open}, map[string][]prober{"a": {up}, "b": {down}}, true},
+		{"TooFew", 0.5, []int{open}, map[string][]prober{"a": {up}, "b": {down}, "c": {down}}, false},
+		{"ListenersOnly", 0, []int{open}, map[string][]prober{"a": {down}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := health.New(health.Options{MinHealthy: test.minHealthy, Timeout: time.Second})
+			if err != nil {
+				t.Fatalf("Failed to create checker: %v", err)
+			}
+			c.SetPorts(test.ports)
+			for cache, probes := range test.probes {
+				for _, p := range probes {
+					c.AddBackend(cache, "backend", p)
+				}
+			}
+
+			r := c.Check()
+			if r.Ready != test.ready {
+				t.Fatalf("Expected ready %v but got %+v", test.ready, r)
+			}
+			if !r.Ready && r.Reason == "" {
+				t.Fatalf("Expected a reason for not being ready")
+			}
+		})
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	open, _, stop := listen(t)
+	defer stop()
+
+	c, err := health.New(health.Options{MinHealthy: 1})
+	if err != nil {
+		t.Fatalf("Failed to create checker: %v", err)
+	}
+	c.SetPorts([]int{open})
+	c.AddBackend("a", "host1:8080", prober{})
+	remove := c.AddBackend("a", "host2:8080", prober{errors.New("down")})
+
+	w := httptest.NewRecorder()
+	c.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200 but got %d: %s", w.Code, w.Body)
+	}
+
+	var r health.Report
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatalf("Got bad JSON: %v", err)
+	}
+	backends := r.Caches["a"].Backends
+	if len(backends) != 2 || !backends[0].Healthy || backends[1].Healthy || backends[1].Error != "down" {
+		t.Fatalf("Got bad backends: %+v", backends)
+	}
+
+	remove()
+	if r := c.Check(); len(r.Caches["a"].Backends) != 1 {
+		t.Fatalf("Expected a removed backend to be left out but got %+v", r.Caches["a"])
+	}
+
+	c.SetDraining()
+	w = httptest.NewRecorder()
+	c.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != 503 {
+		t.Fatalf("Expected status 503 while draining but got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	c.Healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 {
+		t.Fatalf("Expected healthz to stay up while draining but got %d", w.Code)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, opts := range []health.Options{{MinHealthy: -0.1}, {MinHealthy: 1.5}, {Timeout: -1}} {
+		if _, err := health.New(opts); err == nil {
+			t.Fatalf("Expected an error for %+v", opts)
+		}
+	}
+}
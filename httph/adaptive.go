@@ -0,0 +1,227 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricHTTPRequestsLimited = metrics.AddCounter("http_requests_limited", nil)
+)
+
+// limitGauges holds the concurrency limit gauge of each backend, shared by the
+// handlers made for it over time so reloads don't add more
+var limitGauges = struct {
+	sync.Mutex
+	ids map[string]uint32
+}{ids: make(map[string]uint32)}
+
+func limitGauge(backend string) uint32 {
+	limitGauges.Lock()
+	defer limitGauges.Unlock()
+
+	id, ok := limitGauges.ids[backend]
+	if !ok {
+		id = metrics.AddIntGauge("http_concurrency_limit", metrics.Tags{"backend": backend})
+		limitGauges.ids[backend] = id
+	}
+	return id
+}
+
+// Defaults for AdaptiveLimitOptions
+const (
+	DefaultInitialLimit = 20
+	DefaultMinLimit     = 1
+	DefaultMaxLimit     = 1000
+	DefaultLimitTimeout = time.Second
+)
+
+// Adaptive limit algorithms
+const (
+	LimitAIMD     = "aimd"
+	LimitGradient = "gradient"
+)
+
+// AdaptiveLimitOptions configures a limit on the requests in flight to the
+// proxy that follows its round trip times, in the style of Netflix's
+// concurrency-limits. Requests beyond the limit fail right away instead of
+// queueing up behind a proxy that is already struggling.
+type AdaptiveLimitOptions struct {
+	// Algorithm is how the limit adapts to requests that succeed. LimitAIMD
+	// grows it by one each time. LimitGradient scales it by how much the
+	// recent round trip time has grown over the long term average. Either way
+	// a request that fails or takes longer than Timeout cuts the limit by a
+	// tenth. Empty disables the limit.
+	Algorithm string
+
+	// InitialLimit is the limit to start with and MinLimit and MaxLimit bound
+	// it. Zero means DefaultInitialLimit, kept within the bounds,
+	// DefaultMinLimit and DefaultMaxLimit.
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+
+	// Timeout is the round trip time beyond which a request counts as failed.
+	// Zero means DefaultLimitTimeout.
+	Timeout time.Duration
+}
+
+// limitAlgorithm computes a new limit from a request's round trip time and
+// whether it failed. inFlight includes the request.
+type limitAlgorithm interface {
+	update(limit float64, rtt time.Duration, inFlight int, failed bool) float64
+}
+
+// backoffRatio is what the limit is multiplied by when a request fails
+const backoffRatio = 0.9
+
+type aimd struct{}
+
+func (aimd) update(limit float64, rtt time.Duration, inFlight int, failed bool) float64 {
+	if failed {
+		return limit * backoffRatio
+	}
+	// Only grow if the limit is actually being used
+	if float64(inFlight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// gradient compares a short and a long exponential average of round trip
+// times. While the short one is within tolerance of the long one the limit
+// grows with its square root, and as it rises above that the limit shrinks in
+// proportion.
+type gradient struct {
+	shortRTT, longRTT float64
+}
+
+const (
+	gradientShortWindow = 10
+	gradientLongWindow  = 600
+	gradientTolerance   = 1.5
+	gradientSmoothing   = 0.2
+)
+
+func (g *gradient) update(limit float64, rtt time.Duration, inFlight int, failed bool) float64 {
+	if failed {
+		return limit * backoffRatio
+	}
+
+	sample := float64(rtt)
+	if g.longRTT == 0 {
+		g.shortRTT, g.longRTT = sample, sample
+	} else {
+		g.shortRTT += (sample - g.shortRTT) / gradientShortWindow
+		g.longRTT += (sample - g.longRTT) / gradientLongWindow
+	}
+
+	// Let the long term average recover quickly after a long slow period
+	if g.longRTT/g.shortRTT > 2 {
+		g.longRTT *= 0.95
+	}
+
+	// Don't grow a limit that isn't being used
+	if float64(inFlight) < limit/2 {
+		return limit
+	}
+
+	grad := math.Max(0.5, math.Min(1, gradientTolerance*g.longRTT/g.shortRTT))
+	next := limit*grad + math.Sqrt(limit)
+	return limit*(1-gradientSmoothing) + next*gradientSmoothing
+}
+
+// adaptiveLimiter caps the requests in flight to an endpoint
+type adaptiveLimiter struct {
+	algorithm limitAlgorithm
+	min, max  float64
+	timeout   time.Duration
+	gauge     uint32
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+}
+
+func newAdaptiveLimiter(opts AdaptiveLimitOptions, name string) (*adaptiveLimiter, error) {
+	l := &adaptiveLimiter{timeout: opts.Timeout}
+
+	switch opts.Algorithm {
+	case LimitAIMD:
+		l.algorithm = aimd{}
+	case LimitGradient:
+		l.algorithm = &gradient{}
+	default:
+		return nil, fmt.Errorf("unknown adaptive limit algorithm %q", opts.Algorithm)
+	}
+
+	if opts.InitialLimit < 0 || opts.MinLimit < 0 || opts.MaxLimit < 0 || opts.Timeout < 0 {
+		return nil, fmt.Errorf("adaptive limits and timeout must not be negative")
+	}
+
+	initial, min, max := opts.InitialLimit, opts.MinLimit, opts.MaxLimit
+	if min == 0 {
+		min = DefaultMinLimit
+	}
+	if max == 0 {
+		max = DefaultMaxLimit
+	}
+	if initial == 0 {
+		initial = int(math.Max(float64(min), math.Min(float64(max), DefaultInitialLimit)))
+	}
+	if min > max || initial < min || initial > max {
+		return nil, fmt.Errorf("adaptive limit %d must be between the min %d and max %d", initial, min, max)
+	}
+	if l.timeout == 0 {
+		l.timeout = DefaultLimitTimeout
+	}
+
+	l.limit, l.min, l.max = float64(initial), float64(min), float64(max)
+	l.gauge = limitGauge(name)
+	metrics.SetIntGauge(l.gauge, uint64(initial))
+
+	return l, nil
+}
+
+// acquire reports whether a request may be sent, counting it as in flight if
+// so. It must be followed by release.
+func (l *adaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if float64(l.inFlight) >= math.Floor(l.limit) {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+// release finishes a request, adapting the limit to how it went
+func (l *adaptiveLimiter) release(rtt time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.algorithm.update(l.limit, rtt, l.inFlight, failed || rtt > l.timeout)
+	l.inFlight--
+
+	l.limit = math.Max(l.min, math.Min(l.max, limit))
+	metrics.SetIntGauge(l.gauge, uint64(l.limit))
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestAIMD(t *testing.T) {
+	l, err := newAdaptiveLimiter(AdaptiveLimitOptions{Algorithm: LimitAIMD, InitialLimit: 10, Timeout: 50 * time.Millisecond}, "test")
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+
+	// Idle requests don't grow the limit
+	l.acquire()
+	l.release(time.Millisecond, false)
+	if l.limit != 10 {
+		t.Fatalf("Expected the limit to stay at 10 but got %v", l.limit)
+	}
+
+	for i := 0; i < 5; i++ {
+		l.acquire()
+	}
+	l.release(time.Millisecond, false)
+	if l.limit != 11 {
+		t.Fatalf("Expected the limit to grow to 11 but got %v", l.limit)
+	}
+
+	l.release(time.Millisecond, true)
+	if l.limit != 11*backoffRatio {
+		t.Fatalf("Expected the limit to back off after a failure but got %v", l.limit)
+	}
+
+	limit := l.limit
+	l.release(100*time.Millisecond, false)
+	if l.limit != limit*backoffRatio {
+		t.Fatalf("Expected the limit to back off after a timeout but got %v", l.limit)
+	}
+}
+
+func TestGradient(t *testing.T) {
+	l, err := newAdaptiveLimiter(AdaptiveLimitOptions{Algorithm: LimitGradient, InitialLimit: 100}, "test")
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+
+	// Saturate the limit so it adapts
+	run := func(n int, rtt time.Duration) {
+		for i := 0; i < n; i++ {
+			l.inFlight = int(l.limit)
+			l.release(rtt, false)
+		}
+	}
+
+	run(100, time.Millisecond)
+	steady := l.limit
+	if steady <= 100 {
+		t.Fatalf("Expected the limit to grow while latency is steady but got %v", steady)
+	}
+
+	run(20, 10*time.Millisecond)
+	if l.limit >= steady/2 {
+		t.Fatalf("Expected the limit to shrink as latency rose but got %v from %v", l.limit, steady)
+	}
+}
+
+func TestAdaptiveLimitBounds(t *testing.T) {
+	l, err := newAdaptiveLimiter(AdaptiveLimitOptions{Algorithm: LimitAIMD, MinLimit: 2, MaxLimit: 3}, "test")
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	if l.limit != 3 {
+		t.Fatalf("Expected the default initial limit to be capped at the max but got %v", l.limit)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !l.acquire() {
+			t.Fatalf("Request %d within the limit was rejected", i)
+		}
+	}
+	if l.acquire() {
+		t.Fatalf("Expected the request over the limit to be rejected")
+	}
+
+	for i := 0; i < 3; i++ {
+		l.release(time.Millisecond, true)
+	}
+	for i := 0; i < 5; i++ {
+		l.acquire()
+		l.release(time.Millisecond, true)
+	}
+	if l.limit != 2 {
+		t.Fatalf("Expected the limit to stop at the min but got %v", l.limit)
+	}
+
+	for _, opts := range []AdaptiveLimitOptions{
+		{Algorithm: "fixed"},
+		{Algorithm: LimitAIMD, MinLimit: 5, MaxLimit: 4},
+		{Algorithm: LimitAIMD, InitialLimit: 5, MaxLimit: 4},
+		{Algorithm: LimitGradient, Timeout: -1},
+	} {
+		if _, err := newAdaptiveLimiter(opts, "test"); err == nil {
+			t.Fatalf("Expected an error for %#v", opts)
+		}
+	}
+}
+
+func TestAdaptiveLimitSheds(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	gate := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-gate
+	}))
+	defer ts.Close()
+
+	parts := strings.Split(strings.TrimPrefix(ts.URL, "http://"), ":")
+	port, _ := strconv.Atoi(parts[1])
+
+	hc, err := NewWithOptions(parts[0], port, "evcache", Options{
+		AdaptiveLimit: AdaptiveLimitOptions{Algorithm: LimitAIMD, InitialLimit: 1},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	h, _ := hc()
+
+	done := make(chan error)
+	go func() { done <- h.Set(common.SetRequest{Key: []byte("a"), Data: []byte("a")}) }()
+
+	// The set takes up the only slot until the gate opens
+	<-arrived
+	if err := h.Delete(common.DeleteRequest{Key: []byte("b")}); err != common.ErrInternal {
+		close(gate)
+		t.Fatalf("Expected the request over the limit to be shed but got %v", err)
+	}
+
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatalf("Set within the limit failed: %v", err)
+	}
+}
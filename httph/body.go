@@ -0,0 +1,119 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdGetValueTooLarge = metrics.AddCounter("cmd_get_value_too_large", nil)
+	MetricCmdSetValueTooLarge = metrics.AddCounter("cmd_set_value_too_large", nil)
+)
+
+// DefaultMaxValueSize is the largest value, in bytes, that is accepted from
+// clients or read back from the backend unless configured otherwise
+const DefaultMaxValueSize = 16 * 1024 * 1024
+
+// maxEncodingOverhead is the most the codecs add to the size of a value, which
+// is what the encryption envelope and checksum trailer need plus some slack.
+// Stored values may be this much larger than the maximum value size.
+const maxEncodingOverhead = 512
+
+// maxPooledBuffer is the capacity above which buffers aren't returned to the
+// pool, so one huge value doesn't pin its memory for the life of the process
+const maxPooledBuffer = 4 * 1024 * 1024
+
+var errValueTooLarge = errors.New("value exceeds the maximum value size")
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// readPooled reads a body of at most max bytes into a buffer from the pool.
+// The caller hands the buffer back with putBuffer once it is done with the
+// contents. length is the Content-Length of the body, or -1 if unknown.
+func readPooled(r io.Reader, length int64, max int) (*bytes.Buffer, error) {
+	if length > int64(max) {
+		return nil, errValueTooLarge
+	}
+
+	buf := getBuffer()
+
+	// ReadFrom wants MinRead bytes of room before each read, so without the
+	// extra it would reallocate right at the end of a body of known length
+	if length >= 0 {
+		buf.Grow(int(length) + bytes.MinRead)
+	}
+
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(max)+1)); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+
+	if buf.Len() > max {
+		putBuffer(buf)
+		return nil, errValueTooLarge
+	}
+
+	return buf, nil
+}
+
+// readBody reads a body of at most max bytes into a slice of exactly the right
+// size. If the length is known it is read straight into the slice, otherwise
+// it is read into a pooled buffer first. Either way, unlike ioutil.ReadAll,
+// the only garbage left behind is the returned slice.
+func readBody(r io.Reader, length int64, max int) ([]byte, error) {
+	if length > int64(max) {
+		return nil, errValueTooLarge
+	}
+
+	if length >= 0 {
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	buf, err := readPooled(r, length, max)
+	if err != nil {
+		return nil, err
+	}
+	defer putBuffer(buf)
+
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+	return data, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// onlyReader hides everything but Read so ReadFrom and ReadAll can't take any
+// shortcuts a real response body wouldn't allow
+type onlyReader struct {
+	r io.Reader
+}
+
+func (o onlyReader) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
+
+func body(data []byte) io.Reader {
+	return onlyReader{bytes.NewReader(data)}
+}
+
+func TestReadBody(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 1000)
+
+	for _, length := range []int64{int64(len(data)), -1} {
+		t.Run(fmt.Sprintf("Length%d", length), func(t *testing.T) {
+			t.Run("Fits", func(t *testing.T) {
+				out, err := readBody(body(data), length, len(data))
+				if err != nil {
+					t.Fatalf("Failed to read body: %v", err)
+				}
+				if !bytes.Equal(out, data) {
+					t.Fatalf("Read the wrong data")
+				}
+				if cap(out) != len(data) {
+					t.Fatalf("Expected an exactly sized slice but got cap %d for len %d", cap(out), len(data))
+				}
+			})
+
+			t.Run("TooLarge", func(t *testing.T) {
+				if _, err := readBody(body(data), length, len(data)-1); err != errValueTooLarge {
+					t.Fatalf("Expected errValueTooLarge but got %v", err)
+				}
+			})
+
+			t.Run("Pooled", func(t *testing.T) {
+				buf, err := readPooled(body(data), length, len(data))
+				if err != nil {
+					t.Fatalf("Failed to read body: %v", err)
+				}
+				defer putBuffer(buf)
+
+				if !bytes.Equal(buf.Bytes(), data) {
+					t.Fatalf("Read the wrong data")
+				}
+			})
+		})
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		if _, err := readBody(body(data), int64(len(data))+1, len(data)+1); err == nil {
+			t.Fatalf("Expected an error for a body shorter than its length")
+		}
+	})
+}
+
+var benchSizes = []int{1024, 64 * 1024, 1024 * 1024}
+
+// BenchmarkReadAll is the baseline of what gets used to cost
+func BenchmarkReadAll(b *testing.B) {
+	for _, size := range benchSizes {
+		data := make([]byte, size)
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := ioutil.ReadAll(body(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	for _, size := range benchSizes {
+		data := make([]byte, size)
+
+		b.Run(fmt.Sprintf("KnownLength/%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := readBody(body(data), int64(size), DefaultMaxValueSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("UnknownLength/%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := readBody(body(data), -1, DefaultMaxValueSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadPooled is how chunks are read, where the body is copied out and
+// the buffer reused
+func BenchmarkReadPooled(b *testing.B) {
+	for _, size := range benchSizes {
+		data := make([]byte, size)
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				buf, err := readPooled(body(data), int64(size), DefaultMaxValueSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+				putBuffer(buf)
+			}
+		})
+	}
+}
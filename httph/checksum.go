@@ -0,0 +1,128 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdGetChecksumFailures = metrics.AddCounter("cmd_get_checksum_failures", nil)
+)
+
+// ChecksumOptions configures end-to-end integrity checks of values
+type ChecksumOptions struct {
+	// Algorithm is "crc32c" or "xxhash". The checksum of the value is appended
+	// to it as a trailer when it is set and verified when it is read back.
+	// Values are marked with a reserved flag bit so those stored without a
+	// checksum can still be read. Empty disables checksums.
+	Algorithm string
+
+	// MismatchIsError makes a get fail with an error when the checksum doesn't
+	// match. By default a mismatch is treated as a miss.
+	MismatchIsError bool
+}
+
+// The trailer is the checksum, big endian, followed by one byte identifying
+// the algorithm
+const (
+	checksumCRC32C byte = 1
+	checksumXXHash byte = 2
+)
+
+func checksumLen(algo byte) int {
+	switch algo {
+	case checksumCRC32C:
+		return 4
+	case checksumXXHash:
+		return 8
+	}
+	return -1
+}
+
+func appendChecksum(buf []byte, algo byte, data []byte) []byte {
+	var sum [8]byte
+	switch algo {
+	case checksumCRC32C:
+		binary.BigEndian.PutUint32(sum[:], crc32.Checksum(data, castagnoli))
+	case checksumXXHash:
+		binary.BigEndian.PutUint64(sum[:], xxhash.Sum64(data))
+	}
+	return append(buf, sum[:checksumLen(algo)]...)
+}
+
+type checksummer struct {
+	algo            byte
+	mismatchIsError bool
+}
+
+func newChecksummer(opts ChecksumOptions) (*checksummer, error) {
+	c := &checksummer{mismatchIsError: opts.MismatchIsError}
+
+	switch opts.Algorithm {
+	case "crc32c":
+		c.algo = checksumCRC32C
+	case "xxhash":
+		c.algo = checksumXXHash
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm %q", opts.Algorithm)
+	}
+
+	return c, nil
+}
+
+func (c *checksummer) encode(key, data []byte, flags uint32) ([]byte, uint32, error) {
+	out := make([]byte, len(data), len(data)+checksumLen(c.algo)+1)
+	copy(out, data)
+	out = appendChecksum(out, c.algo, data)
+	out = append(out, c.algo)
+	return out, flags | flagChecksummed, nil
+}
+
+func (c *checksummer) decode(key, data []byte, flags uint32) ([]byte, uint32, error) {
+	if flags&flagChecksummed == 0 {
+		return data, flags, nil
+	}
+
+	ok := false
+	var value []byte
+
+	if len(data) > 0 {
+		algo := data[len(data)-1]
+		if n := checksumLen(algo); n > 0 && len(data) >= n+1 {
+			value = data[:len(data)-n-1]
+			sum := data[len(data)-n-1 : len(data)-1]
+			ok = bytes.Equal(appendChecksum(nil, algo, value), sum)
+		}
+	}
+
+	if !ok {
+		log.Printf("[GET] Checksum mismatch for key %q\n", key)
+		metrics.IncCounter(MetricCmdGetChecksumFailures)
+		if c.mismatchIsError {
+			return nil, 0, errCorruptValue
+		}
+		return nil, 0, errDecodeMiss
+	}
+
+	return value, flags &^ flagChecksummed, nil
+}
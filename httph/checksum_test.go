@@ -0,0 +1,145 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+)
+
+func TestChecksum(t *testing.T) {
+	for _, algo := range []string{"crc32c", "xxhash"} {
+		t.Run(algo, func(t *testing.T) {
+			t.Run("RoundTrip", func(t *testing.T) {
+				s := newServer(0, 0)
+				ts := httptest.NewServer(s)
+				defer ts.Close()
+
+				handler := handlerWithOptions(ts, httph.Options{
+					Checksum: httph.ChecksumOptions{Algorithm: algo},
+				})
+
+				err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar"), Flags: 2})
+				if err != nil {
+					t.Fatalf("Failed set request: %s", err.Error())
+				}
+
+				if len(s.data["foo"]) <= 3 {
+					t.Fatalf("Expected a checksum trailer but got %q", s.data["foo"])
+				}
+
+				res, err := getOne(handler, "foo")
+				if err != nil {
+					t.Fatalf("Failed to retrieve item: %s", err.Error())
+				}
+				if res.Miss || string(res.Data) != "bar" || res.Flags != 2 {
+					t.Fatalf("Got wrong item back: %#v", res)
+				}
+			})
+
+			t.Run("MismatchIsMiss", func(t *testing.T) {
+				s := newServer(0, 0)
+				ts := httptest.NewServer(s)
+				defer ts.Close()
+
+				handler := handlerWithOptions(ts, httph.Options{
+					Checksum: httph.ChecksumOptions{Algorithm: algo},
+				})
+
+				if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+					t.Fatalf("Failed set request: %s", err.Error())
+				}
+
+				s.data["foo"] = "baz" + s.data["foo"][3:]
+
+				res, err := getOne(handler, "foo")
+				if err != nil {
+					t.Fatalf("Failed to retrieve item: %s", err.Error())
+				}
+				if !res.Miss {
+					t.Fatalf("Expected a miss but got %q", res.Data)
+				}
+			})
+
+			t.Run("MismatchIsError", func(t *testing.T) {
+				s := newServer(0, 0)
+				ts := httptest.NewServer(s)
+				defer ts.Close()
+
+				handler := handlerWithOptions(ts, httph.Options{
+					Checksum: httph.ChecksumOptions{Algorithm: algo, MismatchIsError: true},
+				})
+
+				if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+					t.Fatalf("Failed set request: %s", err.Error())
+				}
+
+				s.data["foo"] = "baz" + s.data["foo"][3:]
+
+				if res, err := getOne(handler, "foo"); err == nil {
+					t.Fatalf("Expected an error but got %#v", res)
+				}
+			})
+		})
+	}
+
+	t.Run("UnchecksummedValuesReadable", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			Checksum: httph.ChecksumOptions{Algorithm: "crc32c"},
+		})
+
+		s.data["foo"] = "bar"
+		s.flags["foo"] = "0"
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if res.Miss || string(res.Data) != "bar" {
+			t.Fatalf("Got wrong item back: %#v", res)
+		}
+	})
+
+	t.Run("WithCompression", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			Compression: httph.CompressionOptions{Algorithm: "gzip", Threshold: 1},
+			Checksum:    httph.ChecksumOptions{Algorithm: "xxhash"},
+		})
+
+		value := chunkedValue + chunkedValue
+		if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(value)}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if string(res.Data) != value {
+			t.Fatalf("Value did not round trip")
+		}
+	})
+}
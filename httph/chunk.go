@@ -0,0 +1,312 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdSetChunked             = metrics.AddCounter("cmd_set_chunked", nil)
+	MetricCmdGetChunked             = metrics.AddCounter("cmd_get_chunked", nil)
+	MetricCmdGetChunkMisses         = metrics.AddCounter("cmd_get_chunk_misses", nil)
+	MetricCmdGetChunkChecksumErrors = metrics.AddCounter("cmd_get_chunk_checksum_errors", nil)
+	MetricCmdGetBadManifests        = metrics.AddCounter("cmd_get_bad_manifests", nil)
+)
+
+// maxChunkConcurrency is the most requests for the chunks of one value that
+// are in flight at once
+const maxChunkConcurrency = 8
+
+const (
+	manifestVersion = 1
+	manifestLen     = 21
+	tokenLen        = 8
+)
+
+// MaxChunkKeySuffix is the most bytes chunking adds to a key: ":chunk:", the
+// hex token, ':' and a chunk index of up to 10 digits
+const MaxChunkKeySuffix = len(":chunk:") + 2*tokenLen + 1 + 10
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errBadManifest = errors.New("bad chunk manifest")
+
+// A value larger than the chunk size is stored as a manifest item under the
+// original key and a set of chunk items under derived keys. The manifest item
+// carries the original flags plus flagChunked and a body of:
+//
+//	version     1 byte
+//	token       8 bytes, random per set so concurrent sets don't mix chunks
+//	length      uint32, the length of the whole value
+//	chunk size  uint32
+//	checksum    uint32, the CRC-32C of the whole value
+//
+// Chunks are written before the manifest and deleted after it, so a reader
+// that finds a manifest will normally find all of its chunks. Chunks of a value
+// that is overwritten are left to expire or be evicted.
+type manifest struct {
+	token     [tokenLen]byte
+	length    uint32
+	chunkSize uint32
+	checksum  uint32
+}
+
+func (m *manifest) marshal() []byte {
+	buf := make([]byte, manifestLen)
+	buf[0] = manifestVersion
+	copy(buf[1:], m.token[:])
+	binary.BigEndian.PutUint32(buf[9:], m.length)
+	binary.BigEndian.PutUint32(buf[13:], m.chunkSize)
+	binary.BigEndian.PutUint32(buf[17:], m.checksum)
+	return buf
+}
+
+func unmarshalManifest(buf []byte) (*manifest, error) {
+	if len(buf) != manifestLen || buf[0] != manifestVersion {
+		return nil, errBadManifest
+	}
+
+	m := &manifest{}
+	copy(m.token[:], buf[1:])
+	m.length = binary.BigEndian.Uint32(buf[9:])
+	m.chunkSize = binary.BigEndian.Uint32(buf[13:])
+	m.checksum = binary.BigEndian.Uint32(buf[17:])
+
+	if m.chunkSize == 0 {
+		return nil, errBadManifest
+	}
+
+	return m, nil
+}
+
+func (m *manifest) numChunks() int {
+	return int((uint64(m.length) + uint64(m.chunkSize) - 1) / uint64(m.chunkSize))
+}
+
+func (m *manifest) chunkKey(key []byte, i int) []byte {
+	ck := make([]byte, 0, len(key)+32)
+	ck = append(ck, key...)
+	ck = append(ck, ":chunk:"...)
+	ck = append(ck, hex.EncodeToString(m.token[:])...)
+	ck = append(ck, ':')
+	ck = strconv.AppendInt(ck, int64(i), 10)
+	return ck
+}
+
+// parallel runs fn for every i in [0, n) with at most maxChunkConcurrency
+// running at once and returns one of the errors, if any
+func parallel(n int, fn func(i int) error) error {
+	sem := make(chan struct{}, maxChunkConcurrency)
+	errs := make(chan error, n)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := fn(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	// nil if there were no errors
+	return <-errs
+}
+
+// storeChunked splits a value into chunks, stores them and then stores the
+// manifest under the original key
+func (h *Handler) storeChunked(key, data []byte, flags, ttl uint32) error {
+	m := &manifest{
+		length:    uint32(len(data)),
+		chunkSize: uint32(h.chunkSize),
+		checksum:  crc32.Checksum(data, castagnoli),
+	}
+	if _, err := rand.Read(m.token[:]); err != nil {
+		return err
+	}
+
+	err := parallel(m.numChunks(), func(i int) error {
+		end := (i + 1) * h.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		return h.store(m.chunkKey(key, i), data[i*h.chunkSize:end], 0, ttl)
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdSetChunked)
+	return h.store(key, m.marshal(), flags|flagChunked, ttl)
+}
+
+// fetchChunked reassembles a chunked value given its manifest item. A value
+// with missing chunks or a bad checksum is reported as not found.
+func (h *Handler) fetchChunked(ep *endpoint, key, data []byte, flags uint32) ([]byte, uint32, bool, error) {
+	metrics.IncCounter(MetricCmdGetChunked)
+
+	m, err := unmarshalManifest(data)
+	if err != nil {
+		log.Printf("[GET] Bad chunk manifest for key %q\n", key)
+		metrics.IncCounter(MetricCmdGetBadManifests)
+		return nil, 0, false, nil
+	}
+
+	// Check before allocating, the manifest can't be trusted with the memory
+	if int64(m.length) > int64(h.maxStoredSize()) {
+		log.Printf("[GET] Chunked value for key %q is larger than the max value size of %d bytes\n", key, h.maxValueSize)
+		metrics.IncCounter(MetricCmdGetValueTooLarge)
+		return nil, 0, false, errValueTooLarge
+	}
+
+	value := make([]byte, m.length)
+	missing := false
+	mu := &sync.Mutex{}
+
+	err = parallel(m.numChunks(), func(i int) error {
+		start := i * int(m.chunkSize)
+		end := start + int(m.chunkSize)
+		if end > len(value) {
+			end = len(value)
+		}
+
+		ok, err := h.fetchChunk(ep, m.chunkKey(key, i), value[start:end])
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			mu.Lock()
+			missing = true
+			mu.Unlock()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if missing {
+		metrics.IncCounter(MetricCmdGetChunkMisses)
+		return nil, 0, false, nil
+	}
+
+	if crc32.Checksum(value, castagnoli) != m.checksum {
+		log.Printf("[GET] Checksum mismatch on chunked value for key %q\n", key)
+		metrics.IncCounter(MetricCmdGetChunkChecksumErrors)
+		return nil, 0, false, nil
+	}
+
+	return value, flags &^ flagChunked, true, nil
+}
+
+// fetchChunk reads a chunk into dst through a pooled buffer, reporting whether
+// it was found with exactly the expected length
+func (h *Handler) fetchChunk(ep *endpoint, key, dst []byte) (bool, error) {
+	res, _, found, err := h.fetchResponse(ep, key)
+	if err != nil || !found {
+		return false, err
+	}
+
+	buf, err := readPooled(res.Body, res.ContentLength, len(dst))
+	res.Body.Close()
+
+	if err == errValueTooLarge {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer putBuffer(buf)
+
+	if buf.Len() != len(dst) {
+		return false, nil
+	}
+
+	copy(dst, buf.Bytes())
+	return true, nil
+}
+
+// fetchManifest returns the manifest stored under key, or nil if the key does
+// not hold a chunked value. The body is only read if it is a manifest.
+func (h *Handler) fetchManifest(key []byte) (*manifest, error) {
+	res, flags, found, err := h.fetchResponse(h.primary, key)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	// Closing without reading gives up the connection, but saves reading in a
+	// whole value only to throw it away
+	if flags&flagChunked == 0 {
+		res.Body.Close()
+		return nil, nil
+	}
+
+	data, err := readBody(res.Body, res.ContentLength, manifestLen)
+	res.Body.Close()
+
+	// An oversize body leaves data empty, which makes it a bad manifest
+	if err != nil && err != errValueTooLarge {
+		return nil, err
+	}
+
+	m, err := unmarshalManifest(data)
+	if err != nil {
+		log.Printf("Bad chunk manifest for key %q\n", key)
+		metrics.IncCounter(MetricCmdGetBadManifests)
+		return nil, nil
+	}
+
+	return m, nil
+}
+
+// removeChunks deletes the chunks of a value. Failures are only logged since
+// the chunks are unreachable once the manifest is gone.
+func (h *Handler) removeChunks(key []byte, m *manifest) {
+	err := parallel(m.numChunks(), func(i int) error {
+		_, err := h.remove(m.chunkKey(key, i))
+		return err
+	})
+	if err != nil {
+		log.Printf("[DELETE] Failed to delete chunks for key %q: %v\n", key, err)
+	}
+}
+
+// touchChunks updates the TTL of the chunks of a value
+func (h *Handler) touchChunks(key []byte, m *manifest, ttl uint32) error {
+	return parallel(m.numChunks(), func(i int) error {
+		_, err := h.touch(m.chunkKey(key, i), ttl)
+		return err
+	})
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+const chunkedValue = "0123456789abcdefghijklmnopqrstuvwxyz0123456789abcdefghijklmnopqrstuvwxyz0123456789abcdefghijklmn"
+
+func chunkedSetup(t *testing.T) (*server, *httptest.Server, handlers.Handler) {
+	s := newServer(0, 0)
+	ts := httptest.NewServer(s)
+
+	handler := handlerWithOptions(ts, httph.Options{ChunkSize: 10})
+
+	err := handler.Set(common.SetRequest{
+		Key:   []byte("foo"),
+		Data:  []byte(chunkedValue),
+		Flags: 9,
+	})
+	if err != nil {
+		ts.Close()
+		t.Fatalf("Failed set request: %s", err.Error())
+	}
+
+	return s, ts, handler
+}
+
+func chunkKeys(s *server) []string {
+	var keys []string
+	for k := range s.data {
+		if strings.HasPrefix(k, "foo:chunk:") {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func TestChunking(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		s, ts, handler := chunkedSetup(t)
+		defer ts.Close()
+
+		// 96 bytes in 10 byte chunks
+		if n := len(chunkKeys(s)); n != 10 {
+			t.Fatalf("Expected 10 chunks but got %d", n)
+		}
+		if len(s.data["foo"]) >= len(chunkedValue) {
+			t.Fatalf("Expected a manifest under the key but got %q", s.data["foo"])
+		}
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if res.Miss {
+			t.Fatalf("Response was a miss")
+		}
+		if string(res.Data) != chunkedValue {
+			t.Fatalf("Value did not round trip: %q", res.Data)
+		}
+		if res.Flags != 9 {
+			t.Fatalf("Expected flags of 9 but got %d", res.Flags)
+		}
+	})
+
+	t.Run("SmallValuesNotChunked", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{ChunkSize: 10})
+
+		if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		if len(s.data) != 1 || s.data["foo"] != "bar" {
+			t.Fatalf("Expected a single plain item but got %v", s.data)
+		}
+	})
+
+	t.Run("MissingChunkIsMiss", func(t *testing.T) {
+		s, ts, handler := chunkedSetup(t)
+		defer ts.Close()
+
+		delete(s.data, chunkKeys(s)[0])
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if !res.Miss {
+			t.Fatalf("Expected a miss but got %q", res.Data)
+		}
+	})
+
+	t.Run("CorruptChunkIsMiss", func(t *testing.T) {
+		s, ts, handler := chunkedSetup(t)
+		defer ts.Close()
+
+		k := chunkKeys(s)[0]
+		s.data[k] = strings.Repeat("x", len(s.data[k]))
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if !res.Miss {
+			t.Fatalf("Expected a miss but got %q", res.Data)
+		}
+	})
+
+	t.Run("DeleteRemovesChunks", func(t *testing.T) {
+		s, ts, handler := chunkedSetup(t)
+		defer ts.Close()
+
+		if err := handler.Delete(common.DeleteRequest{Key: []byte("foo")}); err != nil {
+			t.Fatalf("Failed delete request: %s", err.Error())
+		}
+
+		if len(s.data) != 0 {
+			t.Fatalf("Expected all items to be deleted but have %d left", len(s.data))
+		}
+	})
+
+	t.Run("WithCompression", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			ChunkSize:   16,
+			Compression: httph.CompressionOptions{Algorithm: "snappy", Threshold: 1},
+		})
+
+		big := strings.Repeat(chunkedValue, 50)
+		if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(big)}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		// chunking applies to the compressed value
+		if n := len(chunkKeys(s)); n == 0 || n >= len(big)/16 {
+			t.Fatalf("Expected fewer chunks than the uncompressed value needs but got %d", n)
+		}
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if string(res.Data) != big {
+			t.Fatalf("Value did not round trip")
+		}
+	})
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"errors"
+)
+
+// The high bits of the item flags are reserved to mark how a stored value was
+// transformed on the way to the backend. Clients may not set these bits while
+// any value transformation or chunking is enabled on a Handler. Bit 31 is left
+// alone because Java based proxies store the flags as a signed int.
+const (
+	flagCompressed  uint32 = 1 << 30
+	flagChunked     uint32 = 1 << 29
+	flagChecksummed uint32 = 1 << 28
+	flagEncrypted   uint32 = 1 << 27
+
+	// ReservedFlags is the mask of all flag bits reserved for use by the Handler
+	ReservedFlags = flagCompressed | flagChunked | flagChecksummed | flagEncrypted
+)
+
+var (
+	// errCorruptValue is returned by a codec when a stored value cannot be
+	// decoded
+	errCorruptValue = errors.New("corrupt value")
+
+	// errDecodeMiss is returned by a codec when a stored value cannot be
+	// decoded and should be reported to the client as a miss
+	errDecodeMiss = errors.New("undecodable value treated as miss")
+)
+
+// codec is one reversible transformation applied to values on their way to the
+// backend. A codec marks the values it transforms with its own reserved flag
+// bit and only decodes values carrying that bit.
+type codec interface {
+	encode(key, data []byte, flags uint32) ([]byte, uint32, error)
+	decode(key, data []byte, flags uint32) ([]byte, uint32, error)
+}
+
+// codecChain applies codecs in order on encode and in reverse order on decode
+type codecChain []codec
+
+func (c codecChain) encode(key, data []byte, flags uint32) ([]byte, uint32, error) {
+	var err error
+	for _, cd := range c {
+		if data, flags, err = cd.encode(key, data, flags); err != nil {
+			return nil, 0, err
+		}
+	}
+	return data, flags, nil
+}
+
+func (c codecChain) decode(key, data []byte, flags uint32) ([]byte, uint32, error) {
+	var err error
+	for i := len(c) - 1; i >= 0; i-- {
+		if data, flags, err = c[i].decode(key, data, flags); err != nil {
+			return nil, 0, err
+		}
+	}
+	return data, flags, nil
+}
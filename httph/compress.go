@@ -0,0 +1,259 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdSetCompressed            = metrics.AddCounter("cmd_set_compressed", nil)
+	MetricCmdSetCompressionSkipped    = metrics.AddCounter("cmd_set_compression_skipped", nil)
+	MetricCmdSetCompressionBytesSaved = metrics.AddCounter("cmd_set_compression_bytes_saved", nil)
+	MetricCmdGetDecompressed          = metrics.AddCounter("cmd_get_decompressed", nil)
+	MetricCmdGetDecompressionErrors   = metrics.AddCounter("cmd_get_decompression_errors", nil)
+
+	MetricCmdSetContentEncoded             = metrics.AddCounter("cmd_set_content_encoded", nil)
+	MetricCmdSetContentEncodingBytesSaved  = metrics.AddCounter("cmd_set_content_encoding_bytes_saved", nil)
+	MetricCmdSetContentEncodingUnsupported = metrics.AddCounter("cmd_set_content_encoding_unsupported", nil)
+)
+
+// DefaultCompressionThreshold is the smallest value, in bytes, that is
+// compressed when no threshold is configured
+const DefaultCompressionThreshold = 1024
+
+// CompressionOptions configures compression of the values sent to the backend
+type CompressionOptions struct {
+	// Algorithm is "gzip", "zstd" or "snappy". The values are stored compressed
+	// on the backend and marked with a reserved flag bit so a get can detect
+	// and decompress them regardless of the algorithm currently configured.
+	// Empty disables value compression.
+	Algorithm string
+
+	// Threshold is the smallest value, in bytes, that is compressed. Zero means
+	// DefaultCompressionThreshold.
+	Threshold int
+
+	// ContentEncoding enables gzip Content-Encoding on set request bodies once
+	// the proxy has advertised gzip in an Accept-Encoding response header, as
+	// described in RFC 7694. The proxy decodes the body and stores the value as
+	// usual. A 415 response turns it back off. Responses to gets are already
+	// negotiated by the HTTP client through Accept-Encoding.
+	ContentEncoding bool
+}
+
+func (o CompressionOptions) threshold() int {
+	if o.Threshold > 0 {
+		return o.Threshold
+	}
+	return DefaultCompressionThreshold
+}
+
+// The algorithm used is stored in the first byte of a compressed value
+const (
+	compressionGzip   byte = 1
+	compressionZstd   byte = 2
+	compressionSnappy byte = 3
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+
+	// The decoders limit the decompressed size, so there's one for each
+	// maximum value size in use
+	zstdDecoders sync.Map
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		// This can't fail with no options given
+		zstdEncoder, _ = zstd.NewWriter(nil)
+	})
+}
+
+// zstdDecoder returns a decoder that fails with zstd.ErrDecoderSizeExceeded
+// as soon as the output grows past max, even for frames that don't record
+// their size, and with zstd.ErrWindowSizeExceeded for frames whose window is
+// larger than max
+func zstdDecoder(max int) *zstd.Decoder {
+	if d, ok := zstdDecoders.Load(max); ok {
+		return d.(*zstd.Decoder)
+	}
+
+	// This can't fail with a valid max memory
+	d, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max)))
+	if prev, loaded := zstdDecoders.LoadOrStore(max, d); loaded {
+		d.Close()
+		return prev.(*zstd.Decoder)
+	}
+	return d
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzipBytes decompresses data, failing with errValueTooLarge if the result
+// would be larger than max
+func gunzipBytes(data []byte, max int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readBody(r, -1, max)
+}
+
+type compressor struct {
+	algo      byte
+	threshold int
+
+	// the largest value a decompressed value may be
+	maxSize int
+}
+
+func newCompressor(opts CompressionOptions, maxSize int) (*compressor, error) {
+	c := &compressor{threshold: opts.threshold(), maxSize: maxSize}
+
+	switch opts.Algorithm {
+	case "gzip":
+		c.algo = compressionGzip
+	case "zstd":
+		c.algo = compressionZstd
+		initZstd()
+	case "snappy":
+		c.algo = compressionSnappy
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", opts.Algorithm)
+	}
+
+	return c, nil
+}
+
+func (c *compressor) encode(key, data []byte, flags uint32) ([]byte, uint32, error) {
+	if len(data) < c.threshold {
+		return data, flags, nil
+	}
+
+	var compressed []byte
+	var err error
+
+	switch c.algo {
+	case compressionGzip:
+		compressed, err = gzipBytes(data)
+	case compressionZstd:
+		compressed = zstdEncoder.EncodeAll(data, nil)
+	case compressionSnappy:
+		compressed = snappy.Encode(nil, data)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Incompressible data is stored as-is
+	if len(compressed)+1 >= len(data) {
+		metrics.IncCounter(MetricCmdSetCompressionSkipped)
+		return data, flags, nil
+	}
+
+	out := make([]byte, len(compressed)+1)
+	out[0] = c.algo
+	copy(out[1:], compressed)
+
+	metrics.IncCounter(MetricCmdSetCompressed)
+	metrics.IncCounterBy(MetricCmdSetCompressionBytesSaved, uint64(len(data)-len(out)))
+
+	return out, flags | flagCompressed, nil
+}
+
+func (c *compressor) decode(key, data []byte, flags uint32) ([]byte, uint32, error) {
+	if flags&flagCompressed == 0 {
+		return data, flags, nil
+	}
+
+	if len(data) == 0 {
+		metrics.IncCounter(MetricCmdGetDecompressionErrors)
+		return nil, 0, errCorruptValue
+	}
+
+	var out []byte
+	var err error
+
+	// The decompressed size is checked up front where the format records it,
+	// and zstd stops once it has produced more than the limit, so a small
+	// corrupt or malicious value can't take a lot of memory
+	switch data[0] {
+	case compressionGzip:
+		out, err = gunzipBytes(data[1:], c.maxSize)
+	case compressionZstd:
+		out, err = zstdDecoder(c.maxSize).DecodeAll(data[1:], nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			err = errValueTooLarge
+		}
+	case compressionSnappy:
+		if n, lerr := snappy.DecodedLen(data[1:]); lerr == nil && n > c.maxSize {
+			err = errValueTooLarge
+		} else {
+			out, err = snappy.Decode(nil, data[1:])
+		}
+	default:
+		err = fmt.Errorf("unknown compression algorithm %d", data[0])
+	}
+
+	if err == errValueTooLarge {
+		return nil, 0, err
+	}
+	if err != nil {
+		metrics.IncCounter(MetricCmdGetDecompressionErrors)
+		return nil, 0, errCorruptValue
+	}
+
+	metrics.IncCounter(MetricCmdGetDecompressed)
+	return out, flags &^ flagCompressed, nil
+}
+
+// acceptsGzip reports whether a response advertises that the proxy accepts
+// gzip encoded request bodies
+func acceptsGzip(res *http.Response) bool {
+	for _, enc := range strings.Split(res.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.IndexByte(enc, ';'); i >= 0 {
+			enc = enc[:i]
+		}
+		if strings.EqualFold(enc, "gzip") {
+			return true
+		}
+	}
+	return false
+}
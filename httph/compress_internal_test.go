@@ -0,0 +1,71 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestZstdDecodeLimit(t *testing.T) {
+	// A streamed frame doesn't record its content size, so the limit can only
+	// be enforced while decoding. The window is small enough to be accepted.
+	buf := &bytes.Buffer{}
+	w, err := zstd.NewWriter(buf, zstd.WithWindowSize(1<<15))
+	if err != nil {
+		t.Fatalf("Failed to create encoder: %v", err)
+	}
+	if _, err := w.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+
+	var hdr zstd.Header
+	if err := hdr.Decode(buf.Bytes()); err != nil || hdr.HasFCS {
+		t.Fatalf("Expected a frame without a content size but got %+v, %v", hdr, err)
+	}
+
+	// Decoding stops at the limit rather than checking the size afterwards
+	if _, err := zstdDecoder(1<<16).DecodeAll(buf.Bytes(), nil); !errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		t.Fatalf("Expected zstd.ErrDecoderSizeExceeded but got %v", err)
+	}
+
+	data := append([]byte{compressionZstd}, buf.Bytes()...)
+
+	c, err := newCompressor(CompressionOptions{Algorithm: "zstd"}, 1<<16)
+	if err != nil {
+		t.Fatalf("Failed to create compressor: %v", err)
+	}
+	if _, _, err := c.decode(nil, data, flagCompressed); err != errValueTooLarge {
+		t.Fatalf("Expected errValueTooLarge but got %v", err)
+	}
+
+	c, err = newCompressor(CompressionOptions{Algorithm: "zstd"}, 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to create compressor: %v", err)
+	}
+	out, _, err := c.decode(nil, data, flagCompressed)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if len(out) != 1<<20 {
+		t.Fatalf("Expected %d bytes but got %d", 1<<20, len(out))
+	}
+}
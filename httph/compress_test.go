@@ -0,0 +1,224 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph_test
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+)
+
+func TestCompression(t *testing.T) {
+	big := strings.Repeat("compressible ", 200)
+
+	for _, algo := range []string{"gzip", "zstd", "snappy"} {
+		t.Run(algo, func(t *testing.T) {
+			s := newServer(0, 0)
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+
+			handler := handlerWithOptions(ts, httph.Options{
+				Compression: httph.CompressionOptions{Algorithm: algo},
+			})
+
+			err := handler.Set(common.SetRequest{
+				Key:   []byte("foo"),
+				Data:  []byte(big),
+				Flags: 5,
+			})
+			if err != nil {
+				t.Fatalf("Failed set request: %s", err.Error())
+			}
+
+			if len(s.data["foo"]) >= len(big) {
+				t.Fatalf("Value was not compressed. Stored %d bytes for %d byte value", len(s.data["foo"]), len(big))
+			}
+
+			res, err := getOne(handler, "foo")
+			if err != nil {
+				t.Fatalf("Failed to retrieve item: %s", err.Error())
+			}
+			if string(res.Data) != big {
+				t.Fatalf("Value did not round trip")
+			}
+			if res.Flags != 5 {
+				t.Fatalf("Expected flags of 5 but got %d", res.Flags)
+			}
+		})
+	}
+
+	t.Run("BelowThreshold", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			Compression: httph.CompressionOptions{Algorithm: "gzip"},
+		})
+
+		err := handler.Set(common.SetRequest{
+			Key:  []byte("foo"),
+			Data: []byte("bar"),
+		})
+		if err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		if s.data["foo"] != "bar" || s.flags["foo"] != "0" {
+			t.Fatalf("Small value should be stored as-is but got %q with flags %s", s.data["foo"], s.flags["foo"])
+		}
+	})
+
+	t.Run("ReadsOtherAlgorithms", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		writer := handlerWithOptions(ts, httph.Options{
+			Compression: httph.CompressionOptions{Algorithm: "snappy"},
+		})
+		reader := handlerWithOptions(ts, httph.Options{
+			Compression: httph.CompressionOptions{Algorithm: "zstd"},
+		})
+
+		if err := writer.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(big)}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		res, err := getOne(reader, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if string(res.Data) != big {
+			t.Fatalf("Value did not round trip")
+		}
+	})
+
+	t.Run("ReservedFlags", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			Compression: httph.CompressionOptions{Algorithm: "gzip"},
+		})
+
+		err := handler.Set(common.SetRequest{
+			Key:   []byte("foo"),
+			Data:  []byte("bar"),
+			Flags: httph.ReservedFlags,
+		})
+		if err != common.ErrInvalidArgs {
+			t.Fatalf("Expected ErrInvalidArgs but got %v", err)
+		}
+
+		if s.numReqs != 0 {
+			t.Fatalf("Expected no requests but got %d", s.numReqs)
+		}
+	})
+
+	t.Run("UnknownAlgorithm", func(t *testing.T) {
+		_, err := httph.NewWithOptions("localhost", 1234, "evcache", httph.Options{
+			Compression: httph.CompressionOptions{Algorithm: "lzma"},
+		})
+		if err == nil {
+			t.Fatalf("Expected an error for an unknown algorithm")
+		}
+	})
+}
+
+// encodingServer advertises and decodes gzip request bodies in front of s
+type encodingServer struct {
+	s       *server
+	accept  bool
+	encoded int
+}
+
+func (e *encodingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		if !e.accept {
+			w.WriteHeader(415)
+			return
+		}
+
+		r, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		req.Body = r
+		e.encoded++
+	}
+
+	w.Header().Set("Accept-Encoding", "gzip")
+	e.s.ServeHTTP(w, req)
+}
+
+func TestContentEncoding(t *testing.T) {
+	big := strings.Repeat("compressible ", 200)
+
+	t.Run("Negotiated", func(t *testing.T) {
+		e := &encodingServer{s: newServer(0, 0), accept: true}
+		ts := httptest.NewServer(e)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			Compression: httph.CompressionOptions{ContentEncoding: true},
+		})
+
+		// The first request learns that the proxy accepts gzip
+		for i := 0; i < 2; i++ {
+			if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(big)}); err != nil {
+				t.Fatalf("Failed set request: %s", err.Error())
+			}
+		}
+
+		if e.encoded != 1 {
+			t.Fatalf("Expected 1 encoded request but got %d", e.encoded)
+		}
+		if e.s.data["foo"] != big {
+			t.Fatalf("Value was not stored decoded")
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		e := &encodingServer{s: newServer(0, 0), accept: false}
+		ts := httptest.NewServer(e)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			Compression: httph.CompressionOptions{ContentEncoding: true},
+		})
+
+		for i := 0; i < 3; i++ {
+			if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(big)}); err != nil {
+				t.Fatalf("Failed set request: %s", err.Error())
+			}
+		}
+
+		// One plain set, one rejected encoded set resent plain, then plain
+		if e.s.numReqs != 3 {
+			t.Fatalf("Expected 3 requests to reach the backend but got %d", e.s.numReqs)
+		}
+		if e.s.data["foo"] != big {
+			t.Fatalf("Value was not stored")
+		}
+	})
+}
@@ -0,0 +1,276 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedOp is returned by a Dialect when the backend has no way to
+// perform the requested operation.
+var ErrUnsupportedOp = errors.New("operation not supported by dialect")
+
+// Op is a cache operation that a Dialect maps onto an HTTP request
+type Op int
+
+// The operations a Dialect knows how to translate
+const (
+	OpGet Op = iota
+	OpSet
+	OpDelete
+	OpTouch
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpGet:
+		return "GET"
+	case OpSet:
+		return "SET"
+	case OpDelete:
+		return "DELETE"
+	case OpTouch:
+		return "TOUCH"
+	}
+	return "UNKNOWN"
+}
+
+// Status is a Dialect's interpretation of an HTTP status code
+type Status int
+
+const (
+	// StatusSuccess means the operation completed
+	StatusSuccess Status = iota
+	// StatusMiss means the key does not exist on the backend
+	StatusMiss
+	// StatusRetry means the operation failed but may succeed if tried again
+	StatusRetry
+	// StatusFail means the operation failed and would fail again if retried
+	StatusFail
+)
+
+// Dialect describes how the cache operations map onto the REST API of a
+// particular backend store: the method, path, query and headers of each
+// request and the meaning of the status codes that come back.
+type Dialect interface {
+	// Name is the name used to select the dialect, e.g. on the command line
+	Name() string
+
+	// Request builds the request for an operation on a key against the server
+	// at base (e.g. "http://localhost:8080"). The flags and ttl are only used by
+	// set and touch. The body of a set is attached by the Handler. Returns
+	// ErrUnsupportedOp if the backend cannot perform the operation.
+	Request(op Op, base string, key []byte, flags, ttl uint32) (*http.Request, error)
+
+	// Status classifies the status code of a response to an operation
+	Status(op Op, code int) Status
+
+	// Flags extracts the item flags from a successful get response
+	Flags(res *http.Response) (uint32, error)
+}
+
+// DialectByName returns the built-in dialect with the given name for a cache.
+// The recognized names are "evcache" (the default) and "kv". The kv dialect
+// uses the cache name as its path prefix, so it must not be empty.
+func DialectByName(name, cache string) (Dialect, error) {
+	switch name {
+	case "", "evcache":
+		return NewEVCacheDialect(cache), nil
+	case "kv":
+		if strings.Trim(cache, "/") == "" {
+			return nil, errors.New("the kv dialect needs a cache name")
+		}
+		return NewKVDialect(cache), nil
+	}
+	return nil, fmt.Errorf("unknown dialect %q", name)
+}
+
+// parseFlags parses a flags header value. Java based proxies treat flags as a
+// signed int, so negative values are accepted and reinterpreted as unsigned.
+func parseFlags(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	flags, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if flags < math.MinInt32 || flags > math.MaxUint32 {
+		return 0, fmt.Errorf("flags out of range: %d", flags)
+	}
+	return uint32(flags), nil
+}
+
+////////////
+// EVCache
+////////////
+
+type evcacheDialect struct {
+	cache string
+}
+
+// NewEVCacheDialect creates the dialect for the EVCache REST proxy, which
+// serves items under /evcrest/v1.0/<cache>/<key>?raw=true and returns the item
+// flags in the X-EVCache-Flags header.
+func NewEVCacheDialect(cache string) Dialect {
+	return evcacheDialect{cache: cache}
+}
+
+func (d evcacheDialect) Name() string {
+	return "evcache"
+}
+
+func (d evcacheDialect) Request(op Op, base string, key []byte, flags, ttl uint32) (*http.Request, error) {
+	url := base + "/evcrest/v1.0/" + d.cache + "/" + string(key) + "?raw=true"
+
+	switch op {
+	case OpGet:
+		return http.NewRequest("GET", url, nil)
+
+	case OpSet:
+		url += "&ttl=" + strconv.Itoa(int(ttl)) + "&flag=" + strconv.Itoa(int(flags))
+		req, err := http.NewRequest("PUT", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+
+	case OpDelete:
+		return http.NewRequest("DELETE", url, nil)
+	}
+
+	return nil, ErrUnsupportedOp
+}
+
+func (d evcacheDialect) Status(op Op, code int) Status {
+	switch op {
+	case OpGet:
+		switch code {
+		case 200:
+			return StatusSuccess
+		case 404:
+			return StatusMiss
+		case 500:
+			// Don't retry for a request that will very likely fail
+			return StatusFail
+		}
+
+	case OpSet:
+		if code >= 200 && code < 300 {
+			return StatusSuccess
+		}
+		// Shortcut on errors that are going to fail on subsequent tries
+		if code == 400 || code == 500 {
+			return StatusFail
+		}
+
+	case OpDelete:
+		if code >= 200 && code < 300 {
+			return StatusSuccess
+		}
+		// Shortcut on failures where subsequent requests will fail
+		if code == 500 {
+			return StatusFail
+		}
+	}
+
+	return StatusRetry
+}
+
+func (d evcacheDialect) Flags(res *http.Response) (uint32, error) {
+	return parseFlags(res.Header.Get(evcacheFlagsHeaderName))
+}
+
+///////////////
+// Generic KV
+///////////////
+
+const (
+	kvTTLHeaderName   = "X-TTL"
+	kvFlagsHeaderName = "X-Flags"
+)
+
+type kvDialect struct {
+	prefix string
+}
+
+// NewKVDialect creates the dialect for a generic REST key-value store. Items
+// live at /<prefix>/<key>, read with GET, written with PUT and removed with
+// DELETE. The TTL in seconds is sent in the X-TTL header and the flags are sent
+// and returned in the X-Flags header. A touch is a PATCH carrying only X-TTL.
+func NewKVDialect(prefix string) Dialect {
+	return kvDialect{prefix: strings.Trim(prefix, "/")}
+}
+
+func (d kvDialect) Name() string {
+	return "kv"
+}
+
+func (d kvDialect) Request(op Op, base string, key []byte, flags, ttl uint32) (*http.Request, error) {
+	u := base + "/" + d.prefix + "/" + url.PathEscape(string(key))
+
+	var req *http.Request
+	var err error
+
+	switch op {
+	case OpGet:
+		return http.NewRequest("GET", u, nil)
+
+	case OpSet:
+		if req, err = http.NewRequest("PUT", u, nil); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set(kvFlagsHeaderName, strconv.FormatUint(uint64(flags), 10))
+
+	case OpDelete:
+		return http.NewRequest("DELETE", u, nil)
+
+	case OpTouch:
+		if req, err = http.NewRequest("PATCH", u, nil); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, ErrUnsupportedOp
+	}
+
+	req.Header.Set(kvTTLHeaderName, strconv.FormatUint(uint64(ttl), 10))
+	return req, nil
+}
+
+func (d kvDialect) Status(op Op, code int) Status {
+	switch {
+	case code >= 200 && code < 300:
+		return StatusSuccess
+	case code == 404:
+		return StatusMiss
+	case code == 408 || code == 429 || code >= 502:
+		// timeouts, throttling and unavailable gateways are transient
+		return StatusRetry
+	}
+	return StatusFail
+}
+
+func (d kvDialect) Flags(res *http.Response) (uint32, error) {
+	return parseFlags(res.Header.Get(kvFlagsHeaderName))
+}
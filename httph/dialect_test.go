@@ -0,0 +1,299 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+type kvItem struct {
+	data  string
+	flags string
+	ttl   string
+}
+
+type kvServer struct {
+	data      map[string]kvItem
+	forcecode int
+	numReqs   int
+}
+
+func newKVServer(forcecode int) *kvServer {
+	return &kvServer{
+		data:      make(map[string]kvItem),
+		forcecode: forcecode,
+	}
+}
+
+func (s *kvServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.numReqs++
+
+	if !strings.HasPrefix(req.URL.Path, "/store/") {
+		w.WriteHeader(400)
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/store/")
+
+	if s.forcecode > 0 {
+		w.WriteHeader(s.forcecode)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		if item, ok := s.data[key]; ok {
+			w.Header().Set("X-Flags", item.flags)
+			w.Write([]byte(item.data))
+		} else {
+			w.WriteHeader(404)
+		}
+
+	case "PUT":
+		ttl := req.Header.Get("X-TTL")
+		if _, err := strconv.Atoi(ttl); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		s.data[key] = kvItem{
+			data:  string(data),
+			flags: req.Header.Get("X-Flags"),
+			ttl:   ttl,
+		}
+		w.WriteHeader(204)
+
+	case "PATCH":
+		item, ok := s.data[key]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		item.ttl = req.Header.Get("X-TTL")
+		s.data[key] = item
+		w.WriteHeader(204)
+
+	case "DELETE":
+		if _, ok := s.data[key]; !ok {
+			w.WriteHeader(404)
+			return
+		}
+		delete(s.data, key)
+		w.WriteHeader(204)
+
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func kvHandlerFromTestServer(ts *httptest.Server) handlers.Handler {
+	hostAndPort := strings.TrimPrefix(ts.URL, "http://")
+	parts := strings.Split(hostAndPort, ":")
+
+	port, err := strconv.Atoi(parts[1])
+	if err != nil {
+		panic(err)
+	}
+
+	dialect, err := httph.DialectByName("kv", "store")
+	if err != nil {
+		panic(err)
+	}
+
+	hc, err := httph.NewWithOptions(parts[0], port, "store", httph.Options{Dialect: dialect})
+	if err != nil {
+		panic(err)
+	}
+
+	handler, err := hc()
+	if err != nil {
+		panic(err)
+	}
+
+	return handler
+}
+
+func TestDialectByName(t *testing.T) {
+	for _, name := range []string{"", "evcache", "kv"} {
+		if _, err := httph.DialectByName(name, "cache"); err != nil {
+			t.Errorf("Expected dialect %q to exist but got error: %v", name, err)
+		}
+	}
+
+	if _, err := httph.DialectByName("kv", ""); err == nil {
+		t.Errorf("Expected an error for the kv dialect without a cache name")
+	}
+	if _, err := httph.DialectByName("memcached", "cache"); err == nil {
+		t.Errorf("Expected an error for an unknown dialect")
+	}
+}
+
+func TestEVCacheDialect(t *testing.T) {
+	d := httph.NewEVCacheDialect("evcache")
+
+	t.Run("SetURL", func(t *testing.T) {
+		req, err := d.Request(httph.OpSet, "http://localhost:1234", []byte("foo"), 5, 10)
+		if err != nil {
+			t.Fatalf("Got error building request: %v", err)
+		}
+		if req.Method != "PUT" {
+			t.Errorf("Expected PUT but got %s", req.Method)
+		}
+		expected := "http://localhost:1234/evcrest/v1.0/evcache/foo?raw=true&ttl=10&flag=5"
+		if req.URL.String() != expected {
+			t.Errorf("Expected URL %s but got %s", expected, req.URL)
+		}
+	})
+
+	t.Run("TouchUnsupported", func(t *testing.T) {
+		if _, err := d.Request(httph.OpTouch, "http://localhost:1234", []byte("foo"), 0, 10); err != httph.ErrUnsupportedOp {
+			t.Errorf("Expected ErrUnsupportedOp but got %v", err)
+		}
+	})
+
+	t.Run("NegativeFlags", func(t *testing.T) {
+		res := &http.Response{Header: http.Header{}}
+		res.Header.Set("X-EVCache-Flags", "-1")
+		flags, err := d.Flags(res)
+		if err != nil {
+			t.Fatalf("Got error parsing flags: %v", err)
+		}
+		if flags != 0xFFFFFFFF {
+			t.Errorf("Expected flags 0xFFFFFFFF but got %x", flags)
+		}
+	})
+}
+
+func TestKVDialect(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		s := newKVServer(0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := kvHandlerFromTestServer(ts)
+
+		err := handler.Set(common.SetRequest{
+			Key:     []byte("foo"),
+			Data:    []byte("bar"),
+			Flags:   42,
+			Exptime: 30,
+		})
+		if err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		if item := s.data["foo"]; item.data != "bar" || item.flags != "42" || item.ttl != "30" {
+			t.Fatalf("Set stored the wrong item: %#v", item)
+		}
+
+		datchan, errchan := handler.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("foo")},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+
+		select {
+		case res := <-datchan:
+			if res.Miss {
+				t.Fatalf("Response was a miss")
+			}
+			if string(res.Data) != "bar" || res.Flags != 42 {
+				t.Fatalf("Got wrong item back: %#v", res)
+			}
+		case err := <-errchan:
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+	})
+
+	t.Run("Touch", func(t *testing.T) {
+		s := newKVServer(0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := kvHandlerFromTestServer(ts)
+		s.data["foo"] = kvItem{data: "bar", ttl: "10"}
+
+		if err := handler.Touch(common.TouchRequest{Key: []byte("foo"), Exptime: 60}); err != nil {
+			t.Fatalf("Failed touch request: %s", err.Error())
+		}
+		if ttl := s.data["foo"].ttl; ttl != "60" {
+			t.Fatalf("Expected TTL of 60 but got %s", ttl)
+		}
+
+		if err := handler.Touch(common.TouchRequest{Key: []byte("baz"), Exptime: 60}); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound but got %v", err)
+		}
+	})
+
+	t.Run("DeleteMiss", func(t *testing.T) {
+		s := newKVServer(0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := kvHandlerFromTestServer(ts)
+
+		if err := handler.Delete(common.DeleteRequest{Key: []byte("foo")}); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound but got %v", err)
+		}
+	})
+
+	t.Run("NoRetriesOnClientError", func(t *testing.T) {
+		s := newKVServer(400)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := kvHandlerFromTestServer(ts)
+
+		err := handler.Set(common.SetRequest{
+			Key:  []byte("foo"),
+			Data: []byte("bar"),
+		})
+		if err == nil {
+			t.Fatalf("Should have received an error.")
+		}
+
+		if s.numReqs != 1 {
+			t.Fatalf("Expected number of requests to be 1 but got %d", s.numReqs)
+		}
+	})
+
+	t.Run("RetriesOnUnavailable", func(t *testing.T) {
+		s := newKVServer(503)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := kvHandlerFromTestServer(ts)
+
+		if err := handler.Delete(common.DeleteRequest{Key: []byte("foo")}); err == nil {
+			t.Fatalf("Should have received an error.")
+		}
+
+		if s.numReqs != httph.DefaultNumTries {
+			t.Fatalf("Expected number of requests to be %d but got %d", httph.DefaultNumTries, s.numReqs)
+		}
+	})
+}
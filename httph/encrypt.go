@@ -0,0 +1,192 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdSetEncrypted          = metrics.AddCounter("cmd_set_encrypted", nil)
+	MetricCmdGetDecrypted          = metrics.AddCounter("cmd_get_decrypted", nil)
+	MetricCmdGetDecryptAuthErrors  = metrics.AddCounter("cmd_get_decrypt_auth_errors", nil)
+	MetricCmdGetDecryptUnknownKeys = metrics.AddCounter("cmd_get_decrypt_unknown_keys", nil)
+	MetricCmdGetDecryptBadEnvelope = metrics.AddCounter("cmd_get_decrypt_bad_envelope", nil)
+)
+
+// EncryptionOptions configures AES-GCM encryption of values at rest on the
+// backend
+type EncryptionOptions struct {
+	// KeyDir is a directory of key files named <key id>.key, each holding a hex
+	// encoded 16, 24 or 32 byte AES key. Empty disables encryption.
+	KeyDir string
+
+	// ActiveKeyID is the id of the key used to encrypt new values. All of the
+	// keys in KeyDir can decrypt, so during a rotation the new key is added,
+	// made active, and the old one removed once its values have expired.
+	ActiveKeyID string
+}
+
+// The stored envelope is:
+//
+//	version     1 byte
+//	key id len  1 byte
+//	key id      key id len bytes
+//	nonce       12 bytes
+//	ciphertext  the sealed value including the GCM tag
+//
+// The item key is authenticated as additional data so a value can't be
+// swapped under another key without detection.
+const envelopeVersion = 1
+
+// LoadKeys reads all of the key files in a directory, keyed by key id
+func LoadKeys(dir string) (map[string][]byte, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte)
+	for _, p := range paths {
+		id := strings.TrimSuffix(filepath.Base(p), ".key")
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key id %q in %s", id, p)
+		}
+
+		raw, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s is not hex encoded: %v", p, err)
+		}
+
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("key file %s holds a %d byte key, expected 16, 24 or 32", p, len(key))
+		}
+
+		keys[id] = key
+	}
+
+	return keys, nil
+}
+
+type encryptor struct {
+	activeID string
+	aeads    map[string]cipher.AEAD
+}
+
+func newEncryptor(opts EncryptionOptions) (*encryptor, error) {
+	keys, err := LoadKeys(opts.KeyDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := keys[opts.ActiveKeyID]; !ok {
+		return nil, fmt.Errorf("active key %q not found in %s", opts.ActiveKeyID, opts.KeyDir)
+	}
+
+	e := &encryptor{
+		activeID: opts.ActiveKeyID,
+		aeads:    make(map[string]cipher.AEAD),
+	}
+
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		e.aeads[id] = aead
+	}
+
+	return e, nil
+}
+
+func (e *encryptor) encode(key, data []byte, flags uint32) ([]byte, uint32, error) {
+	aead := e.aeads[e.activeID]
+
+	headerLen := 2 + len(e.activeID)
+	out := make([]byte, headerLen+aead.NonceSize(), headerLen+aead.NonceSize()+len(data)+aead.Overhead())
+	out[0] = envelopeVersion
+	out[1] = byte(len(e.activeID))
+	copy(out[2:], e.activeID)
+
+	nonce := out[headerLen:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, 0, err
+	}
+
+	out = aead.Seal(out, nonce, data, key)
+
+	metrics.IncCounter(MetricCmdSetEncrypted)
+	return out, flags | flagEncrypted, nil
+}
+
+func (e *encryptor) decode(key, data []byte, flags uint32) ([]byte, uint32, error) {
+	if flags&flagEncrypted == 0 {
+		return data, flags, nil
+	}
+
+	if len(data) < 2 || data[0] != envelopeVersion || len(data) < 2+int(data[1]) {
+		metrics.IncCounter(MetricCmdGetDecryptBadEnvelope)
+		return nil, 0, errCorruptValue
+	}
+
+	headerLen := 2 + int(data[1])
+	id := string(data[2:headerLen])
+
+	aead, ok := e.aeads[id]
+	if !ok {
+		log.Printf("[GET] Value for key %q is encrypted with unknown key %q\n", key, id)
+		metrics.IncCounter(MetricCmdGetDecryptUnknownKeys)
+		return nil, 0, errCorruptValue
+	}
+
+	if len(data) < headerLen+aead.NonceSize()+aead.Overhead() {
+		metrics.IncCounter(MetricCmdGetDecryptBadEnvelope)
+		return nil, 0, errCorruptValue
+	}
+
+	nonce := data[headerLen : headerLen+aead.NonceSize()]
+	ciphertext := data[headerLen+aead.NonceSize():]
+
+	out, err := aead.Open(nil, nonce, ciphertext, key)
+	if err != nil {
+		log.Printf("[GET] Authentication failed decrypting value for key %q\n", key)
+		metrics.IncCounter(MetricCmdGetDecryptAuthErrors)
+		return nil, 0, errCorruptValue
+	}
+
+	metrics.IncCounter(MetricCmdGetDecrypted)
+	return out, flags &^ flagEncrypted, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+)
+
+func writeKey(t *testing.T, dir, id, hexkey string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, id+".key"), []byte(hexkey+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+}
+
+func keyDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rend-http-keys")
+	if err != nil {
+		t.Fatalf("Failed to create key dir: %v", err)
+	}
+
+	writeKey(t, dir, "old", strings.Repeat("11", 32))
+	writeKey(t, dir, "new", strings.Repeat("22", 16))
+
+	return dir
+}
+
+func TestEncryption(t *testing.T) {
+	dir := keyDir(t)
+	defer os.RemoveAll(dir)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			Encryption: httph.EncryptionOptions{KeyDir: dir, ActiveKeyID: "new"},
+		})
+
+		err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("secret"), Flags: 4})
+		if err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		if strings.Contains(s.data["foo"], "secret") {
+			t.Fatalf("Value was stored in plaintext: %q", s.data["foo"])
+		}
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if res.Miss || string(res.Data) != "secret" || res.Flags != 4 {
+			t.Fatalf("Got wrong item back: %#v", res)
+		}
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		oldHandler := handlerWithOptions(ts, httph.Options{
+			Encryption: httph.EncryptionOptions{KeyDir: dir, ActiveKeyID: "old"},
+		})
+		newHandler := handlerWithOptions(ts, httph.Options{
+			Encryption: httph.EncryptionOptions{KeyDir: dir, ActiveKeyID: "new"},
+		})
+
+		if err := oldHandler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("secret")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		res, err := getOne(newHandler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if string(res.Data) != "secret" {
+			t.Fatalf("Value written with the old key did not decrypt: %#v", res)
+		}
+	})
+
+	t.Run("TamperedValue", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{
+			Encryption: httph.EncryptionOptions{KeyDir: dir, ActiveKeyID: "new"},
+		})
+
+		if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("secret")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		// Moving the value to another key fails authentication
+		s.data["bar"] = s.data["foo"]
+		s.flags["bar"] = s.flags["foo"]
+
+		if res, err := getOne(handler, "bar"); err == nil {
+			t.Fatalf("Expected an error but got %#v", res)
+		}
+	})
+
+	t.Run("MissingActiveKey", func(t *testing.T) {
+		_, err := httph.NewWithOptions("localhost", 1234, "evcache", httph.Options{
+			Encryption: httph.EncryptionOptions{KeyDir: dir, ActiveKeyID: "missing"},
+		})
+		if err == nil {
+			t.Fatalf("Expected an error for a missing active key")
+		}
+	})
+}
+
+func TestLoadKeys(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		dir := keyDir(t)
+		defer os.RemoveAll(dir)
+
+		keys, err := httph.LoadKeys(dir)
+		if err != nil {
+			t.Fatalf("Failed to load keys: %v", err)
+		}
+		if len(keys["old"]) != 32 || len(keys["new"]) != 16 {
+			t.Fatalf("Loaded wrong keys: %v", keys)
+		}
+	})
+
+	t.Run("BadLength", func(t *testing.T) {
+		dir := keyDir(t)
+		defer os.RemoveAll(dir)
+
+		writeKey(t, dir, "short", "1234")
+
+		if _, err := httph.LoadKeys(dir); err == nil {
+			t.Fatalf("Expected an error for a short key")
+		}
+	})
+
+	t.Run("NotHex", func(t *testing.T) {
+		dir := keyDir(t)
+		defer os.RemoveAll(dir)
+
+		writeKey(t, dir, "text", strings.Repeat("zz", 16))
+
+		if _, err := httph.LoadKeys(dir); err == nil {
+			t.Fatalf("Expected an error for a key that isn't hex")
+		}
+	})
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdGetFallbacks          = metrics.AddCounter("cmd_get_fallbacks", nil)
+	MetricCmdGetFallbackHits       = metrics.AddCounter("cmd_get_fallback_hits", nil)
+	MetricCmdGetFallbackErrors     = metrics.AddCounter("cmd_get_fallback_errors", nil)
+	MetricCmdGetReadRepairs        = metrics.AddCounter("cmd_get_read_repairs", nil)
+	MetricCmdGetReadRepairErrors   = metrics.AddCounter("cmd_get_read_repair_errors", nil)
+	MetricCmdGetReadRepairsDropped = metrics.AddCounter("cmd_get_read_repairs_dropped", nil)
+	MetricCmdGetReadRepairsSkipped = metrics.AddCounter("cmd_get_read_repairs_skipped", nil)
+)
+
+// DefaultMaxRepairs is the number of read-repairs that may be in flight at
+// once when no limit is configured
+const DefaultMaxRepairs = 100
+
+// FallbackOptions configures a second backend that gets are sent to when the
+// primary misses or fails, for example the old cache while a new one warms up.
+// The fallback is only read from.
+type FallbackOptions struct {
+	// Host and Port locate the fallback's REST proxy. An empty Host disables
+	// the fallback.
+	Host string
+	Port int
+
+	// Dialect maps gets onto the fallback's REST API. If nil, the EVCache
+	// dialect is used for Cache.
+	Dialect Dialect
+	Cache   string
+
+	// ReadRepair copies values found on the fallback after a miss on the
+	// primary back into the primary in the background. The value is stored
+	// as-is with its original flags and RepairTTL as its TTL. A repair is
+	// skipped if the key is set or deleted through the handler after the
+	// miss, so it never overwrites a newer value.
+	ReadRepair bool
+	RepairTTL  uint32
+
+	// MaxRepairs bounds the repairs in flight at once. Repairs found while
+	// that many are running are dropped and counted. Zero means
+	// DefaultMaxRepairs.
+	MaxRepairs int
+}
+
+func (o FallbackOptions) maxRepairs() int {
+	if o.MaxRepairs > 0 {
+		return o.MaxRepairs
+	}
+	return DefaultMaxRepairs
+}
+
+func (o FallbackOptions) endpoint() *endpoint {
+	dialect := o.Dialect
+	if dialect == nil {
+		dialect = NewEVCacheDialect(o.Cache)
+	}
+
+	return &endpoint{
+		baseurl: fmt.Sprintf("http://%s:%d", o.Host, o.Port),
+		dialect: dialect,
+	}
+}
+
+// pendingRepair is a read-repair of a key from the primary's miss until the
+// value is stored. Sets and deletes of the key mark it superseded, waiting for
+// a store already under way so theirs lands after it.
+type pendingRepair struct {
+	sync.Mutex
+	superseded bool
+}
+
+// startRepair registers a repair of key, returning nil if one is already
+// pending
+func (h *Handler) startRepair(key []byte) *pendingRepair {
+	h.repairMu.Lock()
+	defer h.repairMu.Unlock()
+
+	if _, ok := h.pending[string(key)]; ok {
+		return nil
+	}
+	p := &pendingRepair{}
+	h.pending[string(key)] = p
+	return p
+}
+
+func (h *Handler) endRepair(key []byte, p *pendingRepair) {
+	if p == nil {
+		return
+	}
+
+	h.repairMu.Lock()
+	if h.pending[string(key)] == p {
+		delete(h.pending, string(key))
+	}
+	h.repairMu.Unlock()
+}
+
+// supersedeRepair keeps a pending repair of key from storing its value
+func (h *Handler) supersedeRepair(key []byte) {
+	if !h.readRepair {
+		return
+	}
+
+	h.repairMu.Lock()
+	p := h.pending[string(key)]
+	h.repairMu.Unlock()
+
+	if p != nil {
+		p.Lock()
+		p.superseded = true
+		p.Unlock()
+	}
+}
+
+// fetchFallback reads a value from the fallback after the primary missed or
+// failed with primaryErr. A miss on the fallback is a miss even if the primary
+// failed. If both fail, the primary's error is returned.
+func (h *Handler) fetchFallback(key []byte, primaryErr error) ([]byte, uint32, bool, error) {
+	metrics.IncCounter(MetricCmdGetFallbacks)
+
+	// There's no point in repairing a primary that is failing. The repair is
+	// registered before the fallback is read so sets made meanwhile count.
+	var p *pendingRepair
+	if h.readRepair && primaryErr == nil {
+		p = h.startRepair(key)
+	}
+	repairing := false
+	defer func() {
+		if !repairing {
+			h.endRepair(key, p)
+		}
+	}()
+
+	data, flags, found, err := h.fetchStored(h.fallback, key)
+	if err == errValueTooLarge {
+		return nil, 0, false, err
+	}
+	if err != nil {
+		log.Printf("[GET] Failed to read key %q from the fallback: %v\n", key, err)
+		metrics.IncCounter(MetricCmdGetFallbackErrors)
+		return nil, 0, false, primaryErr
+	}
+
+	if !found {
+		return nil, 0, false, nil
+	}
+
+	metrics.IncCounter(MetricCmdGetFallbackHits)
+
+	if p != nil {
+		select {
+		case h.repairs <- struct{}{}:
+			k := make([]byte, len(key))
+			copy(k, key)
+			repairing = true
+			go h.repair(k, data, flags, p)
+		default:
+			metrics.IncCounter(MetricCmdGetReadRepairsDropped)
+		}
+	}
+
+	return data, flags, true, nil
+}
+
+// repair stores a value read from the fallback in the primary unless the key
+// has been written since the miss
+func (h *Handler) repair(key, data []byte, flags uint32, p *pendingRepair) {
+	defer func() { <-h.repairs }()
+	defer h.endRepair(key, p)
+
+	p.Lock()
+	defer p.Unlock()
+	if p.superseded {
+		metrics.IncCounter(MetricCmdGetReadRepairsSkipped)
+		return
+	}
+	metrics.IncCounter(MetricCmdGetReadRepairs)
+
+	var err error
+	if h.chunkSize > 0 && len(data) > h.chunkSize {
+		err = h.storeChunked(key, data, flags, h.repairTTL)
+	} else {
+		err = h.store(key, data, flags, h.repairTTL)
+	}
+
+	if err != nil {
+		log.Printf("[GET] Failed to repair key %q in the primary: %v\n", key, err)
+		metrics.IncCounter(MetricCmdGetReadRepairErrors)
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+func fallbackSetup(primaryCode int, repair bool) (*server, *server, func(), handlers.Handler) {
+	p := newServer(primaryCode, 0)
+	f := newServer(0, 0)
+	pts := httptest.NewServer(p)
+	fts := httptest.NewServer(f)
+
+	parts := strings.Split(strings.TrimPrefix(fts.URL, "http://"), ":")
+	port, _ := strconv.Atoi(parts[1])
+
+	handler := handlerWithOptions(pts, httph.Options{
+		Fallback: httph.FallbackOptions{
+			Host:       parts[0],
+			Port:       port,
+			Cache:      "evcache",
+			ReadRepair: repair,
+			RepairTTL:  60,
+		},
+	})
+
+	return p, f, func() { pts.Close(); fts.Close() }, handler
+}
+
+// waitFor polls until cond holds or a second has passed
+func waitFor(s *server, cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		s.Lock()
+		ok := cond()
+		s.Unlock()
+		if ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFallback(t *testing.T) {
+	t.Run("MissFallsBack", func(t *testing.T) {
+		p, f, done, handler := fallbackSetup(0, false)
+		defer done()
+
+		f.data["foo"] = "bar"
+		f.flags["foo"] = "7"
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if res.Miss || string(res.Data) != "bar" || res.Flags != 7 {
+			t.Fatalf("Expected the fallback's item but got %#v", res)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		p.Lock()
+		defer p.Unlock()
+		if _, ok := p.data["foo"]; ok {
+			t.Fatalf("Item was copied to the primary without read-repair on")
+		}
+	})
+
+	t.Run("HitDoesNotFallBack", func(t *testing.T) {
+		p, f, done, handler := fallbackSetup(0, false)
+		defer done()
+
+		p.data["foo"] = "primary"
+		f.data["foo"] = "fallback"
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if string(res.Data) != "primary" {
+			t.Fatalf("Expected the primary's item but got %#v", res)
+		}
+		if f.numReqs != 0 {
+			t.Fatalf("Expected no requests to the fallback but got %d", f.numReqs)
+		}
+	})
+
+	t.Run("BothMiss", func(t *testing.T) {
+		_, _, done, handler := fallbackSetup(0, false)
+		defer done()
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if !res.Miss {
+			t.Fatalf("Expected a miss but got %#v", res)
+		}
+	})
+
+	t.Run("ErrorFallsBack", func(t *testing.T) {
+		p, f, done, handler := fallbackSetup(500, true)
+		defer done()
+
+		f.data["foo"] = "bar"
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if string(res.Data) != "bar" {
+			t.Fatalf("Expected the fallback's item but got %#v", res)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		p.Lock()
+		defer p.Unlock()
+		if p.numReqs != 1 {
+			t.Fatalf("Expected no read-repair of a failing primary but got %d requests", p.numReqs)
+		}
+	})
+
+	t.Run("ReadRepair", func(t *testing.T) {
+		p, f, done, handler := fallbackSetup(0, true)
+		defer done()
+
+		f.data["foo"] = "bar"
+		f.flags["foo"] = "7"
+
+		if _, err := getOne(handler, "foo"); err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+
+		repaired := waitFor(p, func() bool {
+			return p.data["foo"] == "bar" && p.flags["foo"] == "7"
+		})
+		if !repaired {
+			t.Fatalf("Item was not copied to the primary with its flags")
+		}
+	})
+
+	t.Run("ReadRepairEncoded", func(t *testing.T) {
+		p := newServer(0, 0)
+		f := newServer(0, 0)
+		pts := httptest.NewServer(p)
+		fts := httptest.NewServer(f)
+		defer pts.Close()
+		defer fts.Close()
+
+		opts := httph.Options{Checksum: httph.ChecksumOptions{Algorithm: "crc32c"}}
+
+		// Write the item to the fallback with the same options
+		writer := handlerWithOptions(fts, opts)
+		if err := writer.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		parts := strings.Split(strings.TrimPrefix(fts.URL, "http://"), ":")
+		port, _ := strconv.Atoi(parts[1])
+		opts.Fallback = httph.FallbackOptions{Host: parts[0], Port: port, Cache: "evcache", ReadRepair: true}
+		handler := handlerWithOptions(pts, opts)
+
+		res, err := getOne(handler, "foo")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if string(res.Data) != "bar" {
+			t.Fatalf("Expected the decoded item but got %#v", res)
+		}
+
+		f.Lock()
+		stored := f.data["foo"]
+		f.Unlock()
+
+		if !waitFor(p, func() bool { return p.data["foo"] == stored }) {
+			t.Fatalf("Item was not copied to the primary as stored")
+		}
+	})
+	t.Run("ReadRepairBounded", func(t *testing.T) {
+		p := newServer(0, 0)
+		f := newServer(0, 0)
+		release := make(chan struct{})
+
+		// Sets to the primary wait until released so the first repair stays
+		// in flight
+		pts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != "GET" {
+				<-release
+			}
+			p.ServeHTTP(w, req)
+		}))
+		fts := httptest.NewServer(f)
+		defer pts.Close()
+		defer fts.Close()
+
+		parts := strings.Split(strings.TrimPrefix(fts.URL, "http://"), ":")
+		port, _ := strconv.Atoi(parts[1])
+		handler := handlerWithOptions(pts, httph.Options{
+			Fallback: httph.FallbackOptions{
+				Host:       parts[0],
+				Port:       port,
+				Cache:      "evcache",
+				ReadRepair: true,
+				MaxRepairs: 1,
+			},
+		})
+
+		for _, key := range []string{"a", "b", "c"} {
+			f.data[key] = key
+			if _, err := getOne(handler, key); err != nil {
+				t.Fatalf("Failed to retrieve item: %s", err.Error())
+			}
+		}
+		close(release)
+
+		if !waitFor(p, func() bool { return len(p.data) > 0 }) {
+			t.Fatalf("Expected the first item to be repaired")
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		p.Lock()
+		defer p.Unlock()
+		if len(p.data) != 1 || p.data["a"] != "a" {
+			t.Fatalf("Expected only the first repair to run but got %v", p.data)
+		}
+	})
+
+	t.Run("ReadRepairSuperseded", func(t *testing.T) {
+		p := newServer(0, 0)
+		f := newServer(0, 0)
+		reading := make(chan struct{})
+		release := make(chan struct{})
+
+		// The fallback read waits until released so the key can be set
+		// while the repair is pending
+		pts := httptest.NewServer(p)
+		fts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			close(reading)
+			<-release
+			f.ServeHTTP(w, req)
+		}))
+		defer pts.Close()
+		defer fts.Close()
+
+		parts := strings.Split(strings.TrimPrefix(fts.URL, "http://"), ":")
+		port, _ := strconv.Atoi(parts[1])
+		handler := handlerWithOptions(pts, httph.Options{
+			Fallback: httph.FallbackOptions{
+				Host:       parts[0],
+				Port:       port,
+				Cache:      "evcache",
+				ReadRepair: true,
+			},
+		})
+
+		f.data["foo"] = "old"
+		got := make(chan error, 1)
+		go func() {
+			_, err := getOne(handler, "foo")
+			got <- err
+		}()
+
+		<-reading
+		if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("new")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+		close(release)
+
+		if err := <-got; err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		p.Lock()
+		defer p.Unlock()
+		if p.data["foo"] != "new" {
+			t.Fatalf("Expected the set to be kept over the repair but got %q", p.data["foo"])
+		}
+	})
+}
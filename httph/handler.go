@@ -16,13 +16,14 @@ package httph
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
-
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/netflix/rend-http/config"
@@ -64,19 +65,119 @@ const (
 	evcacheFlagsHeaderName = "X-EVCache-Flags"
 )
 
-func retryDelay(try int) {
+func init() {
+	config.ValidateInt(NumTriesConfigName, config.MinInt(1))
+	config.ValidateInt(RetryDelayMultiplierConfigName, config.MinInt(0))
+}
+
+func (h *Handler) retryDelay(try int) {
 	// wait for 10, 40, and 90 ms successively on retries
 	if try > 0 {
-		mult := config.Get(RetryDelayMultiplierConfigName, DefaultRetryDelayMultiplier)
+		mult := h.retryDelayMultiplier
+		if mult == 0 {
+			mult = h.retryDelayConf.Get()
+		}
 		<-time.After(time.Duration(try) * time.Millisecond * time.Duration(mult))
 	}
 }
 
+func (h *Handler) numTries() int {
+	if h.tries > 0 {
+		return h.tries
+	}
+	return h.numTriesConf.Get()
+}
+
 // Handler implements the github.com/netflix/rend/handlers.Handler interface.
-// The only operations supported right now are set, get, and delete.
+// The only operations supported right now are set, get, delete, and touch if
+// the dialect supports it.
 type Handler struct {
-	urlprefix string
-	client    http.Client
+	primary  *endpoint
+	fallback *endpoint
+	client   http.Client
+	codecs   codecChain
+
+	// cache scopes the dynamic config, see config.GetForCache
+	cache string
+
+	// override the dynamic config when set
+	tries                int
+	retryDelayMultiplier int
+
+	// the dynamic config for the cache, followed for changes
+	numTriesConf, retryDelayConf *config.Int
+
+	// read-repair of values found on the fallback, see FallbackOptions
+	readRepair bool
+	repairTTL  uint32
+	repairs    chan struct{}
+	repairMu   sync.Mutex
+	pending    map[string]*pendingRepair
+
+	// flag bits clients may not use because of the enabled features
+	reserved uint32
+
+	// values larger than this are split across keys, 0 disables chunking
+	chunkSize int
+
+	// the largest value accepted from clients or read back from the backend
+	maxValueSize int
+
+	// queues sets to be stored in the background, nil if off
+	writeBehind *writeBehind
+
+	// gzip Content-Encoding of set bodies, see CompressionOptions
+	contentEncoding bool
+	gzipThreshold   int
+	proxyGzip       int32
+}
+
+// Options holds the optional settings for a Handler. The zero value proxies to
+// the EVCache REST proxy with values passed through untouched.
+type Options struct {
+	// Dialect maps operations onto the backend's REST API. If nil, the EVCache
+	// dialect is used for the cache given to the constructor.
+	Dialect Dialect
+
+	// Compression configures compression of values sent to the backend
+	Compression CompressionOptions
+
+	// Encryption configures encryption of values stored on the backend
+	Encryption EncryptionOptions
+
+	// Checksum configures integrity checks of values stored on the backend
+	Checksum ChecksumOptions
+
+	// Fallback configures a second backend for gets that miss or fail
+	Fallback FallbackOptions
+
+	// WriteBehind configures acknowledging sets before they are stored
+	WriteBehind WriteBehindOptions
+
+	// AdaptiveLimit configures a limit on requests in flight to the backend
+	// that adapts to its latency. It doesn't apply to the fallback.
+	AdaptiveLimit AdaptiveLimitOptions
+
+	// ChunkSize is the largest value, in bytes, stored under a single backend
+	// key. Larger values are split into chunks under separate keys, see
+	// storeChunked. Zero disables chunking.
+	ChunkSize int
+
+	// Timeout bounds each request to the backend, including reading the
+	// response. Zero means no timeout.
+	Timeout time.Duration
+
+	// NumTries and RetryDelayMultiplier override the numTries and
+	// retryDelayMultiplier dynamic config for this handler. Zero means the
+	// dynamic config is used.
+	NumTries             int
+	RetryDelayMultiplier int
+
+	// MaxValueSize is the largest value, in bytes, accepted from clients or
+	// read back from the backend. Larger sets fail with common.ErrValueTooBig,
+	// as do gets of larger values instead of reading them into memory. Zero
+	// means DefaultMaxValueSize.
+	MaxValueSize int
 }
 
 // New creates a new handler constructor function. The returned function returns
@@ -84,102 +185,486 @@ type Handler struct {
 // all requests will be able to take advantage of the http keepalive on the conn
 // pool to the http proxy.
 func New(host string, port int, cache string) handlers.HandlerConst {
+	// The default options are always valid
+	hc, _ := NewWithOptions(host, port, cache, Options{})
+	return hc
+}
+
+// NewWithOptions creates a new handler constructor function like New, but with
+// the given options applied to the singleton. An error is returned if the
+// options are invalid.
+func NewWithOptions(host string, port int, cache string, opts Options) (handlers.HandlerConst, error) {
+	dialect := opts.Dialect
+	if dialect == nil {
+		dialect = NewEVCacheDialect(cache)
+	}
+
 	singleton := &Handler{
-		urlprefix: fmt.Sprintf("http://%s:%d/evcrest/v1.0/%s/", host, port, cache),
-		client:    http.Client{},
+		primary:              &endpoint{baseurl: fmt.Sprintf("http://%s:%d", host, port), dialect: dialect},
+		client:               http.Client{Timeout: opts.Timeout},
+		cache:                cache,
+		tries:                opts.NumTries,
+		retryDelayMultiplier: opts.RetryDelayMultiplier,
+		chunkSize:            opts.ChunkSize,
+		maxValueSize:         opts.MaxValueSize,
+		contentEncoding:      opts.Compression.ContentEncoding,
+		gzipThreshold:        opts.Compression.threshold(),
+	}
+
+	if opts.ChunkSize < 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", opts.ChunkSize)
+	}
+
+	if opts.Timeout < 0 || opts.NumTries < 0 || opts.RetryDelayMultiplier < 0 {
+		return nil, fmt.Errorf("timeout, tries and retry delay multiplier must not be negative")
+	}
+
+	if opts.MaxValueSize < 0 {
+		return nil, fmt.Errorf("invalid max value size %d", opts.MaxValueSize)
+	}
+	if singleton.maxValueSize == 0 {
+		singleton.maxValueSize = DefaultMaxValueSize
+	}
+
+	if opts.Compression.Algorithm != "" {
+		c, err := newCompressor(opts.Compression, singleton.maxValueSize)
+		if err != nil {
+			return nil, err
+		}
+		singleton.codecs = append(singleton.codecs, c)
+	}
+
+	// Encryption has to come after compression since ciphertext won't compress
+	if opts.Encryption.KeyDir != "" {
+		e, err := newEncryptor(opts.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		singleton.codecs = append(singleton.codecs, e)
+	}
+
+	// The checksum goes last so it covers exactly the bytes that are stored
+	if opts.Checksum.Algorithm != "" {
+		c, err := newChecksummer(opts.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		singleton.codecs = append(singleton.codecs, c)
+	}
+
+	if opts.Fallback.Host != "" {
+		singleton.fallback = opts.Fallback.endpoint()
+		singleton.readRepair = opts.Fallback.ReadRepair
+		singleton.repairTTL = opts.Fallback.RepairTTL
+		singleton.repairs = make(chan struct{}, opts.Fallback.maxRepairs())
+		singleton.pending = make(map[string]*pendingRepair)
+	}
+
+	if opts.AdaptiveLimit.Algorithm != "" {
+		l, err := newAdaptiveLimiter(opts.AdaptiveLimit, singleton.primary.baseurl)
+		if err != nil {
+			return nil, err
+		}
+		singleton.primary.limiter = l
+	}
+
+	if len(singleton.codecs) > 0 || singleton.chunkSize > 0 {
+		singleton.reserved = ReservedFlags
+	}
+
+	singleton.numTriesConf = config.WatchIntForCache(cache, NumTriesConfigName, DefaultNumTries)
+	singleton.retryDelayConf = config.WatchIntForCache(cache, RetryDelayMultiplierConfigName, DefaultRetryDelayMultiplier)
+
+	// Started last since spilled sets are replayed right away
+	if opts.WriteBehind.QueueSize > 0 {
+		wb, err := newWriteBehind(singleton, opts.WriteBehind)
+		if err != nil {
+			singleton.Shutdown()
+			return nil, err
+		}
+		singleton.writeBehind = wb
 	}
 
 	return func() (handlers.Handler, error) {
 		return singleton, nil
-	}
+	}, nil
 }
 
-func (h *Handler) makeURL(key []byte) string {
-	return h.urlprefix + string(key) + "?raw=true"
+// Values of Handler.proxyGzip
+const (
+	proxyGzipUnknown int32 = iota
+	proxyGzipAccepted
+	proxyGzipRejected
+)
+
+// gzipBody returns the gzip encoded body for a set if the proxy is known to
+// accept it and encoding is worthwhile, otherwise nil
+func (h *Handler) gzipBody(body []byte) []byte {
+	if !h.contentEncoding || len(body) < h.gzipThreshold || atomic.LoadInt32(&h.proxyGzip) != proxyGzipAccepted {
+		return nil
+	}
+
+	encoded, err := gzipBytes(body)
+	if err != nil || len(encoded) >= len(body) {
+		return nil
+	}
+
+	metrics.IncCounter(MetricCmdSetContentEncoded)
+	metrics.IncCounterBy(MetricCmdSetContentEncodingBytesSaved, uint64(len(body)-len(encoded)))
+	return encoded
 }
 
-// Set performs an HTTP PUT request on the backend server
-func (h *Handler) Set(cmd common.SetRequest) error {
-	url := h.makeURL(cmd.Key) + "?raw=true&ttl=" + strconv.Itoa(int(cmd.Exptime)) + "&flag=" + strconv.Itoa(int(cmd.Flags))
+// endpoint is a REST proxy and the dialect used to talk to it
+type endpoint struct {
+	baseurl string
+	dialect Dialect
 
-	req, err := http.NewRequest("PUT", url, nil)
-	if err != nil {
-		return err
+	// limits the requests in flight, nil if there is no limit
+	limiter *adaptiveLimiter
+}
+
+// do performs an operation against a backend, retrying as the dialect
+// directs. If the dialect reports success or a miss, the response is returned
+// with the body still open for the caller to read and close. Otherwise the
+// body is drained and closed and an error is returned.
+func (h *Handler) do(ep *endpoint, op Op, key []byte, flags, ttl uint32, body []byte) (*http.Response, Status, error) {
+	var encoded []byte
+	if op == OpSet {
+		encoded = h.gzipBody(body)
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
 
-	tries := config.Get(NumTriesConfigName, DefaultNumTries)
+	tries := h.numTries()
 	for i := 0; i < tries; i++ {
-		retryDelay(i)
+		h.retryDelay(i)
+
+		req, err := ep.dialect.Request(op, ep.baseurl, key, flags, ttl)
+		if err != nil {
+			// this would be a bad host, port, or cache
+			return nil, StatusFail, err
+		}
 
-		// Reset body
-		req.Body = ioutil.NopCloser(bytes.NewReader(cmd.Data))
+		if op == OpSet {
+			// Reset body
+			req.Body = http.NoBody
+			if encoded != nil {
+				req.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+				req.ContentLength = int64(len(encoded))
+				req.Header.Set("Content-Encoding", "gzip")
+			} else if len(body) > 0 {
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+				req.ContentLength = int64(len(body))
+			}
+		}
 
-		res, err := h.client.Do(req)
+		res, err := h.send(ep, req)
 		if err != nil {
-			return err
+			return nil, StatusFail, err
 		}
 
-		// discard and close body to allow reuse of connection
-		if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
-			return err
+		if h.contentEncoding && acceptsGzip(res) {
+			atomic.CompareAndSwapInt32(&h.proxyGzip, proxyGzipUnknown, proxyGzipAccepted)
+		}
+
+		// The proxy doesn't understand the encoding after all, so stop using it
+		// and send again without it. This doesn't count as a try.
+		if encoded != nil && res.StatusCode == 415 {
+			discard(res)
+			metrics.IncCounter(MetricCmdSetContentEncodingUnsupported)
+			atomic.StoreInt32(&h.proxyGzip, proxyGzipRejected)
+			encoded = nil
+			i--
+			continue
 		}
-		res.Body.Close()
 
-		if res.StatusCode >= 200 && res.StatusCode < 300 {
-			return nil
+		status := ep.dialect.Status(op, res.StatusCode)
+		if status == StatusSuccess || status == StatusMiss {
+			return res, status, nil
+		}
+
+		// discard and close body to allow reuse of connection
+		if err := discard(res); err != nil {
+			return nil, StatusFail, err
 		}
 
-		// Shortcut on errors that are going to fail on subsequent tries
-		if res.StatusCode == 400 || res.StatusCode == 500 {
-			return common.ErrInternal
+		if status == StatusFail {
+			return nil, status, common.ErrInternal
 		}
 
-		log.Printf("[SET] Unexpected status code in HTTP response: %d\n", res.StatusCode)
-		log.Printf("[SET] url: %s\n", url)
+		log.Printf("[%s] Unexpected status code in HTTP response: %d\n", op, res.StatusCode)
+		log.Printf("[%s] url: %s\n", op, req.URL)
 	}
 
-	return common.ErrInternal
+	return nil, StatusFail, common.ErrInternal
 }
 
-// Delete performs an HTTP DELETE request on the backend server
-func (h *Handler) Delete(cmd common.DeleteRequest) error {
-	url := h.makeURL(cmd.Key)
-	req, err := http.NewRequest("DELETE", url, nil)
+// send sends a request to an endpoint if its limit allows. Requests over the
+// limit fail right away.
+func (h *Handler) send(ep *endpoint, req *http.Request) (*http.Response, error) {
+	if ep.limiter == nil {
+		return h.client.Do(req)
+	}
+
+	if !ep.limiter.acquire() {
+		metrics.IncCounter(MetricHTTPRequestsLimited)
+		return nil, common.ErrInternal
+	}
+
+	start := time.Now()
+	res, err := h.client.Do(req)
+	ep.limiter.release(time.Since(start), err != nil || res.StatusCode >= 500)
+
+	return res, err
+}
+
+// discard drains and closes the body of a response to allow reuse of the
+// connection
+func discard(res *http.Response) error {
+	_, err := io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return err
+}
+
+// store writes a value to a single backend key
+func (h *Handler) store(key, data []byte, flags, ttl uint32) error {
+	res, _, err := h.do(h.primary, OpSet, key, flags, ttl, data)
 	if err != nil {
-		// this would be a bad host, port, or cache
 		return err
 	}
 
-	tries := config.Get(NumTriesConfigName, DefaultNumTries)
-	for i := 0; i < tries; i++ {
-		retryDelay(i)
+	return discard(res)
+}
 
-		res, err := h.client.Do(req)
-		if err != nil {
+// maxStoredSize is the largest value read back from a single backend key,
+// which leaves room for what the codecs add to a value
+func (h *Handler) maxStoredSize() int {
+	if len(h.codecs) > 0 {
+		return h.maxValueSize + maxEncodingOverhead
+	}
+	return h.maxValueSize
+}
+
+// fetchResponse performs a get on a single backend key. On a hit the response
+// is returned with the body open for the caller to read and close. A miss is
+// reported by found being false with a nil error.
+func (h *Handler) fetchResponse(ep *endpoint, key []byte) (res *http.Response, flags uint32, found bool, err error) {
+	res, status, err := h.do(ep, OpGet, key, 0, 0, nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if status == StatusMiss {
+		return nil, 0, false, discard(res)
+	}
+
+	flags, err = ep.dialect.Flags(res)
+	if err != nil {
+		discard(res)
+		log.Printf("Received unparseable flags from REST proxy: %v", err)
+		return nil, 0, false, common.ErrInternal
+	}
+
+	return res, flags, true, nil
+}
+
+// fetch reads a value from a single backend key. A miss is reported by found
+// being false with a nil error.
+func (h *Handler) fetch(ep *endpoint, key []byte) (data []byte, flags uint32, found bool, err error) {
+	res, flags, found, err := h.fetchResponse(ep, key)
+	if err != nil || !found {
+		return nil, 0, found, err
+	}
+
+	data, err = readBody(res.Body, res.ContentLength, h.maxStoredSize())
+
+	// Close body to allow reuse of connection. An oversize body is left unread,
+	// which costs the connection but not the memory.
+	res.Body.Close()
+
+	if err == errValueTooLarge {
+		log.Printf("[GET] Value for key %q is larger than the max value size of %d bytes\n", key, h.maxValueSize)
+		metrics.IncCounter(MetricCmdGetValueTooLarge)
+		return nil, 0, false, err
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return data, flags, true, nil
+}
+
+// fetchStored reads a value as it is stored, reassembling it if it is chunked
+// but without decoding it
+func (h *Handler) fetchStored(ep *endpoint, key []byte) ([]byte, uint32, bool, error) {
+	data, flags, found, err := h.fetch(ep, key)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+
+	if flags&flagChunked != 0 && h.chunkSize > 0 {
+		return h.fetchChunked(ep, key, data, flags)
+	}
+
+	return data, flags, true, nil
+}
+
+// remove deletes a single backend key, reporting whether it existed
+func (h *Handler) remove(key []byte) (bool, error) {
+	res, status, err := h.do(h.primary, OpDelete, key, 0, 0, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := discard(res); err != nil {
+		return false, err
+	}
+
+	return status != StatusMiss, nil
+}
+
+// touch updates the TTL of a single backend key, reporting whether it existed
+func (h *Handler) touch(key []byte, ttl uint32) (bool, error) {
+	res, status, err := h.do(h.primary, OpTouch, key, 0, ttl, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := discard(res); err != nil {
+		return false, err
+	}
+
+	return status != StatusMiss, nil
+}
+
+// Set performs an HTTP request on the backend server to store the item. With
+// write-behind on, the item is queued and stored in the background instead.
+func (h *Handler) Set(cmd common.SetRequest) error {
+	if cmd.Flags&h.reserved != 0 {
+		return common.ErrInvalidArgs
+	}
+
+	if len(cmd.Data) > h.maxValueSize {
+		metrics.IncCounter(MetricCmdSetValueTooLarge)
+		return common.ErrValueTooBig
+	}
+
+	h.supersedeRepair(cmd.Key)
+
+	if h.writeBehind != nil && h.writeBehind.enqueue(cmd) {
+		return nil
+	}
+
+	return h.set(cmd)
+}
+
+// set encodes and stores an item that has already been validated
+func (h *Handler) set(cmd common.SetRequest) error {
+	cmd, err := h.encode(cmd)
+	if err != nil {
+		return err
+	}
+	return h.storeEncoded(cmd)
+}
+
+// encode runs the value of a set through the codecs
+func (h *Handler) encode(cmd common.SetRequest) (common.SetRequest, error) {
+	if len(h.codecs) == 0 {
+		return cmd, nil
+	}
+
+	data, flags, err := h.codecs.encode(cmd.Key, cmd.Data, cmd.Flags)
+	if err != nil {
+		log.Printf("[SET] Failed to encode value: %v\n", err)
+		return cmd, common.ErrInternal
+	}
+	cmd.Data, cmd.Flags = data, flags
+	return cmd, nil
+}
+
+// storeEncoded stores a set whose value has been through the codecs
+func (h *Handler) storeEncoded(cmd common.SetRequest) error {
+	if h.chunkSize > 0 && len(cmd.Data) > h.chunkSize {
+		return h.storeChunked(cmd.Key, cmd.Data, cmd.Flags, cmd.Exptime)
+	}
+
+	return h.store(cmd.Key, cmd.Data, cmd.Flags, cmd.Exptime)
+}
+
+// Delete performs an HTTP request on the backend server to remove the item.
+// With write-behind on, it waits for the sets of the key queued before it.
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	h.supersedeRepair(cmd.Key)
+
+	if h.writeBehind != nil {
+		if queued, err := h.writeBehind.run(cmd.Key, true, func() error { return h.delete(cmd) }); queued {
 			return err
 		}
+	}
+	return h.delete(cmd)
+}
 
-		// discard and close body to allow reuse of connection
-		if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+func (h *Handler) delete(cmd common.DeleteRequest) error {
+	var m *manifest
+	if h.chunkSize > 0 {
+		var err error
+		if m, err = h.fetchManifest(cmd.Key); err != nil {
 			return err
 		}
-		res.Body.Close()
+	}
 
-		if res.StatusCode >= 200 && res.StatusCode < 300 {
-			return nil
-		}
+	found, err := h.remove(cmd.Key)
+	if err != nil {
+		return err
+	}
+
+	// The manifest goes first so a concurrent get can't see missing chunks
+	if m != nil {
+		h.removeChunks(cmd.Key, m)
+	}
+
+	if !found {
+		return common.ErrKeyNotFound
+	}
+
+	return nil
+}
 
-		// Shortcut on failures where subsequent requests will fail
-		if res.StatusCode == 500 {
-			return common.ErrInternal
+// Touch performs an HTTP request on the backend server to update the TTL of an
+// item. If the dialect does not support touch, common.ErrUnknownCmd is returned.
+// With write-behind on, it waits for the sets of the key queued before it.
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	if h.writeBehind != nil {
+		if queued, err := h.writeBehind.run(cmd.Key, false, func() error { return h.touchItem(cmd) }); queued {
+			return err
 		}
+	}
+	return h.touchItem(cmd)
+}
+
+func (h *Handler) touchItem(cmd common.TouchRequest) error {
+	found, err := h.touch(cmd.Key, cmd.Exptime)
+	if err == ErrUnsupportedOp {
+		return common.ErrUnknownCmd
+	}
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return common.ErrKeyNotFound
+	}
 
-		log.Printf("[DELETE] Unexpected status code in HTTP response: %d\n", res.StatusCode)
-		log.Printf("[DELETE] url: %s\n", url)
+	// The chunks need to live as long as their manifest
+	if h.chunkSize > 0 {
+		m, err := h.fetchManifest(cmd.Key)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			return h.touchChunks(cmd.Key, m, cmd.Exptime)
+		}
 	}
 
-	return common.ErrInternal
+	return nil
 }
 
 // Get performs an HTTP GET request on the backend server for each key given
@@ -194,79 +679,56 @@ func realHandleGet(h *Handler, cmd common.GetRequest, dataOut chan common.GetRes
 	defer close(errorOut)
 	defer close(dataOut)
 
-outer:
 	for idx, key := range cmd.Keys {
-		url := h.makeURL(key)
-		req, err := http.NewRequest("GET", url, nil)
+		data, flags, found, err := h.fetchStored(h.primary, key)
+		if h.fallback != nil && err != errValueTooLarge && (err != nil || !found) {
+			data, flags, found, err = h.fetchFallback(key, err)
+		}
+		if err == errValueTooLarge {
+			errorOut <- common.ErrValueTooBig
+			return
+		}
 		if err != nil {
 			errorOut <- err
 			return
 		}
 
-		tries := config.Get(NumTriesConfigName, DefaultNumTries)
-		for i := 0; i < tries; i++ {
-			retryDelay(i)
-
-			res, err := h.client.Do(req)
-			if err != nil {
-				errorOut <- err
+		if found && len(h.codecs) > 0 {
+			data, flags, err = h.codecs.decode(key, data, flags)
+			if err == errDecodeMiss {
+				found = false
+			} else if err == errValueTooLarge {
+				log.Printf("[GET] Value for key %q decodes to more than the max value size of %d bytes\n", key, h.maxValueSize)
+				metrics.IncCounter(MetricCmdGetValueTooLarge)
+				errorOut <- common.ErrValueTooBig
 				return
-			}
-
-			var flags uint32
-			if s := res.Header.Get(evcacheFlagsHeaderName); s != "" {
-				flags64, err := strconv.ParseInt(s, 10, 32)
-
-				if err != nil {
-					log.Printf("Received unparseable flags from REST proxy: %v", s)
-					errorOut <- common.ErrInternal
-				}
-
-				flags = uint32(flags64)
-			}
-
-			data, err := ioutil.ReadAll(res.Body)
-
-			// Close body to allow reuse of connection
-			res.Body.Close()
-
-			switch res.StatusCode {
-			case 200:
-				dataOut <- common.GetResponse{
-					Miss:   false,
-					Quiet:  cmd.Quiet[idx],
-					Opaque: cmd.Opaques[idx],
-					Flags:  flags,
-					Key:    key,
-					Data:   data,
-				}
-
-				continue outer
-
-			case 404:
-				dataOut <- common.GetResponse{
-					Miss:   true,
-					Quiet:  cmd.Quiet[idx],
-					Opaque: cmd.Opaques[idx],
-					Flags:  0,
-					Key:    key,
-				}
-
-				continue outer
-
-			case 500:
-				// Don't retry for a request that will very likely fail
+			} else if err != nil {
+				log.Printf("[GET] Failed to decode value for key %q: %v\n", key, err)
 				errorOut <- common.ErrInternal
 				return
+			}
+		}
 
-			default:
-				log.Printf("[GET] Unexpected status code in HTTP response: %d\n", res.StatusCode)
-				log.Printf("[GET] url: %s\n", url)
+		if !found {
+			dataOut <- common.GetResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Flags:  0,
+				Key:    key,
 			}
+
+			continue
 		}
 
-		errorOut <- common.ErrInternal
-		return
+		dataOut <- common.GetResponse{
+			Miss:   false,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  flags,
+			Key:    key,
+			Data:   data,
+		}
 	}
 }
 
@@ -276,6 +738,48 @@ func (h *Handler) Close() error {
 	return nil
 }
 
+// CloseIdleConnections closes the connections to the proxies that aren't in
+// use, for shutting down. New ones are made as needed.
+func (h *Handler) CloseIdleConnections() {
+	h.client.CloseIdleConnections()
+}
+
+// Shutdown stops following the dynamic config and closes idle connections,
+// for retiring the singleton. Requests made afterwards keep the last settings.
+func (h *Handler) Shutdown() {
+	h.numTriesConf.Stop()
+	h.retryDelayConf.Stop()
+	h.CloseIdleConnections()
+}
+
+// ProbeKey is the key read by Probe, which isn't expected to exist
+const ProbeKey = "__rend_http_probe__"
+
+// Probe checks the REST proxy is answering with a single get of ProbeKey,
+// without retries, the adaptive limit or the fallback. A hit and a miss both
+// mean it is up.
+func (h *Handler) Probe(timeout time.Duration) error {
+	req, err := h.primary.dialect.Request(OpGet, h.primary.baseurl, []byte(ProbeKey), 0, 0)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	res, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	discard(res)
+
+	switch h.primary.dialect.Status(OpGet, res.StatusCode) {
+	case StatusSuccess, StatusMiss:
+		return nil
+	}
+	return fmt.Errorf("unexpected status code %d", res.StatusCode)
+}
+
 /////////////////////////////////////
 // All the rest just return an error
 /////////////////////////////////////
@@ -311,8 +815,3 @@ func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-cha
 func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	return common.GetResponse{}, common.ErrUnknownCmd
 }
-
-// Touch is not implemented and returns common.ErrUnknownCmd
-func (h *Handler) Touch(cmd common.TouchRequest) error {
-	return common.ErrUnknownCmd
-}
@@ -21,7 +21,9 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/netflix/rend-http/httph"
 	"github.com/netflix/rend/common"
@@ -29,7 +31,9 @@ import (
 )
 
 type server struct {
+	sync.Mutex
 	data      map[string]string
+	flags     map[string]string
 	forcecode int
 	failtimes int
 	numReqs   int
@@ -38,12 +42,16 @@ type server struct {
 func newServer(forcecode, failtimes int) *server {
 	return &server{
 		data:      make(map[string]string),
+		flags:     make(map[string]string),
 		forcecode: forcecode,
 		failtimes: failtimes,
 	}
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
 	s.numReqs++
 
 	key := strings.TrimPrefix(req.URL.Path, "/evcrest/v1.0/evcache/")
@@ -64,6 +72,9 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	case "GET":
 		if data, ok := s.data[key]; ok {
 			w.Header().Set("Content-Type", "application/octet-stream")
+			if flags, ok := s.flags[key]; ok {
+				w.Header().Set("X-EVCache-Flags", flags)
+			}
 			w.Write([]byte(data))
 		} else {
 			w.WriteHeader(404)
@@ -87,6 +98,7 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(500)
 		}
 		s.data[key] = string(data)
+		s.flags[key] = req.URL.Query().Get("flag")
 		w.WriteHeader(200)
 
 	case "DELETE":
@@ -96,6 +108,10 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func handlerFromTestServer(ts *httptest.Server) handlers.Handler {
+	return handlerWithOptions(ts, httph.Options{})
+}
+
+func handlerWithOptions(ts *httptest.Server, opts httph.Options) handlers.Handler {
 	hostAndPort := strings.TrimPrefix(ts.URL, "http://")
 	parts := strings.Split(hostAndPort, ":")
 
@@ -105,7 +121,12 @@ func handlerFromTestServer(ts *httptest.Server) handlers.Handler {
 		panic(err)
 	}
 
-	handler, err := httph.New(host, port, "evcache")()
+	hc, err := httph.NewWithOptions(host, port, "evcache", opts)
+	if err != nil {
+		panic(fmt.Sprintf("Handler creation failed: %s", err.Error()))
+	}
+
+	handler, err := hc()
 	if err != nil {
 		panic(fmt.Sprintf("Handler creation failed: %s", err.Error()))
 	}
@@ -113,6 +134,22 @@ func handlerFromTestServer(ts *httptest.Server) handlers.Handler {
 	return handler
 }
 
+// getOne performs a get of a single key and returns the response or error
+func getOne(handler handlers.Handler, key string) (common.GetResponse, error) {
+	datchan, errchan := handler.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	select {
+	case res := <-datchan:
+		return res, nil
+	case err := <-errchan:
+		return common.GetResponse{}, err
+	}
+}
+
 func TestGet(t *testing.T) {
 	t.Run("Hit", func(t *testing.T) {
 		s := newServer(0, 0)
@@ -514,3 +551,234 @@ func TestDelete(t *testing.T) {
 		})
 	})
 }
+
+func TestMaxValueSize(t *testing.T) {
+	t.Run("SetTooLarge", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{MaxValueSize: 4})
+
+		err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("toolong")})
+		if err != common.ErrValueTooBig {
+			t.Fatalf("Expected ErrValueTooBig but got %v", err)
+		}
+
+		if s.numReqs != 0 {
+			t.Fatalf("Expected no requests to the backend but got %d", s.numReqs)
+		}
+	})
+
+	t.Run("GetTooLarge", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{MaxValueSize: 4})
+
+		s.data["foo"] = "toolong"
+
+		if _, err := getOne(handler, "foo"); err != common.ErrValueTooBig {
+			t.Fatalf("Expected ErrValueTooBig but got %v", err)
+		}
+	})
+
+	t.Run("GetUnknownLengthTooLarge", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{MaxValueSize: 1024})
+
+		// Large enough that the server sends it without a Content-Length
+		s.data["foo"] = strings.Repeat("a", 64*1024)
+
+		if _, err := getOne(handler, "foo"); err != common.ErrValueTooBig {
+			t.Fatalf("Expected ErrValueTooBig but got %v", err)
+		}
+	})
+
+	t.Run("ChunkedTooLarge", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		writer := handlerWithOptions(ts, httph.Options{ChunkSize: 16})
+		reader := handlerWithOptions(ts, httph.Options{ChunkSize: 16, MaxValueSize: 32})
+
+		if err := writer.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(chunkedValue)}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		if _, err := getOne(reader, "foo"); err != common.ErrValueTooBig {
+			t.Fatalf("Expected ErrValueTooBig but got %v", err)
+		}
+	})
+
+	t.Run("DecompressedTooLarge", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		for _, algo := range []string{"gzip", "zstd", "snappy"} {
+			writer := handlerWithOptions(ts, httph.Options{
+				Compression: httph.CompressionOptions{Algorithm: algo, Threshold: 1},
+			})
+			reader := handlerWithOptions(ts, httph.Options{
+				Compression:  httph.CompressionOptions{Algorithm: algo, Threshold: 1},
+				MaxValueSize: 1024,
+			})
+
+			value := strings.Repeat("a", 64*1024)
+			if err := writer.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(value)}); err != nil {
+				t.Fatalf("Failed set request: %s", err.Error())
+			}
+
+			if _, err := getOne(reader, "foo"); err != common.ErrValueTooBig {
+				t.Fatalf("Expected ErrValueTooBig for %s but got %v", algo, err)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		if _, err := httph.NewWithOptions("localhost", 1234, "evcache", httph.Options{MaxValueSize: -1}); err == nil {
+			t.Fatalf("Expected an error for a negative max value size")
+		}
+	})
+}
+
+func TestRetryOptions(t *testing.T) {
+	t.Run("NumTries", func(t *testing.T) {
+		s := newServer(0, httph.DefaultNumTries)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		handler := handlerWithOptions(ts, httph.Options{NumTries: httph.DefaultNumTries + 1, RetryDelayMultiplier: 1})
+
+		// Would fail with the default number of tries
+		if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+		if s.numReqs != httph.DefaultNumTries+1 {
+			t.Fatalf("Expected number of requests to be %d but got %d", httph.DefaultNumTries+1, s.numReqs)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		block := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}))
+		defer ts.Close()
+		defer close(block)
+
+		handler := handlerWithOptions(ts, httph.Options{Timeout: 10 * time.Millisecond, NumTries: 1})
+		if err := handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err == nil {
+			t.Fatalf("Expected the set to time out")
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, opts := range []httph.Options{{Timeout: -1}, {NumTries: -1}, {RetryDelayMultiplier: -1}} {
+			if _, err := httph.NewWithOptions("localhost", 1234, "evcache", opts); err == nil {
+				t.Fatalf("Expected an error for %#v", opts)
+			}
+		}
+	})
+}
+
+func TestCacheScopedConfig(t *testing.T) {
+	config := httptest.NewServer(http.DefaultServeMux)
+	defer config.Close()
+
+	put := func(key, value string) int {
+		req, _ := http.NewRequest("PUT", config.URL+"/config/"+key, strings.NewReader(value))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to set config %s: %v", key, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := put("cache/scoped/numTries", "1"); code != 200 {
+		t.Fatalf("Failed to set the scoped config: %d", code)
+	}
+	if code := put("cache/scoped/numTries", "0"); code != 400 {
+		t.Fatalf("Expected the numTries validation to apply to the scoped key but got %d", code)
+	}
+	defer put("cache/scoped/numTries", strconv.Itoa(httph.DefaultNumTries))
+
+	for _, test := range []struct {
+		cache string
+		tries int
+	}{
+		{"scoped", 1},
+		{"unscoped", httph.DefaultNumTries},
+	} {
+		s := newServer(0, httph.DefaultNumTries)
+		ts := httptest.NewServer(s)
+
+		parts := strings.Split(strings.TrimPrefix(ts.URL, "http://"), ":")
+		port, _ := strconv.Atoi(parts[1])
+		hc, err := httph.NewWithOptions(parts[0], port, test.cache, httph.Options{RetryDelayMultiplier: 1})
+		if err != nil {
+			t.Fatalf("Handler creation failed: %v", err)
+		}
+		handler, _ := hc()
+
+		handler.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+		ts.Close()
+
+		if s.numReqs != test.tries {
+			t.Fatalf("Expected %d requests for cache %s but got %d", test.tries, test.cache, s.numReqs)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		status  int
+		healthy bool
+	}{
+		{200, true},
+		{404, true},
+		{500, false},
+		{503, false},
+	}
+
+	for _, test := range tests {
+		var paths []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			w.WriteHeader(test.status)
+		}))
+
+		handler := handlerWithOptions(ts, httph.Options{}).(*httph.Handler)
+		err := handler.Probe(time.Second)
+		ts.Close()
+
+		if (err == nil) != test.healthy {
+			t.Fatalf("Expected healthy %v for status %d but got error %v", test.healthy, test.status, err)
+		}
+		// Probes aren't retried
+		if len(paths) != 1 || paths[0] != "/evcrest/v1.0/evcache/"+httph.ProbeKey {
+			t.Fatalf("Expected a single get of the probe key but got %v", paths)
+		}
+	}
+
+	t.Run("Timeout", func(t *testing.T) {
+		block := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}))
+		defer ts.Close()
+		defer close(block)
+
+		handler := handlerWithOptions(ts, httph.Options{}).(*httph.Handler)
+		if err := handler.Probe(10 * time.Millisecond); err == nil {
+			t.Fatalf("Expected the probe to time out")
+		}
+	})
+}
@@ -0,0 +1,420 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// Spilled sets are stored as a sequence of records of:
+//
+//	checksum    uint32, the CRC-32C of the rest of the record
+//	key len     uint32, with spillEncoded set if the data went through the
+//	            codecs
+//	data len    uint32, or spillMarker
+//	flags       uint32
+//	exptime     uint32
+//	key         key len bytes
+//	data        data len bytes
+//
+// A record cut short by a crash ends the replay. A marker record has no data
+// and means the key was written after the sets of it before the marker, so
+// they are not replayed. Sets are spilled encoded, so values that are
+// encrypted on the backend are encrypted on disk too.
+const spillHeaderLen = 20
+
+const (
+	spillMarker  = ^uint32(0)
+	spillEncoded = uint32(1) << 31
+)
+
+// Exptimes up to 30 days are relative, like memcached's. They are spilled as
+// absolute times so a replay doesn't extend them.
+const maxRelativeExptime = 30 * 24 * 60 * 60
+
+var errBadSpillRecord = errors.New("bad spill record")
+
+// spillFile is a spill file and what is known about the sets in it. Handlers
+// with the same spill file share it, which happens while a reload replaces one
+// with another; the sets are replayed by the newest once the others are
+// drained.
+type spillFile struct {
+	path string
+
+	// guarded by spills
+	owners []*writeBehind
+
+	mu sync.Mutex
+	f  *os.File
+
+	// spilled are the keys with sets in the file since their last marker, and
+	// pending the keys with sets in the replay not yet stored
+	spilled   map[string]bool
+	pending   map[string]bool
+	replaying bool
+
+	// tracked is 1 while either map has keys, so writes of other keys don't
+	// need the lock
+	tracked int32
+}
+
+var spills = struct {
+	sync.Mutex
+	open map[string]*spillFile
+}{open: make(map[string]*spillFile)}
+
+// acquireSpill returns the spill file at path for w, reporting whether w is
+// its only owner and should replay it
+func acquireSpill(path string, w *writeBehind) (*spillFile, bool) {
+	spills.Lock()
+	defer spills.Unlock()
+
+	sf := spills.open[path]
+	if sf == nil {
+		sf = &spillFile{
+			path:    path,
+			spilled: make(map[string]bool),
+			pending: make(map[string]bool),
+		}
+		spills.open[path] = sf
+	}
+	sf.owners = append(sf.owners, w)
+	return sf, len(sf.owners) == 1
+}
+
+// release removes w from the owners of the file, closing it if it was the
+// last. Otherwise it returns the newest owner left, which takes over the sets
+// spilled so far.
+func (sf *spillFile) release(w *writeBehind) *writeBehind {
+	spills.Lock()
+	defer spills.Unlock()
+
+	for i, o := range sf.owners {
+		if o == w {
+			sf.owners = append(sf.owners[:i], sf.owners[i+1:]...)
+			break
+		}
+	}
+
+	if len(sf.owners) > 0 {
+		return sf.owners[len(sf.owners)-1]
+	}
+
+	if spills.open[sf.path] == sf {
+		delete(spills.open, sf.path)
+	}
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.f != nil {
+		sf.f.Close()
+		sf.f = nil
+	}
+	return nil
+}
+
+func (sf *spillFile) updateTracked() {
+	var t int32
+	if len(sf.spilled) > 0 || len(sf.pending) > 0 {
+		t = 1
+	}
+	atomic.StoreInt32(&sf.tracked, t)
+}
+
+// supersede records that key was written, so sets of it spilled before aren't
+// replayed. It must be called before the write is queued or stored.
+func (sf *spillFile) supersede(key []byte) {
+	if atomic.LoadInt32(&sf.tracked) == 0 {
+		return
+	}
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	k := string(key)
+	if !sf.spilled[k] && !sf.pending[k] {
+		return
+	}
+
+	// The marker makes it stick across a restart
+	if err := sf.append(common.SetRequest{Key: key}, true, false); err != nil {
+		log.Printf("[SET] Failed to mark key %q as written in spill file: %v\n", key, err)
+	}
+	delete(sf.spilled, k)
+	delete(sf.pending, k)
+	sf.updateTracked()
+}
+
+// write appends a set to the file. encoded is whether its value has been
+// through the codecs.
+func (sf *spillFile) write(cmd common.SetRequest, encoded bool) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if err := sf.append(cmd, false, encoded); err != nil {
+		return err
+	}
+	sf.spilled[string(cmd.Key)] = true
+	sf.updateTracked()
+	return nil
+}
+
+// append writes a record. It must be called with mu held.
+func (sf *spillFile) append(cmd common.SetRequest, marker, encoded bool) error {
+	if sf.f == nil {
+		f, err := os.OpenFile(sf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		sf.f = f
+	}
+
+	// One write per record so a crash can only cut off the last one
+	_, err := sf.f.Write(spillRecord(cmd, marker, encoded))
+	return err
+}
+
+// spillRecord encodes a record
+func spillRecord(cmd common.SetRequest, marker, encoded bool) []byte {
+	dataLen := uint32(len(cmd.Data))
+	if marker {
+		cmd.Data = nil
+		dataLen = spillMarker
+	}
+	if cmd.Exptime > 0 && cmd.Exptime <= maxRelativeExptime {
+		cmd.Exptime += uint32(time.Now().Unix())
+	}
+
+	keyLen := uint32(len(cmd.Key))
+	if encoded {
+		keyLen |= spillEncoded
+	}
+
+	buf := make([]byte, spillHeaderLen+len(cmd.Key)+len(cmd.Data))
+	binary.BigEndian.PutUint32(buf[4:], keyLen)
+	binary.BigEndian.PutUint32(buf[8:], dataLen)
+	binary.BigEndian.PutUint32(buf[12:], cmd.Flags)
+	binary.BigEndian.PutUint32(buf[16:], cmd.Exptime)
+	copy(buf[spillHeaderLen:], cmd.Key)
+	copy(buf[spillHeaderLen+len(cmd.Key):], cmd.Data)
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(buf[4:], castagnoli))
+	return buf
+}
+
+// isPending is whether a replayed set of key is still the newest
+func (sf *spillFile) isPending(key []byte) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.pending[string(key)]
+}
+
+// take moves the sets spilled so far out of the way of new spills to be
+// replayed, returning "" if there are none or another owner is replaying.
+// skip holds, for each key with a marker, the index of the record of its last
+// marker; earlier sets of the key are not replayed.
+func (sf *spillFile) take() (path string, skip map[string]int, err error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if sf.replaying {
+		return "", nil, nil
+	}
+
+	if sf.f != nil {
+		sf.f.Close()
+		sf.f = nil
+	}
+
+	if path, err = takeSpill(sf.path); err != nil || path == "" {
+		return "", nil, err
+	}
+
+	// Find the sets to replay before anything else is written, so writes from
+	// now on supersede them
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	skip = make(map[string]int)
+	last := make(map[string]int)
+	r := bufio.NewReader(f)
+	for i := 0; ; i++ {
+		cmd, marker, _, err := readSpill(r)
+		if err != nil {
+			break
+		}
+		if marker {
+			skip[string(cmd.Key)] = i
+		} else {
+			last[string(cmd.Key)] = i
+		}
+	}
+
+	sf.pending = make(map[string]bool)
+	for k, i := range last {
+		if m, ok := skip[k]; !ok || i > m {
+			sf.pending[k] = true
+		}
+	}
+	sf.spilled = make(map[string]bool)
+	sf.replaying = true
+	sf.updateTracked()
+
+	return path, skip, nil
+}
+
+// finish ends a replay
+func (sf *spillFile) finish() {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	sf.pending = make(map[string]bool)
+	sf.replaying = false
+	sf.updateTracked()
+}
+
+func readSpill(r io.Reader) (cmd common.SetRequest, marker, encoded bool, err error) {
+	var header [spillHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return common.SetRequest{}, false, false, err
+	}
+
+	keyLen := binary.BigEndian.Uint32(header[4:])
+	if keyLen&spillEncoded != 0 {
+		encoded = true
+		keyLen &^= spillEncoded
+	}
+	dataLen := binary.BigEndian.Uint32(header[8:])
+	if dataLen == spillMarker {
+		marker = true
+		dataLen = 0
+	}
+	if keyLen > 64*1024 || dataLen > 1<<31 {
+		return common.SetRequest{}, false, false, errBadSpillRecord
+	}
+
+	body := make([]byte, int(keyLen)+int(dataLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return common.SetRequest{}, false, false, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[4:], castagnoli), castagnoli, body)
+	if crc != binary.BigEndian.Uint32(header[:]) {
+		return common.SetRequest{}, false, false, errBadSpillRecord
+	}
+
+	return common.SetRequest{
+		Key:     body[:keyLen],
+		Data:    body[keyLen:],
+		Flags:   binary.BigEndian.Uint32(header[12:]),
+		Exptime: binary.BigEndian.Uint32(header[16:]),
+	}, marker, encoded, nil
+}
+
+// takeSpill moves the spill file at spillPath out of the way of new spills,
+// returning the path of the sets to replay or "" if there are none. A replay
+// cut short by a crash is picked up again along with anything spilled after
+// it, once any record cut short at its end is removed.
+func takeSpill(spillPath string) (string, error) {
+	replay := spillPath + ".replay"
+
+	if _, err := os.Stat(replay); os.IsNotExist(err) {
+		if err := os.Rename(spillPath, replay); os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		return replay, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	// Both exist, so append the newer spills to the unfinished replay
+	src, err := os.Open(spillPath)
+	if os.IsNotExist(err) {
+		return replay, nil
+	} else if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	// The replay stops at a torn record, which would hide the ones after it
+	n, err := completeLen(replay)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Truncate(replay, n); err != nil {
+		return "", err
+	}
+
+	dst, err := os.OpenFile(replay, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+
+	return replay, os.Remove(spillPath)
+}
+
+// completeLen returns the length of the complete records at the start of the
+// spill file at path
+func completeLen(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var n int64
+	r := bufio.NewReader(f)
+	for {
+		cmd, _, _, err := readSpill(r)
+		if err != nil {
+			return n, nil
+		}
+		n += int64(spillHeaderLen + len(cmd.Key) + len(cmd.Data))
+	}
+}
+
+// replayExptime turns a spilled exptime back into one relative to now,
+// reporting false if it has passed
+func replayExptime(exptime uint32) (uint32, bool) {
+	if exptime <= maxRelativeExptime {
+		return exptime, true
+	}
+	now := uint32(time.Now().Unix())
+	if exptime <= now {
+		return 0, false
+	}
+	return exptime - now, true
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestTakeSpillTornReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rend-http-spill")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	spill := filepath.Join(dir, "spill")
+
+	// An unfinished replay whose last record was cut short by a crash
+	torn := spillRecord(common.SetRequest{Key: []byte("b"), Data: []byte("b")}, false, false)
+	replay := append(spillRecord(common.SetRequest{Key: []byte("a"), Data: []byte("a")}, false, false), torn[:len(torn)-1]...)
+	if err := ioutil.WriteFile(spill+".replay", replay, 0600); err != nil {
+		t.Fatalf("Failed to write replay file: %v", err)
+	}
+	if err := ioutil.WriteFile(spill, spillRecord(common.SetRequest{Key: []byte("c"), Data: []byte("c")}, false, false), 0600); err != nil {
+		t.Fatalf("Failed to write spill file: %v", err)
+	}
+
+	path, err := takeSpill(spill)
+	if err != nil {
+		t.Fatalf("Failed to take spill file: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open replay file: %v", err)
+	}
+	defer f.Close()
+
+	var keys []string
+	r := bufio.NewReader(f)
+	for {
+		cmd, _, _, err := readSpill(r)
+		if err != nil {
+			break
+		}
+		keys = append(keys, string(cmd.Key))
+	}
+
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {
+		t.Fatalf("Expected the sets before and after the torn record but got %v", keys)
+	}
+}
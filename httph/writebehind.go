@@ -0,0 +1,414 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdSetQueued        = metrics.AddCounter("cmd_set_queued", nil)
+	MetricCmdSetQueueDrops    = metrics.AddCounter("cmd_set_queue_drops", nil)
+	MetricCmdSetSpilled       = metrics.AddCounter("cmd_set_spilled", nil)
+	MetricCmdSetReplayed      = metrics.AddCounter("cmd_set_replayed", nil)
+	MetricCmdSetReplaySkipped = metrics.AddCounter("cmd_set_replay_skipped", nil)
+	MetricCmdSetAsyncErrors   = metrics.AddCounter("cmd_set_async_errors", nil)
+	MetricCmdSetQueueDepth    = metrics.AddIntGauge("cmd_set_queue_depth", nil)
+)
+
+// DefaultWriteBehindWorkers is the number of goroutines storing queued sets
+const DefaultWriteBehindWorkers = 4
+
+// Overflow policies for a full write-behind queue
+const (
+	OverflowDrop  = "drop"
+	OverflowBlock = "block"
+	OverflowSpill = "spill"
+)
+
+// WriteBehindOptions configures acknowledging sets before they are stored.
+// Clients see success as soon as a set is queued, so a set that later fails
+// is only counted and logged.
+type WriteBehindOptions struct {
+	// QueueSize is the most sets waiting to be stored. Zero turns
+	// write-behind off.
+	QueueSize int
+
+	// Workers is the number of goroutines storing queued sets. The queue is
+	// split between them by key, so sets, deletes and touches of a key are
+	// stored in the order they were made. Zero means
+	// DefaultWriteBehindWorkers.
+	Workers int
+
+	// Overflow is what happens to a set when the queue is full: OverflowDrop
+	// (the default) drops it, OverflowBlock waits for room and OverflowSpill
+	// appends it to SpillFile.
+	Overflow string
+
+	// SpillFile is an append-only file of sets that didn't fit in the queue.
+	// Sets in it are replayed into the queue when the handler is created, or
+	// when the other handlers using the file have been drained, unless their
+	// key has been written since.
+	SpillFile string
+}
+
+// queued is a set waiting to be stored, or a delete or touch waiting for the
+// sets of its key queued ahead of it
+type queued struct {
+	cmd common.SetRequest
+
+	// replay is set for sets replayed from the spill file, which are skipped
+	// if their key has been written since, and is done once they are handled
+	replay *sync.WaitGroup
+
+	// encoded is set for replayed sets whose value has been through the
+	// codecs already
+	encoded bool
+
+	// run is set instead of cmd for deletes and touches, and its result is
+	// sent on done
+	run  func() error
+	done chan error
+}
+
+type writeBehind struct {
+	h        *Handler
+	overflow string
+
+	// A key always goes to the same shard, which one worker stores in order
+	shards  []chan queued
+	workers sync.WaitGroup
+
+	// guards against sending on the shards after drain has closed them
+	mu     sync.RWMutex
+	closed bool
+
+	// nil without a spill file
+	spill   *spillFile
+	replays sync.WaitGroup
+}
+
+func newWriteBehind(h *Handler, opts WriteBehindOptions) (*writeBehind, error) {
+	if opts.QueueSize < 0 || opts.Workers < 0 {
+		return nil, errors.New("write-behind queue size and workers must not be negative")
+	}
+
+	workers := opts.Workers
+	if workers == 0 {
+		workers = DefaultWriteBehindWorkers
+	}
+
+	w := &writeBehind{
+		h:        h,
+		overflow: opts.Overflow,
+		shards:   make([]chan queued, workers),
+	}
+
+	switch w.overflow {
+	case "":
+		w.overflow = OverflowDrop
+	case OverflowDrop, OverflowBlock:
+	case OverflowSpill:
+		if opts.SpillFile == "" {
+			return nil, errors.New("the spill overflow policy needs a spill file")
+		}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", opts.Overflow)
+	}
+
+	// The queue is split evenly between the shards
+	size := (opts.QueueSize + workers - 1) / workers
+	for i := range w.shards {
+		w.shards[i] = make(chan queued, size)
+		w.workers.Add(1)
+		go w.work(w.shards[i])
+	}
+
+	if opts.SpillFile != "" {
+		var first bool
+		w.spill, first = acquireSpill(opts.SpillFile, w)
+		if first {
+			if err := w.startReplay(); err != nil {
+				w.drain()
+				return nil, err
+			}
+		}
+	}
+
+	return w, nil
+}
+
+// shard returns the shard for a key
+func (w *writeBehind) shard(key []byte) chan queued {
+	return w.shards[crc32.Checksum(key, castagnoli)%uint32(len(w.shards))]
+}
+
+func (w *writeBehind) setDepth() {
+	depth := 0
+	for _, s := range w.shards {
+		depth += len(s)
+	}
+	metrics.SetIntGauge(MetricCmdSetQueueDepth, uint64(depth))
+}
+
+// enqueue queues a set, reporting false if it should be stored right away
+// instead because the queue has been drained
+func (w *writeBehind) enqueue(cmd common.SetRequest) bool {
+	// The request buffers may be reused once the set is acknowledged
+	key := make([]byte, len(cmd.Key))
+	copy(key, cmd.Key)
+	data := make([]byte, len(cmd.Data))
+	copy(data, cmd.Data)
+	cmd.Key, cmd.Data = key, data
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return false
+	}
+
+	defer w.setDepth()
+
+	if w.spill != nil {
+		w.spill.supersede(cmd.Key)
+	}
+
+	shard := w.shard(cmd.Key)
+	select {
+	case shard <- queued{cmd: cmd}:
+		metrics.IncCounter(MetricCmdSetQueued)
+		return true
+	default:
+	}
+
+	switch w.overflow {
+	case OverflowBlock:
+		shard <- queued{cmd: cmd}
+		metrics.IncCounter(MetricCmdSetQueued)
+
+	case OverflowSpill:
+		// Encoded first so nothing is on disk that wouldn't be on the backend
+		var err error
+		if cmd, err = w.h.encode(cmd); err == nil {
+			err = w.spill.write(cmd, true)
+		}
+		if err != nil {
+			log.Printf("[SET] Failed to spill set of key %q: %v\n", cmd.Key, err)
+			metrics.IncCounter(MetricCmdSetQueueDrops)
+		} else {
+			metrics.IncCounter(MetricCmdSetSpilled)
+		}
+
+	default:
+		metrics.IncCounter(MetricCmdSetQueueDrops)
+	}
+
+	return true
+}
+
+// run runs a delete or touch of key once the sets of the key queued before it
+// are stored, reporting false if it should be run right away instead because
+// the queue has been drained. A delete supersedes spilled sets of the key.
+func (w *writeBehind) run(key []byte, supersede bool, fn func() error) (bool, error) {
+	done := make(chan error, 1)
+
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return false, nil
+	}
+	if supersede && w.spill != nil {
+		w.spill.supersede(key)
+	}
+	// Never dropped or spilled, since the client is waiting for the result
+	w.shard(key) <- queued{run: fn, done: done}
+	w.mu.RUnlock()
+
+	return true, <-done
+}
+
+func (w *writeBehind) work(shard chan queued) {
+	defer w.workers.Done()
+
+	for q := range shard {
+		w.setDepth()
+
+		if q.run != nil {
+			q.done <- q.run()
+			continue
+		}
+
+		if q.replay != nil {
+			w.storeReplayed(q.cmd, q.encoded)
+			q.replay.Done()
+			continue
+		}
+
+		if err := w.h.set(q.cmd); err != nil {
+			log.Printf("[SET] Failed to store queued set of key %q: %v\n", q.cmd.Key, err)
+			metrics.IncCounter(MetricCmdSetAsyncErrors)
+		}
+	}
+}
+
+// storeReplayed stores a set from the spill file unless its key has been
+// written since or it has expired
+func (w *writeBehind) storeReplayed(cmd common.SetRequest, encoded bool) {
+	exptime, live := replayExptime(cmd.Exptime)
+	if !live || !w.spill.isPending(cmd.Key) {
+		metrics.IncCounter(MetricCmdSetReplaySkipped)
+		return
+	}
+	cmd.Exptime = exptime
+
+	var err error
+	if encoded {
+		err = w.h.storeEncoded(cmd)
+	} else {
+		err = w.h.set(cmd)
+	}
+	if err != nil {
+		log.Printf("[SET] Failed to store replayed set of key %q: %v\n", cmd.Key, err)
+		metrics.IncCounter(MetricCmdSetAsyncErrors)
+	}
+}
+
+// drain stops queueing sets and waits for the queued ones to be stored. Sets
+// made afterwards are stored right away. If another handler shares the spill
+// file it takes over replaying it.
+func (w *writeBehind) drain() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		for _, s := range w.shards {
+			close(s)
+		}
+	}
+	w.mu.Unlock()
+
+	w.replays.Wait()
+	w.workers.Wait()
+
+	if w.spill == nil {
+		return
+	}
+	if next := w.spill.release(w); next != nil {
+		if err := next.startReplay(); err != nil {
+			log.Printf("Failed to take over spill file %s: %v\n", w.spill.path, err)
+		}
+	}
+}
+
+// Drain stops queueing sets and waits until the queued ones have been stored.
+// Sets made afterwards are stored before they are acknowledged. Sets still
+// being replayed from the spill file at that point are spilled again for next
+// time.
+func (h *Handler) Drain() {
+	if h.writeBehind != nil {
+		h.writeBehind.drain()
+	}
+}
+
+// startReplay takes the sets spilled so far and starts replaying them
+func (w *writeBehind) startReplay() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return nil
+	}
+
+	path, skip, err := w.spill.take()
+	if err != nil || path == "" {
+		return err
+	}
+
+	w.replays.Add(1)
+	go w.replay(path, skip)
+	return nil
+}
+
+// replay queues the sets in a spill file, waiting for room in the queue, and
+// removes the file once they are all handled. If the queue is drained first,
+// the sets left that are still the newest of their key are spilled again.
+func (w *writeBehind) replay(path string, skip map[string]int) {
+	defer w.replays.Done()
+	defer w.spill.finish()
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open spill file %s for replay: %v\n", path, err)
+		return
+	}
+	defer f.Close()
+
+	var handled sync.WaitGroup
+	defer handled.Wait()
+
+	r := bufio.NewReader(f)
+	n, respilled := 0, 0
+
+	for i := 0; ; i++ {
+		cmd, marker, encoded, err := readSpill(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Most likely the last record was cut short by a crash
+			log.Printf("Stopped replaying spill file %s after %d sets: %v\n", path, n, err)
+			break
+		}
+		if m, ok := skip[string(cmd.Key)]; marker || (ok && i < m) {
+			continue
+		}
+
+		w.mu.RLock()
+		if w.closed {
+			w.mu.RUnlock()
+			if w.spill.isPending(cmd.Key) {
+				if err := w.spill.write(cmd, encoded); err != nil {
+					log.Printf("Failed to spill set of key %q again: %v\n", cmd.Key, err)
+				}
+				respilled++
+			}
+			continue
+		}
+		handled.Add(1)
+		w.shard(cmd.Key) <- queued{cmd: cmd, replay: &handled, encoded: encoded}
+		w.mu.RUnlock()
+
+		metrics.IncCounter(MetricCmdSetReplayed)
+		n++
+	}
+
+	if respilled > 0 {
+		log.Printf("Replayed %d sets from spill file %s before the queue was drained, spilled %d again\n", n, path, respilled)
+	} else {
+		log.Printf("Replayed %d sets from spill file %s\n", n, path)
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Failed to remove spill file %s: %v\n", path, err)
+	}
+}
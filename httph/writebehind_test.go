@@ -0,0 +1,439 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httph_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// gatedServer holds requests until its gate is opened
+type gatedServer struct {
+	*server
+	gate chan struct{}
+}
+
+func newGatedServer() *gatedServer {
+	return &gatedServer{server: newServer(0, 0), gate: make(chan struct{})}
+}
+
+func (g *gatedServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	<-g.gate
+	g.server.ServeHTTP(w, req)
+}
+
+func setKeys(t *testing.T, handler handlers.Handler, keys ...string) {
+	for _, key := range keys {
+		if err := handler.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+	}
+}
+
+// drainable returns the handler as its concrete type so it can be drained
+func drainable(ts *httptest.Server, opts httph.Options) *httph.Handler {
+	return handlerWithOptions(ts, opts).(*httph.Handler)
+}
+
+func TestWriteBehind(t *testing.T) {
+	t.Run("Acknowledged", func(t *testing.T) {
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		defer ts.Close()
+
+		h := drainable(ts, httph.Options{WriteBehind: httph.WriteBehindOptions{QueueSize: 10}})
+
+		// Sets return while the backend is still holding them
+		setKeys(t, h, "a", "b", "c")
+
+		close(g.gate)
+		h.Drain()
+
+		for _, key := range []string{"a", "b", "c"} {
+			if g.data[key] != key {
+				t.Fatalf("Queued set of %q was not stored: %v", key, g.data)
+			}
+		}
+	})
+
+	t.Run("SetAfterDrain", func(t *testing.T) {
+		s := newServer(0, 0)
+		ts := httptest.NewServer(s)
+		defer ts.Close()
+
+		h := drainable(ts, httph.Options{WriteBehind: httph.WriteBehindOptions{QueueSize: 10}})
+		h.Drain()
+
+		setKeys(t, h, "a")
+		if s.data["a"] != "a" {
+			t.Fatalf("Set after drain was not stored synchronously")
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		defer ts.Close()
+
+		h := drainable(ts, httph.Options{
+			WriteBehind: httph.WriteBehindOptions{QueueSize: 1, Workers: 1, Overflow: httph.OverflowDrop},
+		})
+
+		setKeys(t, h, "a", "b", "c", "d")
+
+		close(g.gate)
+		h.Drain()
+
+		if n := len(g.data); n == 0 || n > 2 {
+			t.Fatalf("Expected one or two sets to be stored but got %v", g.data)
+		}
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		defer ts.Close()
+
+		h := drainable(ts, httph.Options{
+			WriteBehind: httph.WriteBehindOptions{QueueSize: 1, Workers: 1, Overflow: httph.OverflowBlock},
+		})
+
+		done := make(chan struct{})
+		go func() {
+			setKeys(t, h, "a", "b", "c", "d")
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			t.Fatalf("Sets did not block on a full queue")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(g.gate)
+		<-done
+		h.Drain()
+
+		if len(g.data) != 4 {
+			t.Fatalf("Expected all sets to be stored but got %v", g.data)
+		}
+	})
+
+	t.Run("SpillAndReplay", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "rend-http-spill")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		spill := filepath.Join(dir, "spill")
+		opts := httph.Options{
+			WriteBehind: httph.WriteBehindOptions{
+				QueueSize: 1,
+				Workers:   1,
+				Overflow:  httph.OverflowSpill,
+				SpillFile: spill,
+			},
+		}
+
+		// The first run can't keep up and spills
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		h := drainable(ts, opts)
+
+		keys := []string{"a", "b", "c", "d", "e"}
+		setKeys(t, h, keys...)
+
+		close(g.gate)
+		h.Drain()
+		ts.Close()
+
+		if fi, err := os.Stat(spill); err != nil || fi.Size() == 0 {
+			t.Fatalf("Expected sets in the spill file: %v", err)
+		}
+
+		// The next run replays the spilled sets
+		s := newServer(0, 0)
+		ts = httptest.NewServer(s)
+		defer ts.Close()
+
+		h = drainable(ts, opts)
+
+		replayed := false
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(spill + ".replay"); os.IsNotExist(err) {
+				replayed = true
+				break
+			}
+		}
+		if !replayed {
+			t.Fatalf("Spill file was not replayed")
+		}
+
+		h.Drain()
+
+		for _, key := range keys {
+			_, first := g.data[key]
+			_, second := s.data[key]
+			if !first && !second {
+				t.Fatalf("Set of %q was lost", key)
+			}
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, wb := range []httph.WriteBehindOptions{
+			{QueueSize: 1, Overflow: "explode"},
+			{QueueSize: 1, Overflow: httph.OverflowSpill},
+			{QueueSize: 1, Workers: -1},
+		} {
+			if _, err := httph.NewWithOptions("localhost", 1234, "evcache", httph.Options{WriteBehind: wb}); err == nil {
+				t.Fatalf("Expected an error for %#v", wb)
+			}
+		}
+	})
+}
+
+func spillOptions(spill string) httph.Options {
+	return httph.Options{
+		WriteBehind: httph.WriteBehindOptions{
+			QueueSize: 1,
+			Workers:   1,
+			Overflow:  httph.OverflowSpill,
+			SpillFile: spill,
+		},
+	}
+}
+
+// waitForReplay waits for the replay of a spill file to finish
+func waitForReplay(t *testing.T, spill string) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(spill + ".replay"); os.IsNotExist(err) {
+			return
+		}
+	}
+	t.Fatalf("Spill file was not replayed")
+}
+
+func TestWriteBehindOrder(t *testing.T) {
+	t.Run("SameKey", func(t *testing.T) {
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		defer ts.Close()
+
+		h := drainable(ts, httph.Options{WriteBehind: httph.WriteBehindOptions{QueueSize: 400, Workers: 4}})
+
+		for i := 0; i < 50; i++ {
+			if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte(strconv.Itoa(i))}); err != nil {
+				t.Fatalf("Failed set request: %s", err.Error())
+			}
+		}
+
+		close(g.gate)
+		h.Drain()
+
+		if g.data["k"] != "49" {
+			t.Fatalf("Expected the last set to be stored last but got %q", g.data["k"])
+		}
+	})
+
+	t.Run("DeleteAfterSet", func(t *testing.T) {
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		defer ts.Close()
+
+		h := drainable(ts, httph.Options{WriteBehind: httph.WriteBehindOptions{QueueSize: 10, Workers: 4}})
+		setKeys(t, h, "k")
+
+		done := make(chan error)
+		go func() {
+			done <- h.Delete(common.DeleteRequest{Key: []byte("k")})
+		}()
+
+		select {
+		case <-done:
+			t.Fatalf("Delete did not wait for the queued set")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(g.gate)
+		if err := <-done; err != nil {
+			t.Fatalf("Failed delete request: %s", err.Error())
+		}
+		h.Drain()
+
+		if _, ok := g.data["k"]; ok {
+			t.Fatalf("Expected the key to stay deleted but got %v", g.data)
+		}
+	})
+}
+
+func TestSpillReplay(t *testing.T) {
+	t.Run("Superseded", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "rend-http-spill")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		spill := filepath.Join(dir, "spill")
+
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		h := drainable(ts, spillOptions(spill))
+
+		// At most two sets fit, so the old value of k is spilled
+		setKeys(t, h, "f1", "f2", "f3")
+		if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("old")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		close(g.gate)
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			g.Lock()
+			_, stored := g.data["f1"]
+			g.Unlock()
+			if stored {
+				break
+			}
+		}
+		if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("new")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+		h.Drain()
+		ts.Close()
+
+		s := newServer(0, 0)
+		ts = httptest.NewServer(s)
+		defer ts.Close()
+
+		h = drainable(ts, spillOptions(spill))
+		waitForReplay(t, spill)
+		h.Drain()
+
+		last, ok := s.data["k"]
+		if !ok {
+			last = g.data["k"]
+		}
+		if last != "new" {
+			t.Fatalf("Expected the newer value to be kept but got %q", last)
+		}
+	})
+
+	t.Run("Handover", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "rend-http-spill")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		spill := filepath.Join(dir, "spill")
+
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		defer ts.Close()
+		old := drainable(ts, spillOptions(spill))
+
+		keys := []string{"a", "b", "c", "d", "e"}
+		setKeys(t, old, keys...)
+
+		// Like a reload, the replacement is created before the old one is
+		// drained, and leaves its spills alone until then
+		s := newServer(0, 0)
+		ts2 := httptest.NewServer(s)
+		defer ts2.Close()
+		h := drainable(ts2, spillOptions(spill))
+
+		if _, err := os.Stat(spill + ".replay"); !os.IsNotExist(err) {
+			t.Fatalf("Expected the spill file to be left to its first handler")
+		}
+
+		close(g.gate)
+		old.Drain()
+		waitForReplay(t, spill)
+		h.Drain()
+
+		for _, key := range keys {
+			_, first := g.data[key]
+			_, second := s.data[key]
+			if !first && !second {
+				t.Fatalf("Set of %q was lost", key)
+			}
+		}
+		if len(s.data) == 0 {
+			t.Fatalf("Expected the spilled sets to be replayed by the new handler")
+		}
+	})
+	t.Run("Encrypted", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "rend-http-spill")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		spill := filepath.Join(dir, "spill")
+
+		keys := keyDir(t)
+		defer os.RemoveAll(keys)
+		opts := spillOptions(spill)
+		opts.Encryption = httph.EncryptionOptions{KeyDir: keys, ActiveKeyID: "new"}
+
+		g := newGatedServer()
+		ts := httptest.NewServer(g)
+		h := drainable(ts, opts)
+
+		// At most two sets fit, so the secret is spilled
+		setKeys(t, h, "f1", "f2", "f3")
+		if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("top secret value")}); err != nil {
+			t.Fatalf("Failed set request: %s", err.Error())
+		}
+
+		data, err := ioutil.ReadFile(spill)
+		if err != nil {
+			t.Fatalf("Expected a spill file: %v", err)
+		}
+		if bytes.Contains(data, []byte("top secret")) {
+			t.Fatalf("Found the plaintext in the spill file")
+		}
+
+		close(g.gate)
+		h.Drain()
+		ts.Close()
+
+		s := newServer(0, 0)
+		ts = httptest.NewServer(s)
+		defer ts.Close()
+
+		h = drainable(ts, opts)
+		waitForReplay(t, spill)
+		h.Drain()
+
+		res, err := getOne(h, "k")
+		if err != nil {
+			t.Fatalf("Failed to retrieve item: %s", err.Error())
+		}
+		if string(res.Data) != "top secret value" {
+			t.Fatalf("Expected the replayed value to be stored encrypted once but got %q", res.Data)
+		}
+	})
+}
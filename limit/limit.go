@@ -0,0 +1,451 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package limit protects the backends shared by a listener's clients with
+// rate limits and a cap on concurrent requests. Limits are read from the
+// config package on every request so they can be changed while running.
+//
+// For a listener named NAME the config keys are
+//
+//	limit.NAME.opsPerSec        requests per second, counting each key of a multiget
+//	limit.NAME.bytesPerSec      value bytes per second, sent and received
+//	limit.NAME.maxInFlight      requests in progress at once
+//
+// and the same three under limit.NAME.OP for each operation type OP: get, set,
+// delete and touch. A limit of zero or less is no limit.
+package limit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend-http/config"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// ErrLimited is returned for requests over a limit. It is sent to clients as
+// a server error.
+var ErrLimited = common.ErrInternal
+
+// Operation types with their own limits
+const (
+	opGet = iota
+	opSet
+	opDelete
+	opTouch
+	numOps
+)
+
+var opNames = [numOps]string{"get", "set", "delete", "touch"}
+
+// Rejections are counted by the limit that was hit, with the listener-wide
+// limits under op "all"
+var (
+	MetricRejectedOps      = addCounters("limit_rejected_ops")
+	MetricRejectedBytes    = addCounters("limit_rejected_bytes")
+	MetricRejectedInFlight = addCounters("limit_rejected_in_flight")
+)
+
+// addCounters adds a counter per operation type followed by one for the
+// listener-wide limits
+func addCounters(name string) [numOps + 1]uint32 {
+	var ret [numOps + 1]uint32
+	for op, opName := range opNames {
+		ret[op] = metrics.AddCounter(name, metrics.Tags{"op": opName})
+	}
+	ret[numOps] = metrics.AddCounter(name, metrics.Tags{"op": "all"})
+	return ret
+}
+
+// Options holds the listener-wide limits used until they are set through the
+// config endpoint
+type Options struct {
+	// Name scopes the config keys, usually the listen port
+	Name string
+
+	OpsPerSec   int
+	BytesPerSec int
+	MaxInFlight int
+}
+
+// bucket is a token bucket holding up to a second's worth of tokens. A request
+// costing more than a second's worth is let through when the bucket is full,
+// leaving it in debt, so big values and multigets aren't shut out forever.
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last call. Must be called with the
+// lock held.
+func (b *bucket) refill(rate int) {
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+	}
+	b.last = now
+}
+
+// take reports whether a request is allowed, taking its cost if it is
+func (b *bucket) take(rate, cost int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if rate <= 0 {
+		// Start full if the limit is turned back on
+		b.last = time.Time{}
+		return true
+	}
+
+	need := cost
+	if need > rate {
+		need = rate
+	}
+
+	b.refill(rate)
+	if b.tokens < float64(need) {
+		return false
+	}
+	b.tokens -= float64(cost)
+	return true
+}
+
+// charge takes a cost that is only known after the request was let through
+func (b *bucket) charge(rate, cost int) {
+	if rate <= 0 || cost == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(rate)
+	b.tokens -= float64(cost)
+}
+
+// refund gives back a cost taken by a request that was rejected afterwards
+func (b *bucket) refund(rate, cost int) {
+	if rate <= 0 || cost == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += float64(cost)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+// scope is one set of limits, either for a whole listener or for one of its
+// operation types
+type scope struct {
+	// the limits, followed in the dynamic config
+	opsRate, bytesRate, maxInFlight *config.Int
+
+	ops, bytes bucket
+	inFlight   int64
+
+	rejectedOps, rejectedBytes, rejectedInFlight uint32
+}
+
+// newScope creates the limits under a config key prefix. The index picks the
+// rejection counters.
+func newScope(prefix string, index int, defOps, defBytes, defMaxInFlight int) *scope {
+	opsKey, bytesKey, inFlightKey := prefix+".opsPerSec", prefix+".bytesPerSec", prefix+".maxInFlight"
+	for _, key := range []string{opsKey, bytesKey, inFlightKey} {
+		config.ValidateInt(key, config.MinInt(0))
+	}
+
+	return &scope{
+		opsRate:          config.WatchInt(opsKey, defOps),
+		bytesRate:        config.WatchInt(bytesKey, defBytes),
+		maxInFlight:      config.WatchInt(inFlightKey, defMaxInFlight),
+		rejectedOps:      MetricRejectedOps[index],
+		rejectedBytes:    MetricRejectedBytes[index],
+		rejectedInFlight: MetricRejectedInFlight[index],
+	}
+}
+
+// stop stops following the dynamic config
+func (s *scope) stop() {
+	s.opsRate.Stop()
+	s.bytesRate.Stop()
+	s.maxInFlight.Stop()
+}
+
+// enter starts a request with ops keys and size bytes known up front, or
+// returns ErrLimited. The request must be finished with leave if it is let in.
+func (s *scope) enter(ops, size int) error {
+	n := atomic.AddInt64(&s.inFlight, 1)
+	if max := s.maxInFlight.Get(); max > 0 && n > int64(max) {
+		atomic.AddInt64(&s.inFlight, -1)
+		metrics.IncCounter(s.rejectedInFlight)
+		return ErrLimited
+	}
+
+	opsRate := s.opsRate.Get()
+	if !s.ops.take(opsRate, ops) {
+		atomic.AddInt64(&s.inFlight, -1)
+		metrics.IncCounter(s.rejectedOps)
+		return ErrLimited
+	}
+
+	if !s.bytes.take(s.bytesRate.Get(), size) {
+		s.ops.refund(opsRate, ops)
+		atomic.AddInt64(&s.inFlight, -1)
+		metrics.IncCounter(s.rejectedBytes)
+		return ErrLimited
+	}
+
+	return nil
+}
+
+// cancel undoes enter for a request that was rejected by another scope
+func (s *scope) cancel(ops, size int) {
+	s.ops.refund(s.opsRate.Get(), ops)
+	s.bytes.refund(s.bytesRate.Get(), size)
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+// leave finishes a request that returned size bytes to the client
+func (s *scope) leave(size int) {
+	s.bytes.charge(s.bytesRate.Get(), size)
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+// limiter holds the state shared by all of a listener's connections
+type limiter struct {
+	listener *scope
+	ops      [numOps]*scope
+}
+
+func (l *limiter) enter(op, ops, size int) error {
+	if err := l.listener.enter(ops, size); err != nil {
+		return err
+	}
+	if err := l.ops[op].enter(ops, size); err != nil {
+		l.listener.cancel(ops, size)
+		return err
+	}
+	return nil
+}
+
+func (l *limiter) leave(op, size int) {
+	l.ops[op].leave(size)
+	l.listener.leave(size)
+}
+
+// New creates a handler constructor that applies the listener's limits to the
+// handlers made by inner. All handlers made by it share the same limits, which
+// follow the dynamic config until stop is called once they are retired.
+func New(inner handlers.HandlerConst, opts Options) (hc handlers.HandlerConst, stop func()) {
+	prefix := "limit." + opts.Name
+
+	l := &limiter{
+		listener: newScope(prefix, numOps, opts.OpsPerSec, opts.BytesPerSec, opts.MaxInFlight),
+	}
+	for op, name := range opNames {
+		l.ops[op] = newScope(prefix+"."+name, op, 0, 0, 0)
+	}
+
+	stop = func() {
+		l.listener.stop()
+		for _, s := range l.ops {
+			s.stop()
+		}
+	}
+
+	return func() (handlers.Handler, error) {
+		h, err := inner()
+		if err != nil {
+			return nil, err
+		}
+		return &Handler{inner: h, limiter: l}, nil
+	}, stop
+}
+
+// Handler applies limits to the requests of a client connection before
+// passing them on to another handler
+type Handler struct {
+	inner   handlers.Handler
+	limiter *limiter
+}
+
+func (h *Handler) write(cmd common.SetRequest, f func(common.SetRequest) error) error {
+	if err := h.limiter.enter(opSet, 1, len(cmd.Data)); err != nil {
+		return err
+	}
+	defer h.limiter.leave(opSet, 0)
+	return f(cmd)
+}
+
+// Set passes the set on if it is within the limits
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.write(cmd, h.inner.Set)
+}
+
+// Add passes the add on if it is within the set limits
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.write(cmd, h.inner.Add)
+}
+
+// Replace passes the replace on if it is within the set limits
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.write(cmd, h.inner.Replace)
+}
+
+// Append passes the append on if it is within the set limits
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.write(cmd, h.inner.Append)
+}
+
+// Prepend passes the prepend on if it is within the set limits
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.write(cmd, h.inner.Prepend)
+}
+
+// Delete passes the delete on if it is within the limits
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	if err := h.limiter.enter(opDelete, 1, 0); err != nil {
+		return err
+	}
+	defer h.limiter.leave(opDelete, 0)
+	return h.inner.Delete(cmd)
+}
+
+// Touch passes the touch on if it is within the limits
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	if err := h.limiter.enter(opTouch, 1, 0); err != nil {
+		return err
+	}
+	defer h.limiter.leave(opTouch, 0)
+	return h.inner.Touch(cmd)
+}
+
+// GAT passes the get-and-touch on if it is within the get limits
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	if err := h.limiter.enter(opGet, 1, 0); err != nil {
+		return common.GetResponse{}, err
+	}
+
+	res, err := h.inner.GAT(cmd)
+	h.limiter.leave(opGet, len(res.Data))
+	return res, err
+}
+
+// Get passes the get on if it is within the limits. The request counts as in
+// flight until all of its responses have been read.
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := h.limiter.enter(opGet, len(cmd.Keys), 0); err != nil {
+		errorOut := make(chan error, 1)
+		errorOut <- err
+		return nil, errorOut
+	}
+
+	dataIn, errorIn := h.inner.Get(cmd)
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		size := 0
+		defer func() { h.limiter.leave(opGet, size) }()
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+				size += len(res.Data)
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				// Handlers stop at the first error and may not close the
+				// channel after it
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE passes the get on if it is within the get limits. The request counts
+// as in flight until all of its responses have been read.
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if err := h.limiter.enter(opGet, len(cmd.Keys), 0); err != nil {
+		errorOut := make(chan error, 1)
+		errorOut <- err
+		return nil, errorOut
+	}
+
+	dataIn, errorIn := h.inner.GetE(cmd)
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		size := 0
+		defer func() { h.limiter.leave(opGet, size) }()
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+				size += len(res.Data)
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// Close closes the wrapped handler
+func (h *Handler) Close() error {
+	return h.inner.Close()
+}
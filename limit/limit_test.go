@@ -0,0 +1,306 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package limit_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/limit"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// memHandler is a handler that keeps items in a map
+type memHandler struct {
+	sync.Mutex
+	data map[string]string
+
+	// if set, sets wait for it to be closed
+	block chan struct{}
+}
+
+func (m *memHandler) Set(cmd common.SetRequest) error {
+	if m.block != nil {
+		<-m.block
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *memHandler) Delete(cmd common.DeleteRequest) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.data, string(cmd.Key))
+	return nil
+}
+
+func (m *memHandler) Add(cmd common.SetRequest) error     { return common.ErrUnknownCmd }
+func (m *memHandler) Replace(cmd common.SetRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Append(cmd common.SetRequest) error  { return common.ErrUnknownCmd }
+func (m *memHandler) Prepend(cmd common.SetRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Touch(cmd common.TouchRequest) error { return nil }
+func (m *memHandler) Close() error                        { return nil }
+
+func (m *memHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	m.Lock()
+	defer m.Unlock()
+
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	for _, key := range cmd.Keys {
+		data, ok := m.data[string(key)]
+		dataOut <- common.GetResponse{Key: key, Data: []byte(data), Miss: !ok}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (m *memHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	return nil, errchan
+}
+
+func (m *memHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{}, common.ErrUnknownCmd
+}
+
+// setConfig sets a value through the config endpoint
+func setConfig(t *testing.T, key string, value int) {
+	ts := httptest.NewServer(http.DefaultServeMux)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/config/"+key, strings.NewReader(strconv.Itoa(value)))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set config %s: %v", key, err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Failed to set config %s: %s", key, res.Status)
+	}
+}
+
+func setup(t *testing.T, opts limit.Options) (*memHandler, handlers.Handler) {
+	m := &memHandler{data: make(map[string]string)}
+
+	hc, _ := limit.New(func() (handlers.Handler, error) { return m, nil }, opts)
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	return m, h
+}
+
+func set(h handlers.Handler, key, value string) error {
+	return h.Set(common.SetRequest{Key: []byte(key), Data: []byte(value)})
+}
+
+// get reads all responses to a get, returning the first error
+func get(h handlers.Handler, keys ...string) error {
+	cmd := common.GetRequest{}
+	for _, key := range keys {
+		cmd.Keys = append(cmd.Keys, []byte(key))
+		cmd.Opaques = append(cmd.Opaques, 0)
+		cmd.Quiet = append(cmd.Quiet, false)
+	}
+
+	datchan, errchan := h.Get(cmd)
+	for datchan != nil || errchan != nil {
+		select {
+		case _, ok := <-datchan:
+			if !ok {
+				datchan = nil
+			}
+		case err, ok := <-errchan:
+			if !ok {
+				errchan = nil
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestOpsPerSec(t *testing.T) {
+	t.Run("Listener", func(t *testing.T) {
+		_, h := setup(t, limit.Options{Name: "ops", OpsPerSec: 2})
+
+		for i := 0; i < 2; i++ {
+			if err := set(h, "foo", "bar"); err != nil {
+				t.Fatalf("Set within the limit failed: %v", err)
+			}
+		}
+		if err := set(h, "foo", "bar"); err != limit.ErrLimited {
+			t.Fatalf("Expected the set over the limit to be rejected but got %v", err)
+		}
+		if err := get(h, "foo"); err != limit.ErrLimited {
+			t.Fatalf("Expected the get over the limit to be rejected but got %v", err)
+		}
+	})
+
+	t.Run("Operation", func(t *testing.T) {
+		setConfig(t, "limit.opsop.delete.opsPerSec", 1)
+		_, h := setup(t, limit.Options{Name: "opsop"})
+
+		if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != nil {
+			t.Fatalf("Delete within the limit failed: %v", err)
+		}
+		if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != limit.ErrLimited {
+			t.Fatalf("Expected the delete over the limit to be rejected but got %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := set(h, "foo", "bar"); err != nil {
+				t.Fatalf("Set was limited by the delete limit: %v", err)
+			}
+		}
+	})
+
+	t.Run("OperationRejectionRefunded", func(t *testing.T) {
+		setConfig(t, "limit.opsrefund.delete.opsPerSec", 1)
+		_, h := setup(t, limit.Options{Name: "opsrefund", OpsPerSec: 3})
+
+		for i := 0; i < 5; i++ {
+			h.Delete(common.DeleteRequest{Key: []byte("foo")})
+		}
+
+		// Only the delete that was let in counts against the listener
+		for i := 0; i < 2; i++ {
+			if err := set(h, "foo", "bar"); err != nil {
+				t.Fatalf("Expected deletes rejected by their own limit to leave the listener's budget but got %v", err)
+			}
+		}
+	})
+
+	t.Run("MultigetKeys", func(t *testing.T) {
+		_, h := setup(t, limit.Options{Name: "opsmulti", OpsPerSec: 3})
+
+		if err := get(h, "a", "b", "c"); err != nil {
+			t.Fatalf("Get within the limit failed: %v", err)
+		}
+		if err := get(h, "a"); err != limit.ErrLimited {
+			t.Fatalf("Expected each key to count against the limit but got %v", err)
+		}
+	})
+
+	t.Run("Live", func(t *testing.T) {
+		_, h := setup(t, limit.Options{Name: "opslive"})
+
+		setConfig(t, "limit.opslive.opsPerSec", 1)
+		set(h, "foo", "bar")
+		if err := set(h, "foo", "bar"); err != limit.ErrLimited {
+			t.Fatalf("Expected the limit set through config to apply but got %v", err)
+		}
+
+		setConfig(t, "limit.opslive.opsPerSec", 0)
+		if err := set(h, "foo", "bar"); err != nil {
+			t.Fatalf("Expected no limit after setting it to 0 but got %v", err)
+		}
+	})
+}
+
+func TestBytesPerSec(t *testing.T) {
+	t.Run("Set", func(t *testing.T) {
+		_, h := setup(t, limit.Options{Name: "bytesset", BytesPerSec: 10})
+
+		// A value bigger than the limit gets through but uses up the budget
+		if err := set(h, "foo", strings.Repeat("a", 20)); err != nil {
+			t.Fatalf("Set with budget left failed: %v", err)
+		}
+		if err := set(h, "foo", "a"); err != limit.ErrLimited {
+			t.Fatalf("Expected the set over the limit to be rejected but got %v", err)
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		m, h := setup(t, limit.Options{Name: "bytesget"})
+		m.data["foo"] = strings.Repeat("a", 20)
+		setConfig(t, "limit.bytesget.get.bytesPerSec", 10)
+
+		if err := get(h, "foo"); err != nil {
+			t.Fatalf("Get with budget left failed: %v", err)
+		}
+		if err := get(h, "foo"); err != limit.ErrLimited {
+			t.Fatalf("Expected the bytes read to count against the limit but got %v", err)
+		}
+	})
+}
+
+func TestMaxInFlight(t *testing.T) {
+	t.Run("Set", func(t *testing.T) {
+		m, h := setup(t, limit.Options{Name: "inflight", MaxInFlight: 1})
+		m.block = make(chan struct{})
+
+		done := make(chan error)
+		go func() { done <- set(h, "foo", "bar") }()
+
+		// Wait for the first set to be let in
+		rejected := false
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !rejected; time.Sleep(time.Millisecond) {
+			rejected = h.Delete(common.DeleteRequest{Key: []byte("foo")}) == limit.ErrLimited
+		}
+		if !rejected {
+			t.Fatalf("Expected requests beyond the in-flight limit to be rejected")
+		}
+
+		close(m.block)
+		if err := <-done; err != nil {
+			t.Fatalf("Set within the limit failed: %v", err)
+		}
+		if err := set(h, "foo", "bar"); err != nil {
+			t.Fatalf("Set after the in-flight request finished failed: %v", err)
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		setConfig(t, "limit.inflightget.maxInFlight", 1)
+		_, h := setup(t, limit.Options{Name: "inflightget"})
+
+		// The get is in flight until its responses are read
+		datchan, _ := h.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("foo")},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+		if err := set(h, "foo", "bar"); err != limit.ErrLimited {
+			t.Fatalf("Expected the set to be rejected while the get is in flight but got %v", err)
+		}
+
+		for range datchan {
+		}
+
+		ok := false
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !ok; time.Sleep(time.Millisecond) {
+			ok = set(h, "foo", "bar") == nil
+		}
+		if !ok {
+			t.Fatalf("Expected the get to leave once its responses were read")
+		}
+	})
+}
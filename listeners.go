@@ -0,0 +1,261 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/netflix/rend-http/limit"
+	"github.com/netflix/rend-http/proxyconf"
+	"github.com/netflix/rend-http/reload"
+	"github.com/netflix/rend-http/router"
+	"github.com/netflix/rend-http/shadow"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/server"
+)
+
+func init() {
+	http.Handle("/reload", http.HandlerFunc(handleReload))
+}
+
+// port is a memcached port the server has been started on. The server can't
+// close it, so a listener removed by a reload is only stopped and comes back on
+// the same port if it is added again.
+type port struct {
+	listener  *reload.Listener
+	protocols []string
+}
+
+var (
+	reloadMu sync.Mutex
+	ports    = make(map[int]*port)
+	current  = &proxyconf.Config{}
+	stopped  bool
+)
+
+// buildBackend creates the handlers for everything behind a listener
+func buildBackend(l proxyconf.Listener) (*reload.Backend, error) {
+	b := &reload.Backend{}
+
+	h, err := newBackend(b, l, proxyconf.Target{Cache: l.Cache}, l.Fallback, roleCache)
+	if err != nil {
+		b.Retire(shutdownTimeout)
+		return nil, fmt.Errorf("could not create backend: %v", err)
+	}
+
+	// Only the listener's own cache is mirrored, not the routed ones. The
+	// mirror isn't needed to serve, so it doesn't count toward readiness.
+	if l.Shadow != nil {
+		sh, err := newBackend(b, l, l.Shadow.Target, nil, roleShadow)
+		if err != nil {
+			b.Retire(shutdownTimeout)
+			return nil, fmt.Errorf("could not create shadow backend: %v", err)
+		}
+		sopts := shadowOpts
+		if l.Shadow.QueueSize > 0 {
+			sopts.QueueSize = l.Shadow.QueueSize
+		}
+		if l.Shadow.CompareRate > 0 {
+			sopts.CompareRate = l.Shadow.CompareRate
+		}
+		s, err := shadow.New(h, sh, sopts)
+		if err != nil {
+			b.Retire(shutdownTimeout)
+			return nil, fmt.Errorf("invalid shadow options: %v", err)
+		}
+		b.OnRetire(s.Drain)
+		h = s.Handler()
+	}
+
+	if len(l.Routes) > 0 {
+		routes := make([]router.Route, len(l.Routes))
+		for i, r := range l.Routes {
+			rh, err := newBackend(b, l, r.Target, nil, routeRole(i))
+			if err != nil {
+				b.Retire(shutdownTimeout)
+				return nil, fmt.Errorf("could not create backend for cache %s: %v", r.Cache, err)
+			}
+			routes[i] = router.Route{Prefix: r.Prefix, Handler: rh}
+			if r.Regexp != "" {
+				routes[i].Regexp = regexp.MustCompile(r.Regexp)
+			}
+		}
+
+		if h, err = router.New(routes, h); err != nil {
+			b.Retire(shutdownTimeout)
+			return nil, fmt.Errorf("invalid routes: %v", err)
+		}
+	}
+
+	// Limits cover all of a listener's requests, wherever they are routed
+	lopts := limits
+	if l.Features.Limits != nil {
+		lopts.OpsPerSec = l.Features.Limits.OpsPerSec
+		lopts.BytesPerSec = l.Features.Limits.BytesPerSec
+		lopts.MaxInFlight = l.Features.Limits.MaxInFlight
+	}
+	lopts.Name = strconv.Itoa(l.Port)
+	var stop func()
+	b.Handler, stop = limit.New(h, lopts)
+	b.OnRetire(stop)
+
+	return b, nil
+}
+
+// start starts serving a new port with backend b
+func start(l proxyconf.Listener, b *reload.Backend) {
+	p := &port{listener: &reload.Listener{}, protocols: l.Protocols}
+	p.listener.Swap(b, 0)
+	ports[l.Port] = p
+
+	shutdownGate.OnShutdown(func() {
+		if err := p.listener.Stop(shutdownTimeout); err != nil {
+			log.Printf("Error: stopping listener %d: %v\n", l.Port, err)
+		}
+	})
+
+	largs := server.ListenArgs{
+		Type: server.ListenTCP,
+		Port: l.Port,
+	}
+
+	go server.ListenAndServe(
+		largs,
+		protocols(l.Protocols),
+		server.Default,
+		orcas.L1Only,
+		shutdownGate.Wrap(p.listener.Handler()),
+		handlers.NilHandler,
+	)
+}
+
+// apply moves the listeners from the current configuration to c, logging what
+// changed. Every new backend is created before any is swapped in, so a reload
+// that fails changes nothing.
+func apply(c *proxyconf.Config) ([]proxyconf.Change, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if stopped {
+		return nil, errors.New("shutting down")
+	}
+
+	byPort := make(map[int]proxyconf.Listener)
+	for _, l := range c.Listeners {
+		byPort[l.Port] = l
+	}
+
+	changes := proxyconf.Diff(current, c)
+
+	backends := make(map[int]*reload.Backend)
+	for _, ch := range changes {
+		if ch.Kind == proxyconf.Removed {
+			continue
+		}
+		b, err := buildBackend(byPort[ch.Port])
+		if err != nil {
+			for _, b := range backends {
+				b.Retire(shutdownTimeout)
+			}
+			return nil, fmt.Errorf("listener %d: %v", ch.Port, err)
+		}
+		backends[ch.Port] = b
+	}
+
+	for _, ch := range changes {
+		log.Println(ch)
+
+		p := ports[ch.Port]
+		if ch.Kind == proxyconf.Removed {
+			if err := p.listener.Stop(shutdownTimeout); err != nil {
+				log.Printf("Error: stopping listener %d: %v\n", ch.Port, err)
+			}
+			continue
+		}
+
+		if p == nil {
+			start(byPort[ch.Port], backends[ch.Port])
+			continue
+		}
+		if l := byPort[ch.Port]; !reflect.DeepEqual(p.protocols, l.Protocols) {
+			log.Printf("Warning: listener %d keeps protocols %v until restarted\n", ch.Port, p.protocols)
+		}
+
+		if err := p.listener.Swap(backends[ch.Port], shutdownTimeout); err != nil {
+			log.Printf("Error: retiring old backends of listener %d: %v\n", ch.Port, err)
+		}
+	}
+
+	current = c
+	checker.SetPorts(servingPorts(c))
+	return changes, nil
+}
+
+// servingPorts lists the ports of c's listeners
+func servingPorts(c *proxyconf.Config) []int {
+	ret := make([]int, len(c.Listeners))
+	for i, l := range c.Listeners {
+		ret[i] = l.Port
+	}
+	return ret
+}
+
+// reloadConfig reads the config file again and applies it
+func reloadConfig() ([]proxyconf.Change, error) {
+	if configFile == "" {
+		return nil, errors.New("reloading needs a --config file")
+	}
+
+	c, err := proxyconf.Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return apply(c)
+}
+
+// stopReloads makes reloads fail from now on, for shutting down
+func stopReloads() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	stopped = true
+}
+
+// handleReload reloads the config file on a POST and responds with the
+// changes, one per line
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	changes, err := reloadConfig()
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	for _, ch := range changes {
+		fmt.Fprintln(w, ch)
+	}
+}
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -22,45 +23,60 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"runtime"
-	"strconv"
-	"strings"
+	"path/filepath"
+	"syscall"
+	"time"
 
+	"github.com/netflix/rend-http/admin"
+	"github.com/netflix/rend-http/config"
+	"github.com/netflix/rend-http/gate"
+	"github.com/netflix/rend-http/grpch"
+	"github.com/netflix/rend-http/health"
 	"github.com/netflix/rend-http/httph"
+	"github.com/netflix/rend-http/limit"
+	"github.com/netflix/rend-http/namespace"
+	"github.com/netflix/rend-http/proxyconf"
+	"github.com/netflix/rend-http/reload"
+	"github.com/netflix/rend-http/shadow"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
-	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/protocol"
 	"github.com/netflix/rend/protocol/binprot"
 	"github.com/netflix/rend/protocol/textprot"
-	"github.com/netflix/rend/server"
 )
 
 func init() {
-	// Setting up signal handlers
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, os.Interrupt)
-
-	go func() {
-		<-sigs
-		panic("Keyboard Interrupt")
-	}()
-
-	// http debug and metrics endpoint
-	go http.ListenAndServe("localhost:11299", nil)
-
 	// metrics output prefix
 	metrics.SetPrefix("rend_http_")
 }
 
-type proxyinfo struct {
-	listenPort int
-	proxyHost  string
-	proxyPort  int
-	cacheName  string
-}
+var adminOpts admin.Options
+var auditLog string
+var healthOpts health.Options
+var checker *health.Checker
+var configFile string
+var configStore string
+var listenerFlags proxyconf.Flags
+
+var compression httph.CompressionOptions
+var chunkSize int
+var maxValueSize int
+var checksum httph.ChecksumOptions
+var encryption httph.EncryptionOptions
+var hashKeysOver int
+var shadowOpts shadow.Options
+var readRepair bool
+var readRepairTTL uint
+var maxRepairs int
+var writeBehind httph.WriteBehindOptions
+var spillDir string
+var limits limit.Options
+var adaptiveLimit httph.AdaptiveLimitOptions
+var shutdownTimeout time.Duration
 
-var pis = []proxyinfo{}
+// shutdownGate tracks commands in progress on all listeners and the background
+// work to flush when shutting down
+var shutdownGate = gate.New()
 
 func init() {
 	flag.Usage = func() {
@@ -68,105 +84,346 @@ func init() {
 		flag.PrintDefaults()
 	}
 
-	var listenPortsStr string
-	var proxyHostsStr string
-	var proxyPortsStr string
-	var cacheNamesStr string
+	flag.StringVar(&adminOpts.Addr, "admin-addr", admin.DefaultAddr, "Address the debug, metrics and config endpoints listen on")
+	flag.StringVar(&adminOpts.TokenFile, "admin-token-file", "", "File of NAME:TOKEN lines, one per bearer token accepted by the admin endpoints. With it or --admin-client-ca, requests without credentials are refused.")
+	flag.StringVar(&adminOpts.CertFile, "admin-tls-cert", "", "Certificate to serve the admin endpoints over TLS with")
+	flag.StringVar(&adminOpts.KeyFile, "admin-tls-key", "", "Key of --admin-tls-cert")
+	flag.StringVar(&adminOpts.ClientCAFile, "admin-client-ca", "", "CAs that client certificates for the admin endpoints are verified against. Clients are identified by their certificate's common name.")
+	flag.BoolVar(&adminOpts.OpenReads, "admin-open-reads", false, "Leave GET and HEAD requests to the admin endpoints open when they need credentials, so only changes do")
+	flag.StringVar(&auditLog, "admin-audit-log", "", "File each change made through the admin endpoints is appended to as a line of JSON. Defaults to the standard log.")
+	flag.Float64Var(&healthOpts.MinHealthy, "readiness-min-healthy", 1, "Fraction of caches that need a backend answering probes for /readyz to report ready. 0 only needs the listeners.")
+	flag.DurationVar(&healthOpts.Timeout, "health-timeout", health.DefaultTimeout, "Longest to wait for each backend probe and listener check made by /readyz")
+	flag.StringVar(&configFile, "config", "", "YAML or JSON file describing the listeners and their backends, instead of --listen-ports and the other per-listener lists. Other flags are the defaults for features the file leaves out.")
+	flag.StringVar(&configStore, "config-store", "", "JSON file the dynamic config set through /config is saved to and loaded from on startup. Off by default.")
+	flag.StringVar(&listenerFlags.ListenPorts, "listen-ports", "", "List of TCP ports to proxy from, separated by '|'")
+	flag.StringVar(&listenerFlags.ProxyHosts, "proxy-hosts", "", "List of hostnames to proxy to, separated by '|'")
+	flag.StringVar(&listenerFlags.ProxyPorts, "proxy-ports", "", "List of ports to proxy to, separated by '|'")
+	flag.StringVar(&listenerFlags.CacheNames, "cache-names", "", "List of cache names to proxy to, separated by '|'")
+	flag.StringVar(&listenerFlags.Dialects, "dialects", "", "Optional list of backend dialects (evcache or kv), separated by '|'. Defaults to evcache.")
+	flag.StringVar(&listenerFlags.Backends, "backends", "", "Optional list of backend protocols (http or grpc), separated by '|'. Defaults to http.")
+	flag.StringVar(&listenerFlags.Routes, "routes", "", "Optional list of routing tables, separated by '|'. Each is a comma separated list of match=CACHE[@host:port] where match is a key prefix or a /regexp/. Unmatched keys go to the listener's cache.")
+	flag.StringVar(&listenerFlags.Shadows, "shadows", "", "Optional list of secondary caches of the form CACHE[@host:port] that writes to each listener's cache are mirrored to, separated by '|'. Entries may be blank.")
+	flag.IntVar(&shadowOpts.QueueSize, "shadow-queue-size", shadow.DefaultQueueSize, "Most writes waiting to be mirrored to a secondary cache before new ones are dropped")
+	flag.Float64Var(&shadowOpts.CompareRate, "shadow-compare-rate", 0, "Fraction of reads compared against the secondary cache. 0 disables comparing.")
+	flag.StringVar(&listenerFlags.Fallbacks, "fallbacks", "", "Optional list of caches of the form CACHE[@host:port] that gets are sent to when each listener's HTTP backend misses or fails, separated by '|'. Entries may be blank.")
+	flag.BoolVar(&readRepair, "read-repair", false, "Copy values found on a fallback cache back into the listener's cache")
+	flag.UintVar(&readRepairTTL, "read-repair-ttl", 3600, "TTL in seconds of values copied back by --read-repair")
+	flag.IntVar(&maxRepairs, "read-repair-max", httph.DefaultMaxRepairs, "Most read-repairs in flight per backend before new ones are dropped")
+	flag.IntVar(&writeBehind.QueueSize, "write-behind-queue-size", 0, "Acknowledge sets to HTTP backends right away and queue up to this many to be stored in the background. 0 disables write-behind.")
+	flag.IntVar(&writeBehind.Workers, "write-behind-workers", httph.DefaultWriteBehindWorkers, "Number of goroutines storing queued sets per backend")
+	flag.StringVar(&writeBehind.Overflow, "write-behind-overflow", httph.OverflowDrop, "What to do with sets when the write-behind queue is full: drop, block or spill")
+	flag.StringVar(&spillDir, "write-behind-spill-dir", "", "Directory of the files sets are spilled to with --write-behind-overflow spill. Spilled sets are replayed on startup.")
+	flag.StringVar(&listenerFlags.KeyPrefixes, "key-prefixes", "", "Optional list of prefixes added to keys sent to the proxies, separated by '|'. Entries may be blank.")
+	flag.IntVar(&hashKeysOver, "hash-keys-over", 0, "Replace keys longer than this many bytes, including the prefix, with a SHA-256 of the key. 0 disables hashing.")
+	flag.StringVar(&compression.Algorithm, "compression", "", "Compress values sent to HTTP backends with gzip, zstd or snappy. Off by default.")
+	flag.IntVar(&compression.Threshold, "compression-threshold", httph.DefaultCompressionThreshold, "Minimum size in bytes of values to compress")
+	flag.BoolVar(&compression.ContentEncoding, "content-encoding", false, "Send gzip encoded set bodies to HTTP backends that advertise support for it")
+	flag.StringVar(&checksum.Algorithm, "checksum", "", "Store a crc32c or xxhash checksum with each value and verify it on get. Off by default.")
+	flag.BoolVar(&checksum.MismatchIsError, "checksum-mismatch-error", false, "Return an error instead of a miss when a checksum doesn't match")
+	flag.StringVar(&encryption.KeyDir, "encryption-key-dir", "", "Directory of hex encoded AES keys named <id>.key used to encrypt values sent to HTTP backends. Off by default.")
+	flag.StringVar(&encryption.ActiveKeyID, "encryption-key-id", "", "Id of the key in --encryption-key-dir used to encrypt new values")
+	flag.IntVar(&chunkSize, "chunk-size", 0, "Split values larger than this many bytes across multiple backend keys. 0 disables chunking.")
+	flag.IntVar(&limits.OpsPerSec, "limit-ops-per-sec", 0, "Requests per second allowed on each listener, counting each key of a multiget. 0 means no limit. Can be changed per listener through /config.")
+	flag.IntVar(&limits.BytesPerSec, "limit-bytes-per-sec", 0, "Value bytes per second sent and received on each listener. 0 means no limit. Can be changed per listener through /config.")
+	flag.IntVar(&limits.MaxInFlight, "limit-max-in-flight", 0, "Requests in progress at once on each listener. 0 means no limit. Can be changed per listener through /config.")
+	flag.StringVar(&adaptiveLimit.Algorithm, "adaptive-limit", "", "Limit requests in flight to each HTTP backend with a limit that follows its latency, adapted with aimd or gradient. Off by default.")
+	flag.IntVar(&adaptiveLimit.InitialLimit, "adaptive-limit-initial", httph.DefaultInitialLimit, "Requests in flight allowed to each HTTP backend before the adaptive limit has adapted")
+	flag.IntVar(&adaptiveLimit.MinLimit, "adaptive-limit-min", httph.DefaultMinLimit, "Lowest the adaptive limit can go")
+	flag.IntVar(&adaptiveLimit.MaxLimit, "adaptive-limit-max", httph.DefaultMaxLimit, "Highest the adaptive limit can go")
+	flag.DurationVar(&adaptiveLimit.Timeout, "adaptive-limit-timeout", httph.DefaultLimitTimeout, "Round trip time beyond which a request to an HTTP backend counts as failed by the adaptive limit")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Longest to wait on SIGINT or SIGTERM for commands in progress to finish and queued writes to be flushed")
+	flag.IntVar(&maxValueSize, "max-value-size", httph.DefaultMaxValueSize, "Largest value in bytes accepted from clients or read back from HTTP backends")
 
-	flag.StringVar(&listenPortsStr, "listen-ports", "", "List of TCP ports to proxy from, separated by '|'")
-	flag.StringVar(&proxyHostsStr, "proxy-hosts", "", "List of hostnames to proxy to, separated by '|'")
-	flag.StringVar(&proxyPortsStr, "proxy-ports", "", "List of ports to proxy to, separated by '|'")
-	flag.StringVar(&cacheNamesStr, "cache-names", "", "List of cache names to proxy to, separated by '|'")
+}
 
-	flag.Parse()
+// loadListeners reads the listeners from the config file, or from the
+// per-listener flags without one
+func loadListeners() ([]proxyconf.Listener, error) {
+	if configFile == "" {
+		return proxyconf.FromFlags(listenerFlags)
+	}
 
-	if len(listenPortsStr) == 0 || len(proxyHostsStr) == 0 || len(proxyPortsStr) == 0 || len(cacheNamesStr) == 0 {
-		log.Fatalln("Error: Must provide all params: --listen-ports, --proxy-hosts, --proxy-ports, --cache-names.")
+	f := listenerFlags
+	if f.ListenPorts != "" || f.ProxyHosts != "" || f.ProxyPorts != "" || f.CacheNames != "" {
+		return nil, errors.New("--config can't be combined with --listen-ports, --proxy-hosts, --proxy-ports or --cache-names")
 	}
 
-	// Trim any quotes off of the args
-	trimQuotes := func(r rune) bool { return r == '"' }
+	c, err := proxyconf.Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return c.Listeners, nil
+}
+
+// resolve fills in a target's host and port from the listener's backend
+func resolve(l proxyconf.Listener, t proxyconf.Target) proxyconf.Target {
+	if t.Host == "" {
+		t.Host = l.Backend.Host
+	}
+	if t.Port == 0 {
+		t.Port = l.Backend.Port
+	}
+	return t
+}
 
-	listenPortsStr = strings.TrimFunc(listenPortsStr, trimQuotes)
-	proxyHostsStr = strings.TrimFunc(proxyHostsStr, trimQuotes)
-	proxyPortsStr = strings.TrimFunc(proxyPortsStr, trimQuotes)
-	cacheNamesStr = strings.TrimFunc(cacheNamesStr, trimQuotes)
+// httpOptions merges a listener's features over the ones set by flags. role
+// names the backend within the listener, for its spill file.
+func httpOptions(l proxyconf.Listener, t proxyconf.Target, role string) httph.Options {
+	opts := httph.Options{
+		Compression:   compression,
+		Encryption:    encryption,
+		Checksum:      checksum,
+		ChunkSize:     chunkSize,
+		MaxValueSize:  maxValueSize,
+		WriteBehind:   writeBehind,
+		AdaptiveLimit: adaptiveLimit,
+		Timeout:       l.Backend.Timeout.Duration,
+	}
+	if l.Backend.Retry != nil {
+		opts.NumTries = l.Backend.Retry.Tries
+		opts.RetryDelayMultiplier = l.Backend.Retry.DelayMultiplier
+	}
 
-	listenPortsParts := strings.Split(listenPortsStr, "|")
-	listenPorts := make([]int, len(listenPortsParts))
-	for i, p := range listenPortsParts {
-		trimmed := strings.TrimSpace(p)
-		if len(trimmed) == 0 {
-			log.Fatalln("Error: Invalid ports; must not have blank entries.")
-		}
-		temp, err := strconv.Atoi(trimmed)
-		if err != nil {
-			log.Fatalf("Error: Invalid port: %s", trimmed)
+	dir := spillDir
+	f := l.Features
+	if f.Compression != nil {
+		opts.Compression = httph.CompressionOptions(*f.Compression)
+	}
+	if f.Checksum != nil {
+		opts.Checksum = httph.ChecksumOptions(*f.Checksum)
+	}
+	if f.Encryption != nil {
+		opts.Encryption = httph.EncryptionOptions(*f.Encryption)
+	}
+	if f.ChunkSize != nil {
+		opts.ChunkSize = *f.ChunkSize
+	}
+	if f.MaxValueSize != nil {
+		opts.MaxValueSize = *f.MaxValueSize
+	}
+	if w := f.WriteBehind; w != nil {
+		opts.WriteBehind = httph.WriteBehindOptions{QueueSize: w.QueueSize, Workers: w.Workers, Overflow: w.Overflow}
+		dir = w.SpillDir
+	}
+	if a := f.AdaptiveLimit; a != nil {
+		opts.AdaptiveLimit = httph.AdaptiveLimitOptions{
+			Algorithm:    a.Algorithm,
+			InitialLimit: a.InitialLimit,
+			MinLimit:     a.MinLimit,
+			MaxLimit:     a.MaxLimit,
+			Timeout:      a.Timeout.Duration,
 		}
-		listenPorts[i] = temp
 	}
 
-	proxyHosts := strings.Split(proxyHostsStr, "|")
-	for i, u := range proxyHosts {
-		proxyHosts[i] = strings.TrimSpace(u)
-		if len(proxyHosts[i]) == 0 {
-			log.Fatalln("Error:Invalid domain sockets; must not have blank entries.")
+	if dir != "" {
+		// One file per backend, even where several go to the same cache
+		opts.WriteBehind.SpillFile = filepath.Join(dir, fmt.Sprintf("%d_%s_%s_%d_%s.spill", l.Port, role, t.Host, t.Port, t.Cache))
+	}
+
+	return opts
+}
+
+// Roles of the backends of a listener besides its routes, which are named by
+// routeRole
+const (
+	roleCache  = "cache"
+	roleShadow = "shadow"
+)
+
+func routeRole(i int) string {
+	return fmt.Sprintf("route%d", i)
+}
+
+// newBackend creates the handler for one cache of a listener, flushing its
+// background work when b is retired. Gets that miss or fail are sent to the
+// fallback cache, if there is one. The role names the backend within the
+// listener; all but the shadow count toward readiness.
+func newBackend(b *reload.Backend, l proxyconf.Listener, t proxyconf.Target, fallback *proxyconf.Target, role string) (handlers.HandlerConst, error) {
+	var h handlers.HandlerConst
+	var err error
+
+	// the most bytes the backend handler adds to keys
+	var reserve int
+
+	t = resolve(l, t)
+
+	switch l.Backend.Type {
+	case "grpc":
+		if fallback != nil {
+			return nil, errors.New("fallbacks are only supported for HTTP backends")
+		}
+		gopts := grpch.Options{Timeout: l.Backend.Timeout.Duration}
+		if l.Backend.Retry != nil {
+			gopts.NumTries = l.Backend.Retry.Tries
+			gopts.RetryDelayMultiplier = l.Backend.Retry.DelayMultiplier
+		}
+		if h, err = grpch.NewWithOptions(fmt.Sprintf("%s:%d", t.Host, t.Port), t.Cache, gopts); err != nil {
+			return nil, err
+		}
+
+		// The constructor always returns the same singleton
+		singleton, _ := h()
+		gh := singleton.(*grpch.Handler)
+		b.OnRetire(func() {
+			if err := gh.Shutdown(); err != nil {
+				log.Printf("Error: closing connection to %s:%d: %v\n", t.Host, t.Port, err)
+			}
+		})
+		if role != roleShadow {
+			b.OnRetire(checker.AddBackend(t.Cache, fmt.Sprintf("%s:%d", t.Host, t.Port), gh))
+		}
+	default:
+		opts := httpOptions(l, t, role)
+		if opts.ChunkSize > 0 {
+			reserve = httph.MaxChunkKeySuffix
+		}
+		if opts.Dialect, err = httph.DialectByName(l.Backend.Dialect, t.Cache); err != nil {
+			return nil, err
+		}
+		if fallback != nil {
+			fb := resolve(l, *fallback)
+			opts.Fallback = httph.FallbackOptions{
+				Host:       fb.Host,
+				Port:       fb.Port,
+				Cache:      fb.Cache,
+				ReadRepair: readRepair,
+				RepairTTL:  uint32(readRepairTTL),
+				MaxRepairs: maxRepairs,
+			}
+			if r := l.Features.ReadRepair; r != nil {
+				opts.Fallback.ReadRepair = r.Enabled
+				opts.Fallback.RepairTTL = uint32(r.TTL.Seconds())
+			}
+			if opts.Fallback.Dialect, err = httph.DialectByName(l.Backend.Dialect, fb.Cache); err != nil {
+				return nil, err
+			}
+		}
+		if h, err = httph.NewWithOptions(t.Host, t.Port, t.Cache, opts); err != nil {
+			return nil, err
+		}
+
+		// The constructor always returns the same singleton
+		singleton, _ := h()
+		hh := singleton.(*httph.Handler)
+		b.OnRetire(func() {
+			hh.Drain()
+			hh.Shutdown()
+		})
+		if role != roleShadow {
+			b.OnRetire(checker.AddBackend(t.Cache, fmt.Sprintf("%s:%d", t.Host, t.Port), hh))
 		}
 	}
 
-	proxyPortsParts := strings.Split(proxyPortsStr, "|")
-	proxyPorts := make([]int, len(proxyPortsParts))
-	for i, p := range proxyPortsParts {
-		trimmed := strings.TrimSpace(p)
-		if len(trimmed) == 0 {
-			log.Fatalln("Error: Invalid proxy ports; must not have blank entries.")
+	// Keys are rewritten after routing so routes match the keys clients use
+	hashOver := hashKeysOver
+	if l.Features.HashKeysOver != nil {
+		hashOver = *l.Features.HashKeysOver
+	}
+	if l.KeyPrefix != "" || hashOver > 0 {
+		h, err = namespace.New(h, namespace.Options{Prefix: l.KeyPrefix, HashOver: hashOver, Reserve: reserve})
+	}
+
+	return h, err
+}
+
+// protocols maps a listener's protocol names to rend's, all of them if none
+// are given
+func protocols(names []string) []protocol.Components {
+	if len(names) == 0 {
+		return []protocol.Components{binprot.Components, textprot.Components}
+	}
+
+	ret := make([]protocol.Components, len(names))
+	for i, name := range names {
+		if name == "text" {
+			ret[i] = textprot.Components
+		} else {
+			ret[i] = binprot.Components
 		}
-		temp, err := strconv.Atoi(trimmed)
+	}
+	return ret
+}
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if checker, err = health.New(healthOpts); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	http.Handle("/healthz", http.HandlerFunc(checker.Healthz))
+	http.Handle("/readyz", http.HandlerFunc(checker.Readyz))
+
+	// Orchestrators check health without credentials
+	adminOpts.Public = []string{"/healthz", "/readyz"}
+	adminServer, err := admin.New(http.DefaultServeMux, adminOpts)
+	if err != nil {
+		log.Fatalf("Error: admin endpoints: %v", err)
+	}
+	config.SetIdentity(admin.Identity)
+	config.OnChange(func(who string, keys []config.KeyChange) {
+		admin.Audit(who, "config", keys)
+	})
+	if auditLog != "" {
+		f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 		if err != nil {
-			log.Fatalf("Error: Invalid port: %s", trimmed)
+			log.Fatalf("Error: could not open the audit log: %v", err)
 		}
-		proxyPorts[i] = temp
+		admin.SetAuditLog(f)
 	}
 
-	cacheNames := strings.Split(cacheNamesStr, "|")
-	for i, u := range cacheNames {
-		cacheNames[i] = strings.TrimSpace(u)
-		if len(cacheNames[i]) == 0 {
-			log.Fatalln("Error:Invalid domain sockets; must not have blank entries.")
+	if configStore != "" {
+		if err := config.Persist(configStore); err != nil {
+			log.Fatalf("Error: could not load the config store: %v", err)
 		}
 	}
 
-	if len(listenPorts) != len(proxyHosts) || len(listenPorts) != len(proxyPorts) || len(listenPorts) != len(cacheNames) {
-		log.Fatalf("Error: all lists must match in length. Got %d listen ports, %d proxy hosts, %d proxy ports, %d cache names\n",
-			len(listenPorts), len(proxyHosts), len(proxyPorts), len(cacheNames))
+	listeners, err := loadListeners()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if _, err := apply(&proxyconf.Config{Listeners: listeners}); err != nil {
+		log.Fatalf("Error: %v", err)
 	}
 
-	for i := 0; i < len(listenPorts); i++ {
-		pis = append(pis, proxyinfo{
-			listenPort: listenPorts[i],
-			proxyHost:  proxyHosts[i],
-			proxyPort:  proxyPorts[i],
-			cacheName:  cacheNames[i],
-		})
+	// http debug, metrics and config endpoint
+	go func() {
+		log.Printf("Error: admin endpoints: %v\n", adminServer.ListenAndServe())
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %v, shutting down\n", sig)
+			break
+		}
+		log.Println("Received SIGHUP, reloading")
+		if _, err := reloadConfig(); err != nil {
+			log.Printf("Error: reload failed: %v\n", err)
+		}
 	}
-}
 
-func main() {
-	for _, pi := range pis {
-		largs := server.ListenArgs{
-			Type: server.ListenTCP,
-			Port: pi.listenPort,
+	stopReloads()
+	checker.SetDraining()
+
+	go func() {
+		for sig := range sigs {
+			if sig != syscall.SIGHUP {
+				log.Println("Received a second signal, exiting without waiting")
+				os.Exit(1)
+			}
 		}
+	}()
 
-		go server.ListenAndServe(
-			largs,
-			[]protocol.Components{binprot.Components, textprot.Components},
-			server.Default,
-			orcas.L1Only,
-			httph.New(pi.proxyHost, pi.proxyPort, pi.cacheName),
-			handlers.NilHandler,
-		)
+	// The listeners can't be closed, so new connections are accepted and then
+	// hung up on until the process exits
+	if err := shutdownGate.Shutdown(shutdownTimeout); err != nil {
+		log.Printf("Error: %v after %v\n", err, shutdownTimeout)
+		os.Exit(1)
 	}
 
-	runtime.Goexit()
+	log.Println("Shut down cleanly")
+	os.Exit(0)
 }
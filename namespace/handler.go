@@ -0,0 +1,273 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package namespace isolates the keys of applications sharing a cache by
+// rewriting keys on their way to another handler and back.
+package namespace
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricKeysHashed = metrics.AddCounter("keys_hashed", nil)
+)
+
+// hashMarker follows the prefix in hashed keys. Client keys that start with it
+// are always hashed so they can't collide with the hash of another key.
+const hashMarker = "sha256:"
+
+// hashedLen is the length of a hashed key, not counting the prefix
+var hashedLen = len(hashMarker) + base64.RawURLEncoding.EncodedLen(sha256.Size)
+
+// Options configures how keys are rewritten
+type Options struct {
+	// Prefix is added to every key sent to the backend and removed from keys
+	// in responses
+	Prefix string
+
+	// HashOver is the longest key, including the prefix, sent to the backend
+	// as-is. Longer keys are replaced with the prefix and a SHA-256 of the key,
+	// which is hashedLen bytes. Zero disables hashing.
+	HashOver int
+
+	// Reserve is the most bytes the inner handler adds to a key, such as
+	// httph.MaxChunkKeySuffix when values are chunked. Keys are hashed when
+	// they would be longer than HashOver with that many bytes added, so the
+	// keys the backend sees stay within HashOver.
+	Reserve int
+}
+
+// Handler rewrites keys and passes requests on to another handler
+type Handler struct {
+	inner    handlers.Handler
+	prefix   []byte
+	hashOver int
+}
+
+// New creates a handler constructor that wraps the handlers made by inner. An
+// error is returned if hashed keys, with Reserve added, would still be longer
+// than HashOver.
+func New(inner handlers.HandlerConst, opts Options) (handlers.HandlerConst, error) {
+	if opts.HashOver < 0 || opts.Reserve < 0 {
+		return nil, fmt.Errorf("invalid key hashing length %d or reserve %d", opts.HashOver, opts.Reserve)
+	}
+	if opts.HashOver > 0 && opts.HashOver < len(opts.Prefix)+hashedLen+opts.Reserve {
+		return nil, fmt.Errorf("key hashing length %d is shorter than a hashed key with prefix %q and %d bytes reserved (%d bytes)",
+			opts.HashOver, opts.Prefix, opts.Reserve, len(opts.Prefix)+hashedLen+opts.Reserve)
+	}
+
+	prefix := []byte(opts.Prefix)
+
+	// Keys are compared against what is left once the reserve is taken
+	hashOver := opts.HashOver
+	if hashOver > 0 {
+		hashOver -= opts.Reserve
+	}
+
+	return func() (handlers.Handler, error) {
+		h, err := inner()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Handler{
+			inner:    h,
+			prefix:   prefix,
+			hashOver: hashOver,
+		}, nil
+	}, nil
+}
+
+// rewrite returns the key as it is stored on the backend
+func (h *Handler) rewrite(key []byte) []byte {
+	if h.hashOver > 0 && (len(h.prefix)+len(key) > h.hashOver || bytes.HasPrefix(key, []byte(hashMarker))) {
+		metrics.IncCounter(MetricKeysHashed)
+
+		sum := sha256.Sum256(key)
+		out := make([]byte, len(h.prefix)+hashedLen)
+		n := copy(out, h.prefix)
+		n += copy(out[n:], hashMarker)
+		base64.RawURLEncoding.Encode(out[n:], sum[:])
+		return out
+	}
+
+	if len(h.prefix) == 0 {
+		return key
+	}
+
+	out := make([]byte, len(h.prefix)+len(key))
+	copy(out, h.prefix)
+	copy(out[len(h.prefix):], key)
+	return out
+}
+
+// rewriteAll rewrites the keys of a multiget and returns a map to look up the
+// original key of each rewritten one, since hashed keys can't be reversed
+func (h *Handler) rewriteAll(keys [][]byte) ([][]byte, map[string][]byte) {
+	rewritten := make([][]byte, len(keys))
+	originals := make(map[string][]byte, len(keys))
+
+	for i, key := range keys {
+		rewritten[i] = h.rewrite(key)
+		originals[string(rewritten[i])] = key
+	}
+
+	return rewritten, originals
+}
+
+// Set rewrites the key and passes the request on
+func (h *Handler) Set(cmd common.SetRequest) error {
+	cmd.Key = h.rewrite(cmd.Key)
+	return h.inner.Set(cmd)
+}
+
+// Add rewrites the key and passes the request on
+func (h *Handler) Add(cmd common.SetRequest) error {
+	cmd.Key = h.rewrite(cmd.Key)
+	return h.inner.Add(cmd)
+}
+
+// Replace rewrites the key and passes the request on
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	cmd.Key = h.rewrite(cmd.Key)
+	return h.inner.Replace(cmd)
+}
+
+// Append rewrites the key and passes the request on
+func (h *Handler) Append(cmd common.SetRequest) error {
+	cmd.Key = h.rewrite(cmd.Key)
+	return h.inner.Append(cmd)
+}
+
+// Prepend rewrites the key and passes the request on
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	cmd.Key = h.rewrite(cmd.Key)
+	return h.inner.Prepend(cmd)
+}
+
+// Delete rewrites the key and passes the request on
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	cmd.Key = h.rewrite(cmd.Key)
+	return h.inner.Delete(cmd)
+}
+
+// Touch rewrites the key and passes the request on
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	cmd.Key = h.rewrite(cmd.Key)
+	return h.inner.Touch(cmd)
+}
+
+// GAT rewrites the key and passes the request on, restoring the key in the
+// response
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	key := cmd.Key
+	cmd.Key = h.rewrite(cmd.Key)
+
+	res, err := h.inner.GAT(cmd)
+	res.Key = key
+	return res, err
+}
+
+// Get rewrites the keys and passes the request on, restoring the keys in the
+// responses
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	var originals map[string][]byte
+	cmd.Keys, originals = h.rewriteAll(cmd.Keys)
+
+	dataIn, errorIn := h.inner.Get(cmd)
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+				res.Key = originals[string(res.Key)]
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				// Handlers stop at the first error and may not close the
+				// channel after it
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE rewrites the keys and passes the request on, restoring the keys in the
+// responses
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	var originals map[string][]byte
+	cmd.Keys, originals = h.rewriteAll(cmd.Keys)
+
+	dataIn, errorIn := h.inner.GetE(cmd)
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+				res.Key = originals[string(res.Key)]
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				// Handlers stop at the first error and may not close the
+				// channel after it
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// Close closes the wrapped handler
+func (h *Handler) Close() error {
+	return h.inner.Close()
+}
@@ -0,0 +1,229 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package namespace_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend-http/namespace"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// memHandler is a handler that keeps items in a map
+type memHandler struct {
+	data map[string]string
+}
+
+func (m *memHandler) Set(cmd common.SetRequest) error {
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *memHandler) Add(cmd common.SetRequest) error     { return common.ErrUnknownCmd }
+func (m *memHandler) Replace(cmd common.SetRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Append(cmd common.SetRequest) error  { return common.ErrUnknownCmd }
+func (m *memHandler) Prepend(cmd common.SetRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Touch(cmd common.TouchRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Close() error                        { return nil }
+
+func (m *memHandler) Delete(cmd common.DeleteRequest) error {
+	if _, ok := m.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(m.data, string(cmd.Key))
+	return nil
+}
+
+func (m *memHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	for _, key := range cmd.Keys {
+		data, ok := m.data[string(key)]
+		dataOut <- common.GetResponse{Key: key, Data: []byte(data), Miss: !ok}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (m *memHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	return nil, errchan
+}
+
+func (m *memHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	data, ok := m.data[string(cmd.Key)]
+	return common.GetResponse{Key: cmd.Key, Data: []byte(data), Miss: !ok}, nil
+}
+
+func setup(t *testing.T, opts namespace.Options) (*memHandler, handlers.Handler) {
+	m := &memHandler{data: make(map[string]string)}
+
+	hc, err := namespace.New(func() (handlers.Handler, error) { return m, nil }, opts)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	return m, h
+}
+
+func getAll(t *testing.T, h handlers.Handler, keys ...string) []common.GetResponse {
+	req := common.GetRequest{
+		Opaques: make([]uint32, len(keys)),
+		Quiet:   make([]bool, len(keys)),
+	}
+	for _, k := range keys {
+		req.Keys = append(req.Keys, []byte(k))
+	}
+
+	datchan, errchan := h.Get(req)
+
+	var ret []common.GetResponse
+	for datchan != nil || errchan != nil {
+		select {
+		case res, ok := <-datchan:
+			if !ok {
+				datchan = nil
+				continue
+			}
+			ret = append(ret, res)
+		case err, ok := <-errchan:
+			if !ok {
+				errchan = nil
+				continue
+			}
+			t.Fatalf("Failed to get: %v", err)
+		}
+	}
+
+	return ret
+}
+
+func TestPrefix(t *testing.T) {
+	m, h := setup(t, namespace.Options{Prefix: "app1:"})
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+
+	if m.data["app1:foo"] != "bar" {
+		t.Fatalf("Expected the key to be prefixed but got %v", m.data)
+	}
+
+	res := getAll(t, h, "foo", "baz")
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 responses but got %d", len(res))
+	}
+	if string(res[0].Key) != "foo" || string(res[0].Data) != "bar" || res[0].Miss {
+		t.Fatalf("Got wrong response for foo: %#v", res[0])
+	}
+	if string(res[1].Key) != "baz" || !res[1].Miss {
+		t.Fatalf("Got wrong response for baz: %#v", res[1])
+	}
+
+	gat, err := h.GAT(common.GATRequest{Key: []byte("foo")})
+	if err != nil {
+		t.Fatalf("Failed to gat: %v", err)
+	}
+	if string(gat.Key) != "foo" || string(gat.Data) != "bar" {
+		t.Fatalf("Got wrong gat response: %#v", gat)
+	}
+
+	if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if len(m.data) != 0 {
+		t.Fatalf("Expected the prefixed key to be deleted but got %v", m.data)
+	}
+}
+
+func TestHashing(t *testing.T) {
+	m, h := setup(t, namespace.Options{Prefix: "app1:", HashOver: 100})
+
+	short := "foo"
+	long := strings.Repeat("k", 200)
+
+	for _, key := range []string{short, long, "sha256:foo"} {
+		if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)}); err != nil {
+			t.Fatalf("Failed to set: %v", err)
+		}
+	}
+
+	if m.data["app1:foo"] != short {
+		t.Fatalf("Expected the short key to be stored as-is but got %v", m.data)
+	}
+
+	for k := range m.data {
+		if len(k) > 100 {
+			t.Fatalf("Key %q is longer than the limit", k)
+		}
+		if !strings.HasPrefix(k, "app1:") {
+			t.Fatalf("Key %q is missing the prefix", k)
+		}
+	}
+
+	if _, ok := m.data["app1:sha256:foo"]; ok {
+		t.Fatalf("Expected a key that looks hashed to be hashed")
+	}
+
+	res := getAll(t, h, long, short, "sha256:foo")
+	for i, key := range []string{long, short, "sha256:foo"} {
+		if string(res[i].Key) != key || string(res[i].Data) != key {
+			t.Fatalf("Got wrong response for %q: %#v", key, res[i])
+		}
+	}
+}
+
+func TestHashingReserve(t *testing.T) {
+	m, h := setup(t, namespace.Options{Prefix: "app1:", HashOver: 100, Reserve: 34})
+
+	// Fits in the limit, but not with the reserve added
+	key := strings.Repeat("k", 80)
+	if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)}); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+
+	for k := range m.data {
+		if len(k)+34 > 100 {
+			t.Fatalf("Key %q leaves no room for the reserve", k)
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	inner := func() (handlers.Handler, error) { return nil, nil }
+
+	if _, err := namespace.New(inner, namespace.Options{HashOver: -1}); err == nil {
+		t.Fatalf("Expected an error for a negative length")
+	}
+
+	if _, err := namespace.New(inner, namespace.Options{Prefix: "app1:", HashOver: 20}); err == nil {
+		t.Fatalf("Expected an error for a length too short for hashed keys")
+	}
+
+	if _, err := namespace.New(inner, namespace.Options{Prefix: "app1:", HashOver: 60, Reserve: 34}); err == nil {
+		t.Fatalf("Expected an error for a length too short for hashed keys and the reserve")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyconf
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Kinds of Change
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// Change is a difference between two configurations in the listener on a port
+type Change struct {
+	Port int
+	Kind string
+
+	// Fields are the paths of the listener's values that differ, for changed
+	// listeners
+	Fields []string
+}
+
+func (c Change) String() string {
+	if c.Kind == Changed {
+		return fmt.Sprintf("listener %d changed: %s", c.Port, strings.Join(c.Fields, ", "))
+	}
+	return fmt.Sprintf("listener %d %s", c.Port, c.Kind)
+}
+
+// Diff lists the listeners added, removed and changed going from old to new,
+// ordered by port. Listeners are matched up by port.
+func Diff(old, new *Config) []Change {
+	before := make(map[int]Listener)
+	for _, l := range old.Listeners {
+		before[l.Port] = l
+	}
+
+	var changes []Change
+	for _, l := range new.Listeners {
+		prev, ok := before[l.Port]
+		delete(before, l.Port)
+
+		if !ok {
+			changes = append(changes, Change{Port: l.Port, Kind: Added})
+		} else if fields := diffFields(prev, l); len(fields) > 0 {
+			changes = append(changes, Change{Port: l.Port, Kind: Changed, Fields: fields})
+		}
+	}
+	for port := range before {
+		changes = append(changes, Change{Port: port, Kind: Removed})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Port < changes[j].Port })
+	return changes
+}
+
+// diffFields returns the paths, as written in the file, of the fields that
+// differ between two listeners. The backend and features are broken down a
+// level further, like "backend.timeout".
+func diffFields(a, b Listener) []string {
+	return diffStruct("", reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+func diffStruct(prefix string, a, b reflect.Value) []string {
+	var fields []string
+
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fa, fb := a.Field(i), b.Field(i)
+		if reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			continue
+		}
+
+		name := prefix + t.Field(i).Tag.Get("yaml")
+		switch fa.Type() {
+		case reflect.TypeOf(Backend{}), reflect.TypeOf(Features{}):
+			fields = append(fields, diffStruct(name+".", fa, fb)...)
+		default:
+			fields = append(fields, name)
+		}
+	}
+
+	return fields
+}
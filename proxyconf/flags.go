@@ -0,0 +1,235 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyconf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Flags are the command line lists describing listeners. Each is separated by
+// '|' and lined up with ListenPorts. The first four are required; the rest
+// are optional, and entries in KeyPrefixes, Routes, Shadows and Fallbacks may
+// be blank.
+type Flags struct {
+	ListenPorts string
+	ProxyHosts  string
+	ProxyPorts  string
+	CacheNames  string
+	Dialects    string
+	Backends    string
+	KeyPrefixes string
+	Routes      string
+	Shadows     string
+	Fallbacks   string
+}
+
+// FromFlags builds the listeners described by the command line lists. Problems
+// are reported together in a *ValidationError, with paths naming the flag and
+// entry, like "--proxy-ports[1]".
+func FromFlags(f Flags) ([]Listener, error) {
+	v := &validator{}
+
+	// Lists may be quoted as a whole
+	unquote := func(s string) string {
+		return strings.Trim(s, `"`)
+	}
+
+	// split splits a list into trimmed entries, checking it has one per
+	// listener
+	split := func(flag, list string, n int) []string {
+		entries := strings.Split(unquote(list), "|")
+		for i := range entries {
+			entries[i] = strings.TrimSpace(entries[i])
+		}
+		if n >= 0 && len(entries) != n {
+			v.errorf(flag, "has %d entries but --listen-ports has %d", len(entries), n)
+			return nil
+		}
+		return entries
+	}
+
+	required := func(flag, list string, n int) []string {
+		if unquote(list) == "" {
+			v.errorf(flag, "is required")
+			return nil
+		}
+		entries := split(flag, list, n)
+		for i, e := range entries {
+			if e == "" {
+				v.errorf(fmt.Sprintf("%s[%d]", flag, i), "must not be blank")
+			}
+		}
+		return entries
+	}
+
+	ports := func(flag string, entries []string) []int {
+		ret := make([]int, len(entries))
+		for i, e := range entries {
+			if e == "" {
+				continue
+			}
+			p, err := strconv.Atoi(e)
+			if err != nil {
+				v.errorf(fmt.Sprintf("%s[%d]", flag, i), "invalid port %q", e)
+			}
+			ret[i] = p
+		}
+		return ret
+	}
+
+	listenPorts := ports("--listen-ports", required("--listen-ports", f.ListenPorts, -1))
+	n := len(listenPorts)
+	if n == 0 {
+		// Without ports nothing else can be lined up
+		n = -1
+	}
+
+	proxyHosts := required("--proxy-hosts", f.ProxyHosts, n)
+	proxyPorts := ports("--proxy-ports", required("--proxy-ports", f.ProxyPorts, n))
+	cacheNames := required("--cache-names", f.CacheNames, n)
+
+	// optional parses an optional list, calling parse for each non-blank entry
+	optional := func(flag, list string, parse func(i int, entry string) error) {
+		if unquote(list) == "" || n < 0 {
+			return
+		}
+		for i, e := range split(flag, list, n) {
+			if e == "" {
+				continue
+			}
+			if err := parse(i, e); err != nil {
+				v.errorf(fmt.Sprintf("%s[%d]", flag, i), "%v", err)
+			}
+		}
+	}
+
+	ls := make([]Listener, len(listenPorts))
+	optional("--dialects", f.Dialects, func(i int, e string) error {
+		ls[i].Backend.Dialect = e
+		return nil
+	})
+	optional("--backends", f.Backends, func(i int, e string) error {
+		ls[i].Backend.Type = e
+		return nil
+	})
+	optional("--key-prefixes", f.KeyPrefixes, func(i int, e string) error {
+		ls[i].KeyPrefix = e
+		return nil
+	})
+	optional("--routes", f.Routes, func(i int, e string) (err error) {
+		ls[i].Routes, err = parseRoutes(e)
+		return err
+	})
+	optional("--shadows", f.Shadows, func(i int, e string) error {
+		t, err := parseTarget(e)
+		ls[i].Shadow = &Shadow{Target: t}
+		return err
+	})
+	optional("--fallbacks", f.Fallbacks, func(i int, e string) error {
+		t, err := parseTarget(e)
+		ls[i].Fallback = &t
+		return err
+	})
+
+	if len(v.errs) > 0 {
+		return nil, &ValidationError{Errors: v.errs}
+	}
+
+	for i := range ls {
+		ls[i].Port = listenPorts[i]
+		ls[i].Cache = cacheNames[i]
+		ls[i].Backend.Host = proxyHosts[i]
+		ls[i].Backend.Port = proxyPorts[i]
+		if ls[i].Backend.Type == "" {
+			ls[i].Backend.Type = "http"
+		}
+	}
+
+	// The same checks as a config file, for anything the lists let through
+	if err := (&Config{Listeners: ls}).Validate(); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// parseTarget parses a cache of the form CACHE[@host:port]. Without a host and
+// port the target is on the listener's backend.
+func parseTarget(target string) (Target, error) {
+	t := Target{Cache: target}
+
+	if at := strings.Index(target, "@"); at >= 0 {
+		t.Cache = target[:at]
+
+		h, p, err := net.SplitHostPort(target[at+1:])
+		if err != nil {
+			return Target{}, err
+		}
+		if t.Port, err = strconv.Atoi(p); err != nil {
+			return Target{}, fmt.Errorf("bad port %s", p)
+		}
+		t.Host = h
+	}
+
+	if len(t.Cache) == 0 {
+		return Target{}, errors.New("missing cache name")
+	}
+
+	return t, nil
+}
+
+// parseRoutes parses a comma separated list of routes of the form
+// match=CACHE[@host:port]. A match wrapped in slashes is a regexp, otherwise
+// it is a key prefix. Routes without a host and port use the listener's.
+func parseRoutes(spec string) ([]Route, error) {
+	var routes []Route
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		eq := strings.LastIndex(entry, "=")
+		if eq <= 0 || eq == len(entry)-1 {
+			return nil, fmt.Errorf("invalid route %q, expected match=CACHE[@host:port]", entry)
+		}
+
+		match := entry[:eq]
+		r := Route{}
+
+		var err error
+		if r.Target, err = parseTarget(entry[eq+1:]); err != nil {
+			return nil, fmt.Errorf("invalid route %q: %v", entry, err)
+		}
+
+		if len(match) > 2 && strings.HasPrefix(match, "/") && strings.HasSuffix(match, "/") {
+			r.Regexp = match[1 : len(match)-1]
+			if _, err := regexp.Compile(r.Regexp); err != nil {
+				return nil, fmt.Errorf("invalid route %q: %v", entry, err)
+			}
+		} else {
+			r.Prefix = match
+		}
+
+		routes = append(routes, r)
+	}
+
+	return routes, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyconf_test
+
+import (
+	"testing"
+
+	"github.com/netflix/rend-http/proxyconf"
+)
+
+func TestFromFlags(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		ls, err := proxyconf.FromFlags(proxyconf.Flags{
+			ListenPorts: `"11211|11212"`,
+			ProxyHosts:  "localhost | other",
+			ProxyPorts:  "8080|9090",
+			CacheNames:  "A|B",
+			Dialects:    "kv|",
+			Backends:    "http|grpc",
+			KeyPrefixes: "app:|",
+			Routes:      "a:=C,/^b/=D@other:7070|",
+			Shadows:     "|E",
+			Fallbacks:   "F|",
+		})
+		if err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		if len(ls) != 2 {
+			t.Fatalf("Expected 2 listeners but got %d", len(ls))
+		}
+
+		l := ls[0]
+		if l.Port != 11211 || l.Cache != "A" || l.KeyPrefix != "app:" {
+			t.Fatalf("Wrong listener: %#v", l)
+		}
+		if l.Backend != (proxyconf.Backend{Type: "http", Host: "localhost", Port: 8080, Dialect: "kv"}) {
+			t.Fatalf("Wrong backend: %#v", l.Backend)
+		}
+		if len(l.Routes) != 2 || l.Routes[0].Prefix != "a:" || l.Routes[0].Cache != "C" ||
+			l.Routes[1].Regexp != "^b" || l.Routes[1].Host != "other" || l.Routes[1].Port != 7070 {
+			t.Fatalf("Wrong routes: %#v", l.Routes)
+		}
+		if l.Shadow != nil || l.Fallback == nil || l.Fallback.Cache != "F" || l.Fallback.Host != "" {
+			t.Fatalf("Wrong shadow or fallback: %#v, %#v", l.Shadow, l.Fallback)
+		}
+
+		l = ls[1]
+		if l.Port != 11212 || l.Backend.Host != "other" || l.Backend.Type != "grpc" || l.Backend.Dialect != "" {
+			t.Fatalf("Wrong listener: %#v", l)
+		}
+		if l.Shadow == nil || l.Shadow.Cache != "E" || l.Fallback != nil || len(l.Routes) != 0 {
+			t.Fatalf("Wrong shadow, fallback or routes: %#v", l)
+		}
+	})
+
+	valid := proxyconf.Flags{
+		ListenPorts: "11211|11212",
+		ProxyHosts:  "localhost|localhost",
+		ProxyPorts:  "8080|8080",
+		CacheNames:  "A|B",
+	}
+
+	tests := []struct {
+		name  string
+		edit  func(f *proxyconf.Flags)
+		paths []string
+	}{
+		{
+			name:  "Missing",
+			edit:  func(f *proxyconf.Flags) { f.ListenPorts, f.CacheNames = "", `""` },
+			paths: []string{"--listen-ports", "--cache-names"},
+		},
+		{
+			name: "MismatchedLengths",
+			edit: func(f *proxyconf.Flags) {
+				f.ProxyHosts = "localhost"
+				f.Dialects = "kv|kv|kv"
+				f.Shadows = "C"
+			},
+			paths: []string{"--proxy-hosts", "--dialects", "--shadows"},
+		},
+		{
+			name:  "BlankEntries",
+			edit:  func(f *proxyconf.Flags) { f.ListenPorts, f.CacheNames = "11211| ", "|B" },
+			paths: []string{"--listen-ports[1]", "--cache-names[0]"},
+		},
+		{
+			name:  "BadPorts",
+			edit:  func(f *proxyconf.Flags) { f.ListenPorts, f.ProxyPorts = "11211|x", "8080|80a" },
+			paths: []string{"--listen-ports[1]", "--proxy-ports[1]"},
+		},
+		{
+			name:  "PortsOutOfRange",
+			edit:  func(f *proxyconf.Flags) { f.ListenPorts = "0|11212" },
+			paths: []string{"listeners[0].port"},
+		},
+		{
+			name:  "DuplicatePorts",
+			edit:  func(f *proxyconf.Flags) { f.ListenPorts = "11211|11211" },
+			paths: []string{"listeners[1].port"},
+		},
+		{
+			name: "BadTargets",
+			edit: func(f *proxyconf.Flags) {
+				f.Routes = "a:=|/(/=C"
+				f.Fallbacks = "@host:1|C@host:port"
+			},
+			paths: []string{"--routes[0]", "--routes[1]", "--fallbacks[0]", "--fallbacks[1]"},
+		},
+		{
+			name:  "BadNames",
+			edit:  func(f *proxyconf.Flags) { f.Dialects, f.Backends = "soap|kv", "http|thrift" },
+			paths: []string{"listeners[0].backend.dialect", "listeners[1].backend.type"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := valid
+			test.edit(&f)
+
+			_, err := proxyconf.FromFlags(f)
+			verr, ok := err.(*proxyconf.ValidationError)
+			if !ok {
+				t.Fatalf("Expected a validation error but got %v", err)
+			}
+			if len(verr.Errors) != len(test.paths) {
+				t.Fatalf("Expected %d errors but got %v", len(test.paths), verr)
+			}
+			for i, path := range test.paths {
+				if verr.Errors[i].Path != path {
+					t.Fatalf("Expected error %d to be for %s but got %v", i, path, verr.Errors[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxyconf reads the listeners the proxy serves and the backends
+// behind them from a YAML or JSON file. A file looks like:
+//
+//	listeners:
+//	  - port: 11211
+//	    cache: MY_CACHE
+//	    backend:
+//	      host: localhost
+//	      port: 8080
+//	      timeout: 500ms
+//	      retry:
+//	        tries: 3
+//	    features:
+//	      compression:
+//	        algorithm: zstd
+//
+// Features left out of a listener fall back to the proxy's command line flags.
+package proxyconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole configuration file
+type Config struct {
+	Listeners []Listener `yaml:"listeners" json:"listeners"`
+}
+
+// Listener is a memcached port and the caches it serves
+type Listener struct {
+	Port int `yaml:"port" json:"port"`
+
+	// Protocols are the memcached protocols accepted, "binary" and "text".
+	// Empty means both.
+	Protocols []string `yaml:"protocols" json:"protocols"`
+
+	// Cache is the cache served by the listener's backend
+	Cache   string  `yaml:"cache" json:"cache"`
+	Backend Backend `yaml:"backend" json:"backend"`
+
+	// KeyPrefix is added to every key sent to the backends
+	KeyPrefix string `yaml:"keyPrefix" json:"keyPrefix"`
+
+	// Routes send matching keys to other caches, see the routing section of
+	// the README
+	Routes []Route `yaml:"routes" json:"routes"`
+
+	// Shadow mirrors writes to a secondary cache
+	Shadow *Shadow `yaml:"shadow" json:"shadow"`
+
+	// Fallback is read from when the backend misses or fails
+	Fallback *Target `yaml:"fallback" json:"fallback"`
+
+	Features Features `yaml:"features" json:"features"`
+}
+
+// Backend is the proxy a listener's caches are reached through
+type Backend struct {
+	// Type is "http" (the default) or "grpc"
+	Type string `yaml:"type" json:"type"`
+	Host string `yaml:"host" json:"host"`
+	Port int    `yaml:"port" json:"port"`
+
+	// Dialect is the REST API of HTTP backends, "evcache" (the default) or "kv"
+	Dialect string `yaml:"dialect" json:"dialect"`
+
+	// Timeout bounds each request to the backend. Zero means no timeout.
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+
+	// Retry overrides the numTries and retryDelayMultiplier dynamic config
+	Retry *Retry `yaml:"retry" json:"retry"`
+}
+
+// Retry is how failed requests to a backend are retried
+type Retry struct {
+	// Tries is the number of attempts, including the first
+	Tries int `yaml:"tries" json:"tries"`
+
+	// DelayMultiplier is the wait in milliseconds before the second try. Each
+	// try after that waits that much longer again. Zero means the dynamic
+	// config.
+	DelayMultiplier int `yaml:"delayMultiplier" json:"delayMultiplier"`
+}
+
+// Target is a cache other than the listener's own. Host and port default to
+// the listener's backend.
+type Target struct {
+	Cache string `yaml:"cache" json:"cache"`
+	Host  string `yaml:"host" json:"host"`
+	Port  int    `yaml:"port" json:"port"`
+}
+
+// Route sends keys with a prefix, or matching a regular expression, to
+// another cache. Exactly one of Prefix and Regexp must be set.
+type Route struct {
+	Prefix string `yaml:"prefix" json:"prefix"`
+	Regexp string `yaml:"regexp" json:"regexp"`
+	Target `yaml:",inline"`
+}
+
+// Shadow is a secondary cache writes are mirrored to
+type Shadow struct {
+	Target `yaml:",inline"`
+
+	// QueueSize and CompareRate are as in shadow.Options. Zero means the
+	// --shadow-queue-size and --shadow-compare-rate flags.
+	QueueSize   int     `yaml:"queueSize" json:"queueSize"`
+	CompareRate float64 `yaml:"compareRate" json:"compareRate"`
+}
+
+// Features toggles the optional behavior of a listener. Each one that is
+// left out takes its value from the command line flags. An empty algorithm or
+// key directory turns a feature off for the listener.
+type Features struct {
+	Compression   *Compression   `yaml:"compression" json:"compression"`
+	Checksum      *Checksum      `yaml:"checksum" json:"checksum"`
+	Encryption    *Encryption    `yaml:"encryption" json:"encryption"`
+	ChunkSize     *int           `yaml:"chunkSize" json:"chunkSize"`
+	MaxValueSize  *int           `yaml:"maxValueSize" json:"maxValueSize"`
+	HashKeysOver  *int           `yaml:"hashKeysOver" json:"hashKeysOver"`
+	ReadRepair    *ReadRepair    `yaml:"readRepair" json:"readRepair"`
+	WriteBehind   *WriteBehind   `yaml:"writeBehind" json:"writeBehind"`
+	Limits        *Limits        `yaml:"limits" json:"limits"`
+	AdaptiveLimit *AdaptiveLimit `yaml:"adaptiveLimit" json:"adaptiveLimit"`
+}
+
+// Compression is as in httph.CompressionOptions
+type Compression struct {
+	Algorithm       string `yaml:"algorithm" json:"algorithm"`
+	Threshold       int    `yaml:"threshold" json:"threshold"`
+	ContentEncoding bool   `yaml:"contentEncoding" json:"contentEncoding"`
+}
+
+// Checksum is as in httph.ChecksumOptions
+type Checksum struct {
+	Algorithm       string `yaml:"algorithm" json:"algorithm"`
+	MismatchIsError bool   `yaml:"mismatchIsError" json:"mismatchIsError"`
+}
+
+// Encryption is as in httph.EncryptionOptions
+type Encryption struct {
+	KeyDir      string `yaml:"keyDir" json:"keyDir"`
+	ActiveKeyID string `yaml:"activeKeyID" json:"activeKeyID"`
+}
+
+// ReadRepair copies values found on the fallback back into the listener's
+// cache with the given TTL
+type ReadRepair struct {
+	Enabled bool     `yaml:"enabled" json:"enabled"`
+	TTL     Duration `yaml:"ttl" json:"ttl"`
+}
+
+// WriteBehind is as in httph.WriteBehindOptions, with spill files kept in
+// SpillDir
+type WriteBehind struct {
+	QueueSize int    `yaml:"queueSize" json:"queueSize"`
+	Workers   int    `yaml:"workers" json:"workers"`
+	Overflow  string `yaml:"overflow" json:"overflow"`
+	SpillDir  string `yaml:"spillDir" json:"spillDir"`
+}
+
+// Limits is as in limit.Options
+type Limits struct {
+	OpsPerSec   int `yaml:"opsPerSec" json:"opsPerSec"`
+	BytesPerSec int `yaml:"bytesPerSec" json:"bytesPerSec"`
+	MaxInFlight int `yaml:"maxInFlight" json:"maxInFlight"`
+}
+
+// AdaptiveLimit is as in httph.AdaptiveLimitOptions
+type AdaptiveLimit struct {
+	Algorithm    string   `yaml:"algorithm" json:"algorithm"`
+	InitialLimit int      `yaml:"initialLimit" json:"initialLimit"`
+	MinLimit     int      `yaml:"minLimit" json:"minLimit"`
+	MaxLimit     int      `yaml:"maxLimit" json:"maxLimit"`
+	Timeout      Duration `yaml:"timeout" json:"timeout"`
+}
+
+// Duration is a time.Duration written like "500ms" or "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"500ms\"")
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	d.Duration = v
+	return nil
+}
+
+// Load reads and validates a configuration file. Files ending in .json are
+// read as JSON and everything else as YAML. Unknown fields are errors, and
+// invalid values are reported together in a *ValidationError.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Parse(data, strings.EqualFold(filepath.Ext(path), ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Parse reads and validates a configuration from JSON or YAML
+func Parse(data []byte, isJSON bool) (*Config, error) {
+	c := &Config{}
+
+	if isJSON {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, jsonError(data, err)
+		}
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// jsonError adds the line and column to JSON syntax and type errors
+func jsonError(data []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err
+	}
+
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d, column %d: %v", line, col, err)
+}
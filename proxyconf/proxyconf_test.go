@@ -0,0 +1,360 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyconf_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/proxyconf"
+)
+
+const yamlConfig = `
+listeners:
+  - port: 11211
+    protocols: [binary]
+    cache: MY_CACHE
+    backend:
+      type: http
+      host: localhost
+      port: 8080
+      timeout: 500ms
+      retry:
+        tries: 5
+        delayMultiplier: 20
+    routes:
+      - prefix: "a:"
+        cache: A
+      - regexp: "^b"
+        cache: B
+        host: other
+        port: 9090
+    shadow:
+      cache: SHADOW
+      compareRate: 0.5
+    features:
+      compression:
+        algorithm: zstd
+      chunkSize: 1024
+      readRepair:
+        enabled: true
+        ttl: 1m
+  - port: 11212
+    cache: OTHER
+    backend:
+      type: grpc
+      host: localhost
+      port: 9000
+`
+
+const jsonConfig = `{
+  "listeners": [{
+    "port": 11211,
+    "cache": "MY_CACHE",
+    "backend": {"host": "localhost", "port": 8080, "timeout": "2s"},
+    "features": {"limits": {"opsPerSec": 100}}
+  }]
+}`
+
+func TestParse(t *testing.T) {
+	t.Run("YAML", func(t *testing.T) {
+		c, err := proxyconf.Parse([]byte(yamlConfig), false)
+		if err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		if len(c.Listeners) != 2 {
+			t.Fatalf("Expected 2 listeners but got %d", len(c.Listeners))
+		}
+
+		l := c.Listeners[0]
+		if l.Port != 11211 || l.Cache != "MY_CACHE" || len(l.Protocols) != 1 || l.Protocols[0] != "binary" {
+			t.Fatalf("Wrong listener: %#v", l)
+		}
+		if l.Backend.Timeout.Duration != 500*time.Millisecond {
+			t.Fatalf("Expected a 500ms timeout but got %v", l.Backend.Timeout)
+		}
+		if l.Backend.Retry == nil || l.Backend.Retry.Tries != 5 || l.Backend.Retry.DelayMultiplier != 20 {
+			t.Fatalf("Wrong retry: %#v", l.Backend.Retry)
+		}
+		if len(l.Routes) != 2 || l.Routes[0].Prefix != "a:" || l.Routes[0].Cache != "A" ||
+			l.Routes[1].Regexp != "^b" || l.Routes[1].Host != "other" || l.Routes[1].Port != 9090 {
+			t.Fatalf("Wrong routes: %#v", l.Routes)
+		}
+		if l.Shadow == nil || l.Shadow.Cache != "SHADOW" || l.Shadow.CompareRate != 0.5 {
+			t.Fatalf("Wrong shadow: %#v", l.Shadow)
+		}
+		if l.Fallback != nil {
+			t.Fatalf("Expected no fallback but got %#v", l.Fallback)
+		}
+
+		f := l.Features
+		if f.Compression == nil || f.Compression.Algorithm != "zstd" {
+			t.Fatalf("Wrong compression: %#v", f.Compression)
+		}
+		if f.ChunkSize == nil || *f.ChunkSize != 1024 {
+			t.Fatalf("Wrong chunk size: %v", f.ChunkSize)
+		}
+		if f.ReadRepair == nil || !f.ReadRepair.Enabled || f.ReadRepair.TTL.Duration != time.Minute {
+			t.Fatalf("Wrong read repair: %#v", f.ReadRepair)
+		}
+		if f.Checksum != nil || f.MaxValueSize != nil || f.WriteBehind != nil {
+			t.Fatalf("Expected features left out to be nil: %#v", f)
+		}
+
+		if c.Listeners[1].Backend.Type != "grpc" {
+			t.Fatalf("Expected a grpc backend but got %q", c.Listeners[1].Backend.Type)
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		c, err := proxyconf.Parse([]byte(jsonConfig), true)
+		if err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		l := c.Listeners[0]
+		if l.Backend.Timeout.Duration != 2*time.Second {
+			t.Fatalf("Expected a 2s timeout but got %v", l.Backend.Timeout)
+		}
+		if l.Features.Limits == nil || l.Features.Limits.OpsPerSec != 100 {
+			t.Fatalf("Wrong limits: %#v", l.Features.Limits)
+		}
+	})
+
+	t.Run("UnknownFields", func(t *testing.T) {
+		if _, err := proxyconf.Parse([]byte(strings.Replace(yamlConfig, "chunkSize", "chunkSzie", 1)), false); err == nil {
+			t.Fatalf("Expected an error for an unknown YAML field")
+		}
+		if _, err := proxyconf.Parse([]byte(strings.Replace(jsonConfig, `"port": 8080`, `"prot": 8080`, 1)), true); err == nil {
+			t.Fatalf("Expected an error for an unknown JSON field")
+		}
+	})
+
+	t.Run("BadDuration", func(t *testing.T) {
+		_, err := proxyconf.Parse([]byte(strings.Replace(jsonConfig, `"2s"`, `"2 seconds"`, 1)), true)
+		if err == nil || !strings.Contains(err.Error(), "invalid duration") {
+			t.Fatalf("Expected an invalid duration error but got %v", err)
+		}
+
+		_, err = proxyconf.Parse([]byte(strings.Replace(jsonConfig, `"2s"`, `2`, 1)), true)
+		if err == nil {
+			t.Fatalf("Expected an error for a duration that isn't a string")
+		}
+	})
+
+	t.Run("SyntaxErrorPosition", func(t *testing.T) {
+		_, err := proxyconf.Parse([]byte("{\n  \"listeners\": [,]\n}"), true)
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2, column") {
+			t.Fatalf("Expected the error to have a line and column but got %v", err)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		paths  []string
+	}{
+		{
+			name:   "NoListeners",
+			config: `listeners: []`,
+			paths:  []string{"listeners"},
+		},
+		{
+			name: "MissingFields",
+			config: `
+listeners:
+  - port: 0
+    backend: {port: 70000}
+`,
+			paths: []string{"listeners[0].port", "listeners[0].cache", "listeners[0].backend.host", "listeners[0].backend.port"},
+		},
+		{
+			name: "DuplicatePorts",
+			config: `
+listeners:
+  - {port: 1, cache: A, backend: {host: h, port: 1}}
+  - {port: 1, cache: B, backend: {host: h, port: 1}}
+`,
+			paths: []string{"listeners[1].port"},
+		},
+		{
+			name: "Enumerations",
+			config: `
+listeners:
+  - port: 1
+    protocols: [binary, ascii]
+    cache: A
+    backend: {type: thrift, host: h, port: 1, dialect: soap}
+    features:
+      compression: {algorithm: lz4}
+      writeBehind: {overflow: spill}
+`,
+			paths: []string{
+				"listeners[0].protocols[1]",
+				"listeners[0].backend.type",
+				"listeners[0].backend.dialect",
+				"listeners[0].features.compression.algorithm",
+				"listeners[0].features.writeBehind.spillDir",
+			},
+		},
+		{
+			name: "Routes",
+			config: `
+listeners:
+  - port: 1
+    cache: A
+    backend: {host: h, port: 1}
+    routes:
+      - {cache: B}
+      - {prefix: p, regexp: r, cache: B}
+      - {regexp: "(", cache: B}
+      - {prefix: p}
+`,
+			paths: []string{
+				"listeners[0].routes[0]",
+				"listeners[0].routes[1]",
+				"listeners[0].routes[2].regexp",
+				"listeners[0].routes[3].cache",
+			},
+		},
+		{
+			name: "GRPC",
+			config: `
+listeners:
+  - port: 1
+    cache: A
+    backend: {type: grpc, host: h, port: 1, dialect: kv, retry: {tries: 0}}
+    fallback: {cache: B}
+    shadow: {cache: C, compareRate: 2}
+`,
+			paths: []string{
+				"listeners[0].backend.dialect",
+				"listeners[0].backend.retry.tries",
+				"listeners[0].shadow.compareRate",
+				"listeners[0].fallback",
+			},
+		},
+		{
+			name: "GRPCFeatures",
+			config: `
+listeners:
+  - port: 1
+    cache: A
+    backend: {type: grpc, host: h, port: 1}
+    features:
+      compression: {algorithm: gzip}
+      checksum: {algorithm: crc32c}
+      encryption: {keyDir: /keys, activeKeyID: k}
+      chunkSize: 1024
+      maxValueSize: 1024
+      hashKeysOver: 200
+      readRepair: {enabled: true}
+      writeBehind: {queueSize: 10}
+      limits: {opsPerSec: 10}
+      adaptiveLimit: {algorithm: aimd}
+`,
+			paths: []string{
+				"listeners[0].features.compression",
+				"listeners[0].features.checksum",
+				"listeners[0].features.encryption",
+				"listeners[0].features.chunkSize",
+				"listeners[0].features.maxValueSize",
+				"listeners[0].features.readRepair",
+				"listeners[0].features.writeBehind",
+				"listeners[0].features.adaptiveLimit",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := proxyconf.Parse([]byte(test.config), false)
+			verr, ok := err.(*proxyconf.ValidationError)
+			if !ok {
+				t.Fatalf("Expected a validation error but got %v", err)
+			}
+			if len(verr.Errors) != len(test.paths) {
+				t.Fatalf("Expected %d errors but got %v", len(test.paths), verr)
+			}
+			for i, path := range test.paths {
+				if verr.Errors[i].Path != path {
+					t.Fatalf("Expected error %d to be for %s but got %v", i, path, verr.Errors[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxyconf")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{"proxy.yaml": yamlConfig, "proxy.json": jsonConfig} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		if _, err := proxyconf.Load(path); err != nil {
+			t.Fatalf("Failed to load %s: %v", name, err)
+		}
+	}
+
+	_, err = proxyconf.Load(filepath.Join(dir, "missing.yaml"))
+	if err == nil {
+		t.Fatalf("Expected an error for a missing file")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old, err := proxyconf.Parse([]byte(yamlConfig), false)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	changed := strings.Replace(yamlConfig, "timeout: 500ms", "timeout: 1s", 1)
+	changed = strings.Replace(changed, "algorithm: zstd", "algorithm: gzip", 1)
+	changed = strings.Replace(changed, "port: 11212", "port: 11213", 1)
+	new, err := proxyconf.Parse([]byte(changed), false)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	changes := proxyconf.Diff(old, new)
+	want := []string{
+		"listener 11211 changed: backend.timeout, features.compression",
+		"listener 11212 removed",
+		"listener 11213 added",
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes but got %v", len(want), changes)
+	}
+	for i, w := range want {
+		if changes[i].String() != w {
+			t.Fatalf("Expected change %d to be %q but got %q", i, w, changes[i])
+		}
+	}
+
+	if changes := proxyconf.Diff(old, old); len(changes) != 0 {
+		t.Fatalf("Expected no changes but got %v", changes)
+	}
+}
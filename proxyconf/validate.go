@@ -0,0 +1,280 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxyconf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FieldError is a problem with one value in the configuration
+type FieldError struct {
+	// Path locates the value, like "listeners[1].backend.port"
+	Path string
+	Msg  string
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// ValidationError holds every problem found in a configuration
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validator collects the errors found while walking a configuration
+type validator struct {
+	errs []FieldError
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) port(path string, port int) {
+	if port < 1 || port > 65535 {
+		v.errorf(path, "must be between 1 and 65535, got %d", port)
+	}
+}
+
+// optionalPort checks a port that defaults to another one when zero
+func (v *validator) optionalPort(path string, port int) {
+	if port != 0 {
+		v.port(path, port)
+	}
+}
+
+func (v *validator) nonNegative(path string, n int) {
+	if n < 0 {
+		v.errorf(path, "must not be negative, got %d", n)
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.errorf(path, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+func (v *validator) target(path string, t Target) {
+	if t.Cache == "" {
+		v.errorf(path+".cache", "is required")
+	}
+	v.optionalPort(path+".port", t.Port)
+}
+
+// Validate checks the configuration, returning a *ValidationError listing
+// every problem or nil if there are none
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if len(c.Listeners) == 0 {
+		v.errorf("listeners", "at least one listener is required")
+	}
+
+	ports := make(map[int]int)
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		l.validate(v, path)
+
+		if j, ok := ports[l.Port]; ok {
+			v.errorf(path+".port", "port %d is already used by listeners[%d]", l.Port, j)
+		} else {
+			ports[l.Port] = i
+		}
+	}
+
+	if len(v.errs) > 0 {
+		return &ValidationError{Errors: v.errs}
+	}
+	return nil
+}
+
+func (l Listener) validate(v *validator, path string) {
+	v.port(path+".port", l.Port)
+
+	seen := make(map[string]bool)
+	for i, p := range l.Protocols {
+		ppath := fmt.Sprintf("%s.protocols[%d]", path, i)
+		v.oneOf(ppath, p, "binary", "text")
+		if seen[p] {
+			v.errorf(ppath, "protocol %q is listed twice", p)
+		}
+		seen[p] = true
+	}
+
+	if l.Cache == "" {
+		v.errorf(path+".cache", "is required")
+	}
+
+	b := l.Backend
+	bpath := path + ".backend"
+	if b.Type != "" {
+		v.oneOf(bpath+".type", b.Type, "http", "grpc")
+	}
+	if b.Host == "" {
+		v.errorf(bpath+".host", "is required")
+	}
+	v.port(bpath+".port", b.Port)
+	if b.Dialect != "" {
+		v.oneOf(bpath+".dialect", b.Dialect, "evcache", "kv")
+		if b.Type == "grpc" {
+			v.errorf(bpath+".dialect", "only applies to http backends")
+		}
+	}
+	if b.Timeout.Duration < 0 {
+		v.errorf(bpath+".timeout", "must not be negative")
+	}
+	if b.Retry != nil {
+		if b.Retry.Tries < 1 {
+			v.errorf(bpath+".retry.tries", "must be at least 1, got %d", b.Retry.Tries)
+		}
+		v.nonNegative(bpath+".retry.delayMultiplier", b.Retry.DelayMultiplier)
+	}
+
+	for i, r := range l.Routes {
+		rpath := fmt.Sprintf("%s.routes[%d]", path, i)
+		switch {
+		case r.Prefix == "" && r.Regexp == "":
+			v.errorf(rpath, "one of prefix and regexp is required")
+		case r.Prefix != "" && r.Regexp != "":
+			v.errorf(rpath, "only one of prefix and regexp may be set")
+		case r.Regexp != "":
+			if _, err := regexp.Compile(r.Regexp); err != nil {
+				v.errorf(rpath+".regexp", "%v", err)
+			}
+		}
+		v.target(rpath, r.Target)
+	}
+
+	if l.Shadow != nil {
+		v.target(path+".shadow", l.Shadow.Target)
+		v.nonNegative(path+".shadow.queueSize", l.Shadow.QueueSize)
+		if l.Shadow.CompareRate < 0 || l.Shadow.CompareRate > 1 {
+			v.errorf(path+".shadow.compareRate", "must be between 0 and 1, got %v", l.Shadow.CompareRate)
+		}
+	}
+
+	if l.Fallback != nil {
+		v.target(path+".fallback", *l.Fallback)
+		if b.Type == "grpc" {
+			v.errorf(path+".fallback", "is only supported for http backends")
+		}
+	}
+
+	l.Features.validate(v, path+".features")
+	if b.Type == "grpc" {
+		l.Features.httpOnly(v, path+".features")
+	}
+}
+
+// httpOnly rejects the features only HTTP backends have, for a gRPC backend.
+// Limits and key hashing wrap any backend.
+func (f Features) httpOnly(v *validator, path string) {
+	set := []struct {
+		name string
+		set  bool
+	}{
+		{"compression", f.Compression != nil},
+		{"checksum", f.Checksum != nil},
+		{"encryption", f.Encryption != nil},
+		{"chunkSize", f.ChunkSize != nil},
+		{"maxValueSize", f.MaxValueSize != nil},
+		{"readRepair", f.ReadRepair != nil},
+		{"writeBehind", f.WriteBehind != nil},
+		{"adaptiveLimit", f.AdaptiveLimit != nil},
+	}
+	for _, feature := range set {
+		if feature.set {
+			v.errorf(path+"."+feature.name, "is only supported for http backends")
+		}
+	}
+}
+
+func (f Features) validate(v *validator, path string) {
+	if c := f.Compression; c != nil {
+		if c.Algorithm != "" {
+			v.oneOf(path+".compression.algorithm", c.Algorithm, "gzip", "zstd", "snappy")
+		}
+		v.nonNegative(path+".compression.threshold", c.Threshold)
+	}
+
+	if c := f.Checksum; c != nil && c.Algorithm != "" {
+		v.oneOf(path+".checksum.algorithm", c.Algorithm, "crc32c", "xxhash")
+	}
+
+	if e := f.Encryption; e != nil && e.KeyDir != "" && e.ActiveKeyID == "" {
+		v.errorf(path+".encryption.activeKeyID", "is required with keyDir")
+	}
+
+	if f.ChunkSize != nil {
+		v.nonNegative(path+".chunkSize", *f.ChunkSize)
+	}
+	if f.MaxValueSize != nil {
+		v.nonNegative(path+".maxValueSize", *f.MaxValueSize)
+	}
+	if f.HashKeysOver != nil {
+		v.nonNegative(path+".hashKeysOver", *f.HashKeysOver)
+	}
+
+	if r := f.ReadRepair; r != nil && r.TTL.Duration < 0 {
+		v.errorf(path+".readRepair.ttl", "must not be negative")
+	}
+
+	if w := f.WriteBehind; w != nil {
+		v.nonNegative(path+".writeBehind.queueSize", w.QueueSize)
+		v.nonNegative(path+".writeBehind.workers", w.Workers)
+		if w.Overflow != "" {
+			v.oneOf(path+".writeBehind.overflow", w.Overflow, "drop", "block", "spill")
+		}
+		if w.Overflow == "spill" && w.SpillDir == "" {
+			v.errorf(path+".writeBehind.spillDir", "is required with the spill overflow policy")
+		}
+	}
+
+	if l := f.Limits; l != nil {
+		v.nonNegative(path+".limits.opsPerSec", l.OpsPerSec)
+		v.nonNegative(path+".limits.bytesPerSec", l.BytesPerSec)
+		v.nonNegative(path+".limits.maxInFlight", l.MaxInFlight)
+	}
+
+	if a := f.AdaptiveLimit; a != nil {
+		if a.Algorithm != "" {
+			v.oneOf(path+".adaptiveLimit.algorithm", a.Algorithm, "aimd", "gradient")
+		}
+		v.nonNegative(path+".adaptiveLimit.initialLimit", a.InitialLimit)
+		v.nonNegative(path+".adaptiveLimit.minLimit", a.MinLimit)
+		v.nonNegative(path+".adaptiveLimit.maxLimit", a.MaxLimit)
+		if a.MaxLimit > 0 && a.MinLimit > a.MaxLimit {
+			v.errorf(path+".adaptiveLimit.minLimit", "must not be more than maxLimit %d, got %d", a.MaxLimit, a.MinLimit)
+		}
+		if a.Timeout.Duration < 0 {
+			v.errorf(path+".adaptiveLimit.timeout", "must not be negative")
+		}
+	}
+}
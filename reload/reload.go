@@ -0,0 +1,348 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reload lets the backends behind a memcached listener be replaced
+// while it keeps serving. Connections stay open across a swap; each one moves
+// to the new backends at its next command, and the old backends are retired
+// once the commands still using them are done.
+package reload
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricSwaps        = metrics.AddCounter("reload_swaps", nil)
+	MetricRejectedCmds = metrics.AddCounter("reload_stopped_cmds", nil)
+)
+
+var (
+	// ErrStopped is returned instead of a handler for connections made to a
+	// stopped listener, which makes the server hang up on them
+	ErrStopped = errors.New("listener stopped")
+
+	// ErrTimeout is returned if the old backends were still busy when the
+	// deadline passed
+	ErrTimeout = errors.New("timed out retiring backends")
+)
+
+// Backend is one version of the handlers behind a listener
+type Backend struct {
+	// Handler creates the handlers for each connection
+	Handler handlers.HandlerConst
+
+	inFlight sync.WaitGroup
+	flushes  []func()
+}
+
+// OnRetire adds a function that flushes background work once the backend has
+// been replaced and its commands are done. They run in the reverse order they
+// were added, like gate.Gate's.
+func (b *Backend) OnRetire(flush func()) {
+	b.flushes = append(b.flushes, flush)
+}
+
+// Retire waits for the backend's commands and then runs its flushes. Swap does
+// this for the backend it replaces; it is only needed for backends that are
+// never swapped in.
+func (b *Backend) Retire(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		b.inFlight.Wait()
+		for i := len(b.flushes) - 1; i >= 0; i-- {
+			b.flushes[i]()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+// Listener holds the current backend of a listener. It starts out stopped.
+type Listener struct {
+	mu      sync.RWMutex
+	current *Backend
+}
+
+// Swap makes b the listener's backend and retires the previous one, waiting
+// up to timeout for it. A nil b stops the listener. On ErrTimeout the swap has
+// happened but the old backend is left to finish on its own.
+func (l *Listener) Swap(b *Backend, timeout time.Duration) error {
+	l.mu.Lock()
+	old := l.current
+	l.current = b
+	l.mu.Unlock()
+
+	metrics.IncCounter(MetricSwaps)
+
+	if old == nil {
+		return nil
+	}
+	return old.Retire(timeout)
+}
+
+// Stop turns away new connections and commands and retires the backend
+func (l *Listener) Stop(timeout time.Duration) error {
+	return l.Swap(nil, timeout)
+}
+
+// acquire returns the current backend, counting a command in progress on it
+func (l *Listener) acquire() *Backend {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	b := l.current
+	if b != nil {
+		b.inFlight.Add(1)
+	}
+	return b
+}
+
+// Handler creates a handler constructor for connections to the listener
+func (l *Listener) Handler() handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		b := l.acquire()
+		if b == nil {
+			return nil, ErrStopped
+		}
+		defer b.inFlight.Done()
+
+		inner, err := b.Handler()
+		if err != nil {
+			return nil, err
+		}
+		return &Handler{listener: l, backend: b, inner: inner}, nil
+	}
+}
+
+// Handler passes commands on to the handler for the listener's current
+// backend, replacing it when the backend is swapped. Commands made while the
+// listener is stopped fail with a server error.
+type Handler struct {
+	listener *Listener
+	backend  *Backend
+	inner    handlers.Handler
+}
+
+// enter picks the handler for a command, which must call b.inFlight.Done when
+// finished
+func (h *Handler) enter() (handlers.Handler, *Backend, error) {
+	b := h.listener.acquire()
+	if b == nil {
+		metrics.IncCounter(MetricRejectedCmds)
+		return nil, nil, common.ErrInternal
+	}
+
+	if b != h.backend {
+		// Commands on a connection are one at a time, so nothing is still
+		// using the old handler
+		if h.inner != nil {
+			h.inner.Close()
+			h.inner = nil
+		}
+
+		inner, err := b.Handler()
+		if err != nil {
+			b.inFlight.Done()
+			return nil, nil, common.ErrInternal
+		}
+		h.inner = inner
+		h.backend = b
+	}
+
+	return h.inner, b, nil
+}
+
+// Set passes the set on to the current backend
+func (h *Handler) Set(cmd common.SetRequest) error {
+	inner, b, err := h.enter()
+	if err != nil {
+		return err
+	}
+	defer b.inFlight.Done()
+	return inner.Set(cmd)
+}
+
+// Add passes the add on to the current backend
+func (h *Handler) Add(cmd common.SetRequest) error {
+	inner, b, err := h.enter()
+	if err != nil {
+		return err
+	}
+	defer b.inFlight.Done()
+	return inner.Add(cmd)
+}
+
+// Replace passes the replace on to the current backend
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	inner, b, err := h.enter()
+	if err != nil {
+		return err
+	}
+	defer b.inFlight.Done()
+	return inner.Replace(cmd)
+}
+
+// Append passes the append on to the current backend
+func (h *Handler) Append(cmd common.SetRequest) error {
+	inner, b, err := h.enter()
+	if err != nil {
+		return err
+	}
+	defer b.inFlight.Done()
+	return inner.Append(cmd)
+}
+
+// Prepend passes the prepend on to the current backend
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	inner, b, err := h.enter()
+	if err != nil {
+		return err
+	}
+	defer b.inFlight.Done()
+	return inner.Prepend(cmd)
+}
+
+// Delete passes the delete on to the current backend
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	inner, b, err := h.enter()
+	if err != nil {
+		return err
+	}
+	defer b.inFlight.Done()
+	return inner.Delete(cmd)
+}
+
+// Touch passes the touch on to the current backend
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	inner, b, err := h.enter()
+	if err != nil {
+		return err
+	}
+	defer b.inFlight.Done()
+	return inner.Touch(cmd)
+}
+
+// GAT passes the get-and-touch on to the current backend
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	inner, b, err := h.enter()
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+	defer b.inFlight.Done()
+	return inner.GAT(cmd)
+}
+
+// Get passes the get on to the current backend. The backend is busy until all
+// of its responses have been read.
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	inner, b, err := h.enter()
+	if err != nil {
+		errorOut := make(chan error, 1)
+		errorOut <- err
+		return nil, errorOut
+	}
+
+	dataIn, errorIn := inner.Get(cmd)
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+		defer b.inFlight.Done()
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE passes the get on to the current backend. The backend is busy until all
+// of its responses have been read.
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	inner, b, err := h.enter()
+	if err != nil {
+		errorOut := make(chan error, 1)
+		errorOut <- err
+		return nil, errorOut
+	}
+
+	dataIn, errorIn := inner.GetE(cmd)
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+		defer b.inFlight.Done()
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// Close closes the handler for the backend last used
+func (h *Handler) Close() error {
+	if h.inner == nil {
+		return nil
+	}
+	return h.inner.Close()
+}
@@ -0,0 +1,243 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reload_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend-http/reload"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// memHandler is a handler that keeps items in a map
+type memHandler struct {
+	sync.Mutex
+	data   map[string]string
+	closed int
+
+	// if set, sets signal started and wait for block to be closed
+	started chan struct{}
+	block   chan struct{}
+}
+
+func newMemHandler() *memHandler {
+	return &memHandler{data: make(map[string]string)}
+}
+
+func (m *memHandler) Set(cmd common.SetRequest) error {
+	if m.block != nil {
+		m.started <- struct{}{}
+		<-m.block
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *memHandler) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	m.closed++
+	return nil
+}
+
+func (m *memHandler) Delete(cmd common.DeleteRequest) error { return common.ErrKeyNotFound }
+func (m *memHandler) Add(cmd common.SetRequest) error       { return common.ErrUnknownCmd }
+func (m *memHandler) Replace(cmd common.SetRequest) error   { return common.ErrUnknownCmd }
+func (m *memHandler) Append(cmd common.SetRequest) error    { return common.ErrUnknownCmd }
+func (m *memHandler) Prepend(cmd common.SetRequest) error   { return common.ErrUnknownCmd }
+func (m *memHandler) Touch(cmd common.TouchRequest) error   { return common.ErrUnknownCmd }
+
+func (m *memHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	m.Lock()
+	defer m.Unlock()
+
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	for _, key := range cmd.Keys {
+		data, ok := m.data[string(key)]
+		dataOut <- common.GetResponse{Key: key, Data: []byte(data), Miss: !ok}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (m *memHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	return nil, errchan
+}
+
+func (m *memHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{}, common.ErrUnknownCmd
+}
+
+func backend(m *memHandler) *reload.Backend {
+	return &reload.Backend{Handler: func() (handlers.Handler, error) { return m, nil }}
+}
+
+func connect(t *testing.T, l *reload.Listener) handlers.Handler {
+	h, err := l.Handler()()
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	return h
+}
+
+func set(h handlers.Handler, key string) error {
+	return h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)})
+}
+
+func get(h handlers.Handler, key string) <-chan common.GetResponse {
+	datchan, _ := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	return datchan
+}
+
+func TestSwap(t *testing.T) {
+	t.Run("MovesConnections", func(t *testing.T) {
+		m1, m2 := newMemHandler(), newMemHandler()
+		l := &reload.Listener{}
+		l.Swap(backend(m1), time.Second)
+
+		h := connect(t, l)
+		if err := set(h, "a"); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+
+		if err := l.Swap(backend(m2), time.Second); err != nil {
+			t.Fatalf("Swap failed: %v", err)
+		}
+		if err := set(h, "b"); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+
+		if _, ok := m1.data["b"]; ok {
+			t.Fatalf("Expected the set after the swap to skip the old backend")
+		}
+		if _, ok := m2.data["b"]; !ok {
+			t.Fatalf("Expected the set after the swap to go to the new backend")
+		}
+		if m1.closed != 1 {
+			t.Fatalf("Expected the old handler to be closed once but was closed %d times", m1.closed)
+		}
+	})
+
+	t.Run("WaitsForCommands", func(t *testing.T) {
+		m1 := newMemHandler()
+		m1.started = make(chan struct{})
+		m1.block = make(chan struct{})
+
+		l := &reload.Listener{}
+		b := backend(m1)
+		var flushed bool
+		b.OnRetire(func() {
+			m1.Lock()
+			defer m1.Unlock()
+			flushed = m1.data["a"] == "a"
+		})
+		l.Swap(b, time.Second)
+
+		h := connect(t, l)
+		setDone := make(chan error)
+		go func() { setDone <- set(h, "a") }()
+		<-m1.started
+
+		m2 := newMemHandler()
+		m2.data["x"] = "x"
+		swapDone := make(chan error)
+		go func() { swapDone <- l.Swap(backend(m2), time.Second) }()
+
+		// New connections go to the new backend while the old one finishes
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			if res := <-get(connect(t, l), "x"); !res.Miss {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("New connections never went to the new backend")
+			}
+		}
+
+		select {
+		case <-swapDone:
+			t.Fatalf("Swap finished while a command was in progress")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(m1.block)
+		if err := <-setDone; err != nil {
+			t.Fatalf("Set in progress failed: %v", err)
+		}
+		if err := <-swapDone; err != nil {
+			t.Fatalf("Swap failed: %v", err)
+		}
+		if !flushed {
+			t.Fatalf("Expected the flush to run after the set in progress")
+		}
+	})
+
+	t.Run("WaitsForGets", func(t *testing.T) {
+		l := &reload.Listener{}
+		l.Swap(backend(newMemHandler()), time.Second)
+
+		datchan := get(connect(t, l), "a")
+
+		if err := l.Swap(backend(newMemHandler()), 20*time.Millisecond); err != reload.ErrTimeout {
+			t.Fatalf("Expected the swap to wait for the unread get but got %v", err)
+		}
+		for range datchan {
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		l := &reload.Listener{}
+		if _, err := l.Handler()(); err != reload.ErrStopped {
+			t.Fatalf("Expected a new listener to be stopped but got %v", err)
+		}
+
+		l.Swap(backend(newMemHandler()), time.Second)
+		h := connect(t, l)
+
+		if err := l.Stop(time.Second); err != nil {
+			t.Fatalf("Stop failed: %v", err)
+		}
+		if _, err := l.Handler()(); err != reload.ErrStopped {
+			t.Fatalf("Expected new connections to be turned away but got %v", err)
+		}
+		if err := set(h, "a"); err != common.ErrInternal {
+			t.Fatalf("Expected commands to be turned away but got %v", err)
+		}
+
+		// Started again, the same connection carries on
+		m := newMemHandler()
+		l.Swap(backend(m), time.Second)
+		if err := set(h, "a"); err != nil {
+			t.Fatalf("Set after restarting failed: %v", err)
+		}
+		if _, ok := m.data["a"]; !ok {
+			t.Fatalf("Expected the set to go to the new backend")
+		}
+	})
+}
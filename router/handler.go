@@ -0,0 +1,356 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package router sends each key to one of several handlers based on a routing
+// table, so one listener can serve keys from multiple caches.
+package router
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdGetSplits    = metrics.AddCounter("cmd_get_splits", nil)
+	MetricCmdGetMisrouted = metrics.AddCounter("cmd_get_misrouted", nil)
+)
+
+// Route sends the keys it matches to a handler. Exactly one of Prefix and
+// Regexp is set.
+type Route struct {
+	Prefix  string
+	Regexp  *regexp.Regexp
+	Handler handlers.HandlerConst
+}
+
+func (r Route) matches(key []byte) bool {
+	if r.Regexp != nil {
+		return r.Regexp.Match(key)
+	}
+	return bytes.HasPrefix(key, []byte(r.Prefix))
+}
+
+// Handler routes each request to the handler of the first route that matches
+// its key, or to the default handler if none do
+type Handler struct {
+	routes   []Route
+	handlers []handlers.Handler
+	def      handlers.Handler
+}
+
+// New creates a handler constructor for a routing table. Routes are tried in
+// order and keys that match none go to def.
+func New(routes []Route, def handlers.HandlerConst) (handlers.HandlerConst, error) {
+	if def == nil {
+		return nil, errors.New("a default route is required")
+	}
+	for _, r := range routes {
+		if r.Handler == nil {
+			return nil, errors.New("route has no handler")
+		}
+		if (r.Prefix == "") == (r.Regexp == nil) {
+			return nil, errors.New("route needs exactly one of a prefix or a regexp")
+		}
+	}
+
+	return func() (handlers.Handler, error) {
+		h := &Handler{
+			routes:   routes,
+			handlers: make([]handlers.Handler, len(routes)),
+		}
+
+		var err error
+		if h.def, err = def(); err != nil {
+			return nil, err
+		}
+		for i, r := range routes {
+			if h.handlers[i], err = r.Handler(); err != nil {
+				return nil, err
+			}
+		}
+
+		return h, nil
+	}, nil
+}
+
+// route returns the handler for a key
+func (h *Handler) route(key []byte) handlers.Handler {
+	for i, r := range h.routes {
+		if r.matches(key) {
+			return h.handlers[i]
+		}
+	}
+	return h.def
+}
+
+// group is the part of a multiget going to one handler, with the positions
+// of its keys in the original request
+type group struct {
+	handler handlers.Handler
+	idxs    []int
+}
+
+// split groups the keys of a multiget by the handler they route to
+func (h *Handler) split(keys [][]byte) []*group {
+	var groups []*group
+	byHandler := make(map[handlers.Handler]*group)
+
+	for i, key := range keys {
+		rh := h.route(key)
+		g, ok := byHandler[rh]
+		if !ok {
+			g = &group{handler: rh}
+			byHandler[rh] = g
+			groups = append(groups, g)
+		}
+		g.idxs = append(g.idxs, i)
+	}
+
+	return groups
+}
+
+func subRequest(cmd common.GetRequest, idxs []int) common.GetRequest {
+	sub := common.GetRequest{
+		Keys:       make([][]byte, len(idxs)),
+		Opaques:    make([]uint32, len(idxs)),
+		Quiet:      make([]bool, len(idxs)),
+		NoopOpaque: cmd.NoopOpaque,
+		NoopEnd:    cmd.NoopEnd,
+	}
+
+	for i, idx := range idxs {
+		sub.Keys[i] = cmd.Keys[idx]
+		sub.Opaques[i] = cmd.Opaques[idx]
+		sub.Quiet[i] = cmd.Quiet[idx]
+	}
+
+	return sub
+}
+
+// errMisrouted is reported when a handler doesn't return exactly one response
+// per key, which would put responses in the wrong places
+var errMisrouted = errors.New("handler returned the wrong number of responses")
+
+// Set routes the request by key
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.route(cmd.Key).Set(cmd)
+}
+
+// Add routes the request by key
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.route(cmd.Key).Add(cmd)
+}
+
+// Replace routes the request by key
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.route(cmd.Key).Replace(cmd)
+}
+
+// Append routes the request by key
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.route(cmd.Key).Append(cmd)
+}
+
+// Prepend routes the request by key
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.route(cmd.Key).Prepend(cmd)
+}
+
+// Delete routes the request by key
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	return h.route(cmd.Key).Delete(cmd)
+}
+
+// Touch routes the request by key
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	return h.route(cmd.Key).Touch(cmd)
+}
+
+// GAT routes the request by key
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return h.route(cmd.Key).GAT(cmd)
+}
+
+// Get sends a multiget whose keys all route to one handler straight to it.
+// Otherwise the multiget is split by handler, the parts are run concurrently
+// and the responses are put back in the order of the original keys.
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	groups := h.split(cmd.Keys)
+	if len(groups) == 0 {
+		return h.def.Get(cmd)
+	}
+	if len(groups) == 1 {
+		return groups[0].handler.Get(cmd)
+	}
+
+	metrics.IncCounter(MetricCmdGetSplits)
+
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		results := make([]common.GetResponse, len(cmd.Keys))
+		errs := make(chan error, len(groups))
+		wg := &sync.WaitGroup{}
+
+		for _, g := range groups {
+			wg.Add(1)
+			go func(g *group) {
+				defer wg.Done()
+
+				dataIn, errorIn := g.handler.Get(subRequest(cmd, g.idxs))
+				n := 0
+
+				for dataIn != nil || errorIn != nil {
+					select {
+					case res, ok := <-dataIn:
+						if !ok {
+							dataIn = nil
+							continue
+						}
+						if n < len(g.idxs) {
+							results[g.idxs[n]] = res
+						}
+						n++
+
+					case err, ok := <-errorIn:
+						if !ok {
+							errorIn = nil
+							continue
+						}
+						errs <- err
+						return
+					}
+				}
+
+				if n != len(g.idxs) {
+					metrics.IncCounter(MetricCmdGetMisrouted)
+					errs <- errMisrouted
+				}
+			}(g)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		// nil if there were no errors
+		if err := <-errs; err != nil {
+			errorOut <- err
+			return
+		}
+
+		for _, res := range results {
+			dataOut <- res
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE is routed like Get
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	groups := h.split(cmd.Keys)
+	if len(groups) == 0 {
+		return h.def.GetE(cmd)
+	}
+	if len(groups) == 1 {
+		return groups[0].handler.GetE(cmd)
+	}
+
+	metrics.IncCounter(MetricCmdGetSplits)
+
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		results := make([]common.GetEResponse, len(cmd.Keys))
+		errs := make(chan error, len(groups))
+		wg := &sync.WaitGroup{}
+
+		for _, g := range groups {
+			wg.Add(1)
+			go func(g *group) {
+				defer wg.Done()
+
+				dataIn, errorIn := g.handler.GetE(subRequest(cmd, g.idxs))
+				n := 0
+
+				for dataIn != nil || errorIn != nil {
+					select {
+					case res, ok := <-dataIn:
+						if !ok {
+							dataIn = nil
+							continue
+						}
+						if n < len(g.idxs) {
+							results[g.idxs[n]] = res
+						}
+						n++
+
+					case err, ok := <-errorIn:
+						if !ok {
+							errorIn = nil
+							continue
+						}
+						errs <- err
+						return
+					}
+				}
+
+				if n != len(g.idxs) {
+					metrics.IncCounter(MetricCmdGetMisrouted)
+					errs <- errMisrouted
+				}
+			}(g)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		// nil if there were no errors
+		if err := <-errs; err != nil {
+			errorOut <- err
+			return
+		}
+
+		for _, res := range results {
+			dataOut <- res
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// Close closes all of the routed handlers
+func (h *Handler) Close() error {
+	err := h.def.Close()
+	for _, rh := range h.handlers {
+		if cerr := rh.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,248 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router_test
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend-http/router"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// memHandler is a handler that keeps items in a map
+type memHandler struct {
+	sync.Mutex
+	data map[string]string
+	fail bool
+}
+
+func newMemHandler() *memHandler {
+	return &memHandler{data: make(map[string]string)}
+}
+
+func (m *memHandler) hc() handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return m, nil }
+}
+
+func (m *memHandler) Set(cmd common.SetRequest) error {
+	m.Lock()
+	defer m.Unlock()
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *memHandler) Add(cmd common.SetRequest) error     { return common.ErrUnknownCmd }
+func (m *memHandler) Replace(cmd common.SetRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Append(cmd common.SetRequest) error  { return common.ErrUnknownCmd }
+func (m *memHandler) Prepend(cmd common.SetRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Touch(cmd common.TouchRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Delete(cmd common.DeleteRequest) error {
+	return common.ErrUnknownCmd
+}
+func (m *memHandler) Close() error { return nil }
+
+func (m *memHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		for i, key := range cmd.Keys {
+			if m.fail {
+				errorOut <- common.ErrInternal
+				return
+			}
+
+			m.Lock()
+			data, ok := m.data[string(key)]
+			m.Unlock()
+
+			dataOut <- common.GetResponse{
+				Key:    key,
+				Data:   []byte(data),
+				Miss:   !ok,
+				Opaque: cmd.Opaques[i],
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (m *memHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	return nil, errchan
+}
+
+func (m *memHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{}, common.ErrUnknownCmd
+}
+
+type backends struct {
+	user, session, misc *memHandler
+}
+
+func setup(t *testing.T) (backends, handlers.Handler) {
+	b := backends{
+		user:    newMemHandler(),
+		session: newMemHandler(),
+		misc:    newMemHandler(),
+	}
+
+	hc, err := router.New([]router.Route{
+		{Prefix: "user:", Handler: b.user.hc()},
+		{Regexp: regexp.MustCompile(`^sess[0-9]+$`), Handler: b.session.hc()},
+	}, b.misc.hc())
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	return b, h
+}
+
+func getAll(h handlers.Handler, keys ...string) ([]common.GetResponse, error) {
+	req := common.GetRequest{Quiet: make([]bool, len(keys))}
+	for i, k := range keys {
+		req.Keys = append(req.Keys, []byte(k))
+		req.Opaques = append(req.Opaques, uint32(i))
+	}
+
+	datchan, errchan := h.Get(req)
+
+	var ret []common.GetResponse
+	for datchan != nil || errchan != nil {
+		select {
+		case res, ok := <-datchan:
+			if !ok {
+				datchan = nil
+				continue
+			}
+			ret = append(ret, res)
+		case err, ok := <-errchan:
+			if !ok {
+				errchan = nil
+				continue
+			}
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+func TestRouting(t *testing.T) {
+	b, h := setup(t)
+
+	for _, key := range []string{"user:1", "sess42", "other", "session"} {
+		if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)}); err != nil {
+			t.Fatalf("Failed to set: %v", err)
+		}
+	}
+
+	if _, ok := b.user.data["user:1"]; !ok || len(b.user.data) != 1 {
+		t.Fatalf("Wrong keys routed by prefix: %v", b.user.data)
+	}
+	if _, ok := b.session.data["sess42"]; !ok || len(b.session.data) != 1 {
+		t.Fatalf("Wrong keys routed by regexp: %v", b.session.data)
+	}
+	if len(b.misc.data) != 2 {
+		t.Fatalf("Wrong keys routed to the default: %v", b.misc.data)
+	}
+}
+
+func TestMultiget(t *testing.T) {
+	t.Run("SplitAndReassembled", func(t *testing.T) {
+		_, h := setup(t)
+
+		for _, key := range []string{"user:1", "user:2", "sess1", "other"} {
+			if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)}); err != nil {
+				t.Fatalf("Failed to set: %v", err)
+			}
+		}
+
+		keys := []string{"other", "user:1", "sess1", "missing", "user:2", "sess2"}
+		res, err := getAll(h, keys...)
+		if err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+
+		if len(res) != len(keys) {
+			t.Fatalf("Expected %d responses but got %d", len(keys), len(res))
+		}
+
+		for i, key := range keys {
+			if string(res[i].Key) != key || res[i].Opaque != uint32(i) {
+				t.Fatalf("Response %d is out of order: %#v", i, res[i])
+			}
+
+			miss := key == "missing" || key == "sess2"
+			if res[i].Miss != miss {
+				t.Fatalf("Expected miss to be %v for %q", miss, key)
+			}
+			if !miss && string(res[i].Data) != key {
+				t.Fatalf("Got wrong data for %q: %q", key, res[i].Data)
+			}
+		}
+	})
+
+	t.Run("SingleRoute", func(t *testing.T) {
+		b, h := setup(t)
+		b.user.data["user:1"] = "a"
+
+		res, err := getAll(h, "user:1", "user:2")
+		if err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+		if len(res) != 2 || string(res[0].Data) != "a" || !res[1].Miss {
+			t.Fatalf("Got wrong responses: %#v", res)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		b, h := setup(t)
+		b.session.fail = true
+
+		if res, err := getAll(h, "user:1", "sess1", "other"); err == nil {
+			t.Fatalf("Expected an error but got %#v", res)
+		}
+	})
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	m := newMemHandler()
+
+	if _, err := router.New(nil, nil); err == nil {
+		t.Fatalf("Expected an error without a default route")
+	}
+
+	if _, err := router.New([]router.Route{{Handler: m.hc()}}, m.hc()); err == nil {
+		t.Fatalf("Expected an error for a route with no prefix or regexp")
+	}
+
+	if _, err := router.New([]router.Route{{Prefix: "a"}}, m.hc()); err == nil {
+		t.Fatalf("Expected an error for a route with no handler")
+	}
+}
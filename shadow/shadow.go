@@ -0,0 +1,457 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shadow mirrors writes to a secondary backend while serving from a
+// primary one, for migrating between caches or proxy clusters.
+package shadow
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"log"
+	"math/rand"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricShadowQueued          = metrics.AddCounter("shadow_queued", nil)
+	MetricShadowDropped         = metrics.AddCounter("shadow_dropped", nil)
+	MetricShadowSecondaryErrors = metrics.AddCounter("shadow_secondary_errors", nil)
+	MetricShadowQueueDepth      = metrics.AddIntGauge("shadow_queue_depth", nil)
+
+	MetricShadowCompares          = metrics.AddCounter("shadow_compares", nil)
+	MetricShadowCompareMatches    = metrics.AddCounter("shadow_compare_matches", nil)
+	MetricShadowCompareMismatches = metrics.AddCounter("shadow_compare_mismatches", nil)
+	MetricShadowCompareMisses     = metrics.AddCounter("shadow_compare_secondary_misses", nil)
+	MetricShadowCompareExtra      = metrics.AddCounter("shadow_compare_secondary_extra", nil)
+	MetricShadowCompareDropped    = metrics.AddCounter("shadow_compare_dropped", nil)
+)
+
+const (
+	// DefaultQueueSize is the number of writes waiting for the secondary beyond
+	// which new ones are dropped
+	DefaultQueueSize = 10000
+
+	// DefaultWorkers is the number of concurrent requests to the secondary
+	DefaultWorkers = 4
+)
+
+// Options configures a Shadow
+type Options struct {
+	// QueueSize bounds the writes waiting for the secondary. When the queue is
+	// full new ones are dropped and counted. Compares get a tenth as much room
+	// of their own. Zero means DefaultQueueSize.
+	QueueSize int
+
+	// Workers is the number of goroutines sending queued writes to the
+	// secondary. The queue is split between them by key, so writes of a key
+	// reach the secondary in the order they were made. Compares have a worker
+	// of their own. Zero means DefaultWorkers.
+	Workers int
+
+	// CompareRate is the fraction of keys read from the primary that are also
+	// read from the secondary in the background to compare the results. Zero
+	// disables comparing.
+	CompareRate float64
+}
+
+type taskKind int
+
+const (
+	taskSet taskKind = iota
+	taskDelete
+	taskTouch
+	taskCompare
+)
+
+// task is a request queued for the secondary. For compares, res is what the
+// primary returned.
+type task struct {
+	kind taskKind
+	set  common.SetRequest
+	key  []byte
+	ttl  uint32
+	res  common.GetResponse
+}
+
+// Shadow sends all requests to a primary backend and mirrors sets, deletes
+// and touches to a secondary backend asynchronously. Reads are served by the
+// primary alone. The secondary's results never affect responses to clients.
+type Shadow struct {
+	primary     handlers.HandlerConst
+	compareRate float64
+
+	// Writes of a key always go to the same shard, which one worker sends in
+	// order. Compares have their own smaller queue so they are dropped before
+	// writes are.
+	shards   []chan task
+	compares chan task
+	workers  sync.WaitGroup
+
+	// guards against sending on the queues after Drain has closed them
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New creates a Shadow and starts its workers
+func New(primary, secondary handlers.HandlerConst, opts Options) (*Shadow, error) {
+	if opts.QueueSize < 0 || opts.Workers < 0 {
+		return nil, errors.New("queue size and workers must not be negative")
+	}
+	if opts.CompareRate < 0 || opts.CompareRate > 1 {
+		return nil, errors.New("compare rate must be between 0 and 1")
+	}
+
+	if opts.QueueSize == 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.Workers == 0 {
+		opts.Workers = DefaultWorkers
+	}
+
+	s := &Shadow{
+		primary:     primary,
+		compareRate: opts.CompareRate,
+		shards:      make([]chan task, opts.Workers),
+	}
+
+	// The queue is split evenly between the shards
+	size := (opts.QueueSize + opts.Workers - 1) / opts.Workers
+	queues := s.shards
+	if s.compareRate > 0 {
+		s.compares = make(chan task, (opts.QueueSize+compareQueueShare-1)/compareQueueShare)
+		queues = append(queues[:len(queues):len(queues)], s.compares)
+	}
+
+	for i, q := range queues {
+		if i < len(s.shards) {
+			q = make(chan task, size)
+			s.shards[i] = q
+		}
+
+		h, err := secondary()
+		if err != nil {
+			s.Drain()
+			return nil, err
+		}
+
+		s.workers.Add(1)
+		go s.work(h, q)
+	}
+
+	return s, nil
+}
+
+// compareQueueShare is the fraction of QueueSize, as 1/compareQueueShare, that
+// compares can queue
+const compareQueueShare = 10
+
+// Handler is the constructor for the handlers serving clients
+func (s *Shadow) Handler() handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, err := s.primary()
+		if err != nil {
+			return nil, err
+		}
+		return &Handler{primary: h, shadow: s}, nil
+	}
+}
+
+// Drain stops accepting new work and waits for the queued work to finish
+func (s *Shadow) Drain() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, q := range s.shards {
+			if q != nil {
+				close(q)
+			}
+		}
+		if s.compares != nil {
+			close(s.compares)
+		}
+	}
+	s.mu.Unlock()
+
+	s.workers.Wait()
+}
+
+// shard returns the queue for writes of key
+func (s *Shadow) shard(key []byte) chan task {
+	return s.shards[crc32.ChecksumIEEE(key)%uint32(len(s.shards))]
+}
+
+func (s *Shadow) setDepth() {
+	depth := len(s.compares)
+	for _, q := range s.shards {
+		depth += len(q)
+	}
+	metrics.SetIntGauge(MetricShadowQueueDepth, uint64(depth))
+}
+
+// enqueue queues a task for the secondary without blocking
+func (s *Shadow) enqueue(t task) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		metrics.IncCounter(MetricShadowDropped)
+		return
+	}
+
+	var q chan task
+	switch t.kind {
+	case taskSet:
+		q = s.shard(t.set.Key)
+	case taskCompare:
+		q = s.compares
+	default:
+		q = s.shard(t.key)
+	}
+
+	select {
+	case q <- t:
+		metrics.IncCounter(MetricShadowQueued)
+	default:
+		if t.kind == taskCompare {
+			metrics.IncCounter(MetricShadowCompareDropped)
+		} else {
+			metrics.IncCounter(MetricShadowDropped)
+		}
+	}
+
+	s.setDepth()
+}
+
+func (s *Shadow) work(h handlers.Handler, q chan task) {
+	defer s.workers.Done()
+	defer h.Close()
+
+	for t := range q {
+		s.setDepth()
+
+		var err error
+		switch t.kind {
+		case taskSet:
+			err = h.Set(t.set)
+		case taskDelete:
+			err = h.Delete(common.DeleteRequest{Key: t.key})
+		case taskTouch:
+			err = h.Touch(common.TouchRequest{Key: t.key, Exptime: t.ttl})
+		case taskCompare:
+			err = compare(h, t.res)
+		}
+
+		// Misses are expected while the secondary fills up
+		if err != nil && err != common.ErrKeyNotFound {
+			metrics.IncCounter(MetricShadowSecondaryErrors)
+		}
+	}
+}
+
+// compare reads a key from the secondary and compares it to what the primary
+// returned for it
+func compare(h handlers.Handler, primary common.GetResponse) error {
+	dataIn, errorIn := h.Get(common.GetRequest{
+		Keys:    [][]byte{primary.Key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var secondary *common.GetResponse
+	for dataIn != nil || errorIn != nil {
+		select {
+		case res, ok := <-dataIn:
+			if !ok {
+				dataIn = nil
+				continue
+			}
+			secondary = &res
+
+		case err, ok := <-errorIn:
+			if !ok {
+				errorIn = nil
+				continue
+			}
+			return err
+		}
+	}
+
+	if secondary == nil {
+		return errors.New("no response from secondary")
+	}
+
+	metrics.IncCounter(MetricShadowCompares)
+
+	switch {
+	case primary.Miss && secondary.Miss:
+		metrics.IncCounter(MetricShadowCompareMatches)
+	case secondary.Miss:
+		metrics.IncCounter(MetricShadowCompareMisses)
+	case primary.Miss:
+		metrics.IncCounter(MetricShadowCompareExtra)
+	case primary.Flags != secondary.Flags || !bytes.Equal(primary.Data, secondary.Data):
+		log.Printf("[SHADOW] Value for key %q differs between primary and secondary\n", primary.Key)
+		metrics.IncCounter(MetricShadowCompareMismatches)
+	default:
+		metrics.IncCounter(MetricShadowCompareMatches)
+	}
+
+	return nil
+}
+
+// sampled reports whether a key read from the primary should be compared
+func (s *Shadow) sampled() bool {
+	return s.compareRate > 0 && rand.Float64() < s.compareRate
+}
+
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// Handler serves a client connection from the primary and queues writes for
+// the secondary
+type Handler struct {
+	primary handlers.Handler
+	shadow  *Shadow
+}
+
+// Set sets the item on the primary and queues it for the secondary if that
+// succeeded
+func (h *Handler) Set(cmd common.SetRequest) error {
+	if err := h.primary.Set(cmd); err != nil {
+		return err
+	}
+
+	// The request buffers may be reused once this returns
+	cmd.Key = clone(cmd.Key)
+	cmd.Data = clone(cmd.Data)
+	h.shadow.enqueue(task{kind: taskSet, set: cmd})
+
+	return nil
+}
+
+// Delete deletes the item on the primary and queues the delete for the
+// secondary, which may have the item even if the primary doesn't
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	err := h.primary.Delete(cmd)
+	if err == nil || err == common.ErrKeyNotFound {
+		h.shadow.enqueue(task{kind: taskDelete, key: clone(cmd.Key)})
+	}
+	return err
+}
+
+// Touch touches the item on the primary and queues the touch for the secondary
+// so the copies expire together
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	err := h.primary.Touch(cmd)
+	if err == nil {
+		h.shadow.enqueue(task{kind: taskTouch, key: clone(cmd.Key), ttl: cmd.Exptime})
+	}
+	return err
+}
+
+// Get reads from the primary, sampling keys to compare against the secondary
+// if configured to
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataIn, errorIn := h.primary.Get(cmd)
+	if h.shadow.compareRate == 0 {
+		return dataIn, errorIn
+	}
+
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		for dataIn != nil || errorIn != nil {
+			select {
+			case res, ok := <-dataIn:
+				if !ok {
+					dataIn = nil
+					continue
+				}
+
+				if h.shadow.sampled() {
+					c := res
+					c.Key = clone(res.Key)
+					c.Data = clone(res.Data)
+					h.shadow.enqueue(task{kind: taskCompare, res: c})
+				}
+
+				dataOut <- res
+
+			case err, ok := <-errorIn:
+				if !ok {
+					errorIn = nil
+					continue
+				}
+				// Handlers stop at the first error and may not close the
+				// channel after it
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE reads from the primary
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return h.primary.GetE(cmd)
+}
+
+// GAT reads from the primary
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return h.primary.GAT(cmd)
+}
+
+// Add is passed to the primary only
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.primary.Add(cmd)
+}
+
+// Replace is passed to the primary only
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.primary.Replace(cmd)
+}
+
+// Append is passed to the primary only
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.primary.Append(cmd)
+}
+
+// Prepend is passed to the primary only
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.primary.Prepend(cmd)
+}
+
+// Close closes the primary handler for the connection. The workers keep their
+// own secondary handlers.
+func (h *Handler) Close() error {
+	return h.primary.Close()
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadow_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend-http/shadow"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// memHandler is a handler that keeps items in a map
+type memHandler struct {
+	sync.Mutex
+	data    map[string]string
+	numGets int
+
+	// if set, sets wait for it to be closed
+	block chan struct{}
+
+	// if set, gets wait for it to be closed
+	getBlock chan struct{}
+}
+
+func newMemHandler() *memHandler {
+	return &memHandler{data: make(map[string]string)}
+}
+
+func (m *memHandler) hc() handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return m, nil }
+}
+
+func (m *memHandler) get(key string) (string, bool) {
+	m.Lock()
+	defer m.Unlock()
+	v, ok := m.data[key]
+	return v, ok
+}
+
+func (m *memHandler) Set(cmd common.SetRequest) error {
+	if m.block != nil {
+		<-m.block
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *memHandler) Delete(cmd common.DeleteRequest) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(m.data, string(cmd.Key))
+	return nil
+}
+
+func (m *memHandler) Add(cmd common.SetRequest) error     { return common.ErrUnknownCmd }
+func (m *memHandler) Replace(cmd common.SetRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Append(cmd common.SetRequest) error  { return common.ErrUnknownCmd }
+func (m *memHandler) Prepend(cmd common.SetRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Touch(cmd common.TouchRequest) error { return common.ErrUnknownCmd }
+func (m *memHandler) Close() error                        { return nil }
+
+func (m *memHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if m.getBlock != nil {
+		<-m.getBlock
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.numGets++
+
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	for _, key := range cmd.Keys {
+		data, ok := m.data[string(key)]
+		dataOut <- common.GetResponse{Key: key, Data: []byte(data), Miss: !ok}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (m *memHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	return nil, errchan
+}
+
+func (m *memHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{}, common.ErrUnknownCmd
+}
+
+func setup(t *testing.T, opts shadow.Options) (*memHandler, *memHandler, *shadow.Shadow, handlers.Handler) {
+	primary, secondary := newMemHandler(), newMemHandler()
+
+	s, err := shadow.New(primary.hc(), secondary.hc(), opts)
+	if err != nil {
+		t.Fatalf("Failed to create shadow: %v", err)
+	}
+
+	h, err := s.Handler()()
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	return primary, secondary, s, h
+}
+
+func getOne(t *testing.T, h handlers.Handler, key string) common.GetResponse {
+	datchan, errchan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var ret common.GetResponse
+	for datchan != nil || errchan != nil {
+		select {
+		case res, ok := <-datchan:
+			if !ok {
+				datchan = nil
+				continue
+			}
+			ret = res
+		case err, ok := <-errchan:
+			if !ok {
+				errchan = nil
+				continue
+			}
+			t.Fatalf("Failed to get: %v", err)
+		}
+	}
+
+	return ret
+}
+
+func TestDualWrite(t *testing.T) {
+	primary, secondary, s, h := setup(t, shadow.Options{})
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	if err := h.Set(common.SetRequest{Key: []byte("baz"), Data: []byte("qux")}); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	if err := h.Delete(common.DeleteRequest{Key: []byte("baz")}); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	s.Drain()
+
+	if v, _ := primary.get("foo"); v != "bar" {
+		t.Fatalf("Primary is missing the set")
+	}
+	if v, _ := secondary.get("foo"); v != "bar" {
+		t.Fatalf("Secondary is missing the set")
+	}
+	if _, ok := secondary.get("baz"); ok {
+		t.Fatalf("Secondary is missing the delete")
+	}
+}
+
+func TestReadsFromPrimary(t *testing.T) {
+	primary, secondary, s, h := setup(t, shadow.Options{})
+	primary.data["foo"] = "primary"
+	secondary.data["foo"] = "secondary"
+
+	res := getOne(t, h, "foo")
+	s.Drain()
+
+	if string(res.Data) != "primary" {
+		t.Fatalf("Expected the primary's value but got %q", res.Data)
+	}
+	if secondary.numGets != 0 {
+		t.Fatalf("Expected no reads from the secondary but got %d", secondary.numGets)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	primary, secondary, s, h := setup(t, shadow.Options{CompareRate: 1})
+	primary.data["foo"] = "primary"
+	secondary.data["foo"] = "secondary"
+
+	res := getOne(t, h, "foo")
+	s.Drain()
+
+	if string(res.Data) != "primary" {
+		t.Fatalf("Expected the primary's value but got %q", res.Data)
+	}
+	if secondary.numGets != 1 {
+		t.Fatalf("Expected the read to be compared with the secondary but got %d reads", secondary.numGets)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	primary, secondary := newMemHandler(), newMemHandler()
+	secondary.block = make(chan struct{})
+
+	s, err := shadow.New(primary.hc(), secondary.hc(), shadow.Options{QueueSize: 1, Workers: 1})
+	if err != nil {
+		t.Fatalf("Failed to create shadow: %v", err)
+	}
+	h, _ := s.Handler()()
+
+	// One held by the worker, one queued and the rest dropped
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)}); err != nil {
+			t.Fatalf("Set failed even though the primary is fine: %v", err)
+		}
+	}
+
+	close(secondary.block)
+	s.Drain()
+
+	if len(primary.data) != 4 {
+		t.Fatalf("Expected all sets on the primary but got %v", primary.data)
+	}
+	if n := len(secondary.data); n == 0 || n > 2 {
+		t.Fatalf("Expected one or two sets on the secondary but got %v", secondary.data)
+	}
+}
+
+func TestWriteOrder(t *testing.T) {
+	_, secondary, s, h := setup(t, shadow.Options{Workers: 4})
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(strconv.Itoa(i))
+		h.Set(common.SetRequest{Key: key, Data: key})
+		h.Delete(common.DeleteRequest{Key: key})
+	}
+	s.Drain()
+
+	if len(secondary.data) != 0 {
+		t.Fatalf("Expected every delete to follow its set but got %d keys left on the secondary", len(secondary.data))
+	}
+}
+
+func TestComparesDropFirst(t *testing.T) {
+	primary, secondary := newMemHandler(), newMemHandler()
+	secondary.getBlock = make(chan struct{})
+
+	s, err := shadow.New(primary.hc(), secondary.hc(), shadow.Options{QueueSize: 10, Workers: 1, CompareRate: 1})
+	if err != nil {
+		t.Fatalf("Failed to create shadow: %v", err)
+	}
+	h, _ := s.Handler()()
+
+	// The compare worker is stuck, so its queue fills and the rest are dropped
+	primary.data["foo"] = "bar"
+	for i := 0; i < 10; i++ {
+		getOne(t, h, "foo")
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)})
+	}
+
+	close(secondary.getBlock)
+	s.Drain()
+
+	if len(secondary.data) != 4 {
+		t.Fatalf("Expected all sets on the secondary but got %v", secondary.data)
+	}
+	if secondary.numGets > 2 {
+		t.Fatalf("Expected most compares to be dropped but got %d reads", secondary.numGets)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	m := newMemHandler()
+
+	for _, opts := range []shadow.Options{
+		{QueueSize: -1},
+		{Workers: -1},
+		{CompareRate: 2},
+	} {
+		if _, err := shadow.New(m.hc(), m.hc(), opts); err == nil {
+			t.Fatalf("Expected an error for %#v", opts)
+		}
+	}
+}